@@ -0,0 +1,255 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// The api handler serves the same information as the console as json, for scripts and dashboards.
+// Every request names what it wants by the last element of the url path:
+//
+//   jobs?prefix=&stage=&after=&before=&order=&cursor=&limit=
+//                                        jobs, most recently updated first unless order is given
+//                                        (see JobQuery and JobOrder); prefix must be a job's whole
+//                                        UrlPrefix, after and before are RFC 3339 times, and cursor
+//                                        comes from the previous page
+//   job?id=                              the job along with how many of its tasks are in each status
+//   tasks?id=&status=                    the job's tasks, optionally only those with the statuses given
+//   results?id=                          the Result of each of the job's tasks (like GetJobTaskResults)
+//   cancel?id=, retry?id=, delete?id=    change the job; these must be POSTed, and only jobs which
+//                                        have finished can be deleted
+//
+// Errors are returned as {"Error": "..."}.
+
+// how many jobs are returned by default, and at most, by a single jobs request
+const apiDefaultJobLimit = 50
+const apiMaxJobLimit = 1000
+
+// ApiHandler serves a json api for jobs which keep their state in the appengine datastore; retried
+// jobs are posted through taskIntf
+func ApiHandler(taskIntf TaskInterface) http.HandlerFunc {
+	return ApiStoreHandler(taskIntf, appengine.NewContext, func(c context.Context) JobStore {
+		return NewDatastoreJobStore(c, appwrap.NewAppengineDatastore(c))
+	}, appwrap.NewAppengineLogging)
+}
+
+// ApiStoreHandler returns an api handler for jobs which keep their state in the JobStore returned
+// by getStore; like MapReduceStoreHandler, getContext, getStore and getLogger are called for each
+// request
+func ApiStoreHandler(taskIntf TaskInterface, getContext func(r *http.Request) context.Context,
+	getStore func(c context.Context) JobStore, getLogger func(c context.Context) appwrap.Logging) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := getContext(r)
+		apiHandler(c, w, r, getStore(c), taskIntf, getLogger(c))
+	}
+}
+
+// apiBadRequest is an error in the request itself
+type apiBadRequest struct{ err string }
+
+func (e apiBadRequest) Error() string { return e.err }
+
+// apiJobList is the response to a jobs request; Cursor is empty on the last page
+type apiJobList struct {
+	Jobs   []JobInfo
+	Cursor string `json:",omitempty"`
+}
+
+// apiJob is the response to a job request
+type apiJob struct {
+	Job   JobInfo
+	Tasks map[TaskStatus]int
+}
+
+func apiHandler(c context.Context, w http.ResponseWriter, r *http.Request, store JobStore, taskIntf TaskInterface, log appwrap.Logging) {
+	var response interface{}
+	var err error
+
+	r.ParseForm()
+	path := r.URL.Path
+	action := path[strings.LastIndex(path, "/")+1:]
+	switch action {
+	case "jobs":
+		response, err = apiListJobs(store, r)
+	case "cancel", "retry", "delete":
+		if r.Method != "POST" {
+			writeApiJson(w, http.StatusMethodNotAllowed, map[string]string{"Error": "POST required"})
+			return
+		}
+
+		response, err = apiChangeJob(c, store, taskIntf, action, r, log)
+	case "job", "tasks", "results":
+		jobId, idErr := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if idErr != nil {
+			err = apiBadRequest{fmt.Sprintf("invalid id: %s", idErr)}
+		} else if action == "job" {
+			response, err = apiGetJob(store, jobId)
+		} else if action == "tasks" {
+			response, err = apiListTasks(store, jobId, r.Form["status"])
+		} else {
+			var job JobInfo
+			if job, err = store.GetJob(jobId); err == nil {
+				var results []interface{}
+				results, err = jobTaskResults(store, job)
+				response = map[string][]interface{}{"Results": results}
+			}
+		}
+	default:
+		writeApiJson(w, http.StatusNotFound, map[string]string{"Error": "unknown request url"})
+		return
+	}
+
+	if _, ok := err.(apiBadRequest); ok {
+		writeApiJson(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+	} else if err == datastore.ErrNoSuchEntity {
+		writeApiJson(w, http.StatusNotFound, map[string]string{"Error": err.Error()})
+	} else if err != nil {
+		writeApiJson(w, http.StatusInternalServerError, map[string]string{"Error": err.Error()})
+	} else {
+		writeApiJson(w, http.StatusOK, response)
+	}
+}
+
+func writeApiJson(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// apiListJobs returns a page of the jobs which match the request's parameters
+func apiListJobs(store JobStore, r *http.Request) (apiJobList, error) {
+	query, err := jobQueryFromForm(r, apiDefaultJobLimit, apiMaxJobLimit)
+	if err != nil {
+		return apiJobList{}, apiBadRequest{err.Error()}
+	}
+
+	jobs, cursor, err := store.QueryJobs(query)
+	if _, ok := err.(invalidJobCursorError); ok {
+		return apiJobList{}, apiBadRequest{err.Error()}
+	} else if err != nil {
+		return apiJobList{}, err
+	}
+
+	return apiJobList{Jobs: jobs, Cursor: cursor}, nil
+}
+
+// apiGetJob returns the job along with the number of tasks in each status; the tasks are the ones
+// the console shows
+func apiGetJob(store JobStore, jobId int64) (apiJob, error) {
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		return apiJob{}, err
+	}
+
+	tasks, err := jobPageTasks(store, job)
+	if err != nil {
+		return apiJob{}, fmt.Errorf("reading tasks: %s", err)
+	}
+
+	summary := make(map[TaskStatus]int)
+	for _, task := range tasks {
+		summary[task.Status]++
+	}
+
+	return apiJob{Job: job, Tasks: summary}, nil
+}
+
+// apiListTasks returns all of the job's tasks, or only the ones with one of the statuses if any
+// are given
+func apiListTasks(store JobStore, jobId int64, statuses []string) (map[string][]JobTask, error) {
+	if _, err := store.GetJob(jobId); err != nil {
+		return nil, err
+	}
+
+	tasks, err := store.JobTasks(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(statuses) > 0 {
+		wanted := make(map[TaskStatus]bool)
+		for _, status := range statuses {
+			wanted[TaskStatus(status)] = true
+		}
+
+		filtered := make([]JobTask, 0, len(tasks))
+		for _, task := range tasks {
+			if wanted[task.Status] {
+				filtered = append(filtered, task)
+			}
+		}
+		tasks = filtered
+	}
+
+	return map[string][]JobTask{"Tasks": tasks}, nil
+}
+
+// apiChangeJob cancels, retries or deletes a job. The job is returned afterwards, except for
+// delete.
+func apiChangeJob(c context.Context, store JobStore, taskIntf TaskInterface, action string, r *http.Request, log appwrap.Logging) (interface{}, error) {
+	jobId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return nil, apiBadRequest{fmt.Sprintf("invalid id: %s", err)}
+	}
+
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	finished := job.Stage == StageDone || job.Stage == StageFailed || job.Stage == StageCancelled
+
+	switch action {
+	case "cancel":
+		if finished {
+			return nil, apiBadRequest{fmt.Sprintf("job %d is already %s", jobId, job.Stage)}
+		} else if err := CancelJobWithStore(store, jobId); err != nil {
+			return nil, err
+		}
+	case "retry":
+		if job.Stage != StageFailed && job.Stage != StageCancelled {
+			return nil, apiBadRequest{fmt.Sprintf("job %d is %s; only failed or cancelled jobs can be retried", jobId, job.Stage)}
+		} else if job.ChainId != 0 {
+			return nil, apiBadRequest{fmt.Sprintf("job %d is part of chain %d and can't be retried on its own", jobId, job.ChainId)}
+		} else if err := RetryJobWithStore(c, store, taskIntf, jobId, log); err != nil {
+			return nil, err
+		}
+	case "delete":
+		if !finished {
+			return nil, apiBadRequest{fmt.Sprintf("job %d is %s; cancel it before deleting it", jobId, job.Stage)}
+		} else if intStorage, ok := taskIntf.(IntermediateStorage); !ok {
+			if err := store.RemoveJob(jobId); err != nil {
+				return nil, err
+			}
+		} else if err := RemoveJobWithStore(c, store, intStorage, jobId, log); err != nil {
+			return nil, err
+		}
+
+		return map[string]int64{"Deleted": jobId}, nil
+	}
+
+	return store.GetJob(jobId)
+}
@@ -0,0 +1,325 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// apiRequest makes a request to the api handler and decodes the json response into response
+func (mrt *MapreduceTests) apiRequest(c *ck.C, store JobStore, taskIntf TaskInterface, method string, reqUrl string, response interface{}) int {
+	req, _ := http.NewRequest(method, reqUrl, nil)
+	w := httptest.NewRecorder()
+	apiHandler(appwrap.StubContext(), w, req, store, taskIntf, mrt.nullLog)
+	c.Assert(w.Header().Get("Content-Type"), ck.Equals, "application/json")
+	if response != nil {
+		c.Assert(json.Unmarshal(w.Body.Bytes(), response), ck.IsNil)
+	}
+
+	return w.Code
+}
+
+func (mrt *MapreduceTests) TestApiJobs(c *ck.C) {
+	store := NewMemoryJobStore()
+
+	jobIds := make([]int64, 0)
+	for i, stage := range []JobStage{StageMapping, StageDone, StageFailed, StageDone, StageDone} {
+		prefix := "/mr/even"
+		if i%2 == 1 {
+			prefix = "/mr/odd"
+		}
+
+		jobId, err := createJob(store, JobInfo{UrlPrefix: prefix, WriterNames: []string{}})
+		c.Assert(err, ck.IsNil)
+		_, err = store.UpdateJob(jobId, func(job *JobInfo) error {
+			job.Stage = stage
+			return nil
+		})
+		c.Assert(err, ck.IsNil)
+		jobIds = append(jobIds, jobId)
+	}
+
+	listIds := func(query string) ([]int64, string) {
+		var list apiJobList
+		c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/jobs?"+query, &list), ck.Equals, 200)
+		ids := make([]int64, len(list.Jobs))
+		for i, job := range list.Jobs {
+			ids[i] = job.Id
+		}
+		sort.Sort(int64Slice(ids))
+		return ids, list.Cursor
+	}
+
+	ids, cursor := listIds("")
+	c.Assert(ids, ck.DeepEquals, jobIds)
+	c.Assert(cursor, ck.Equals, "")
+
+	ids, _ = listIds("prefix=/mr/odd")
+	c.Assert(ids, ck.DeepEquals, []int64{jobIds[1], jobIds[3]})
+
+	ids, _ = listIds("stage=done")
+	c.Assert(ids, ck.DeepEquals, []int64{jobIds[1], jobIds[3], jobIds[4]})
+
+	ids, _ = listIds("prefix=/mr/even&stage=done")
+	c.Assert(ids, ck.DeepEquals, []int64{jobIds[4]})
+
+	// pages of two
+	seen := []int64{}
+	pages := 0
+	for query := "limit=2"; query != ""; pages++ {
+		ids, cursor = listIds(query)
+		seen = append(seen, ids...)
+		query = ""
+		if cursor != "" {
+			query = "limit=2&cursor=" + cursor
+		}
+	}
+	sort.Sort(int64Slice(seen))
+	c.Assert(seen, ck.DeepEquals, jobIds)
+	c.Assert(pages, ck.Equals, 3)
+
+	var apiErr map[string]string
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/jobs?limit=none", &apiErr), ck.Equals, 400)
+	c.Assert(apiErr["Error"], ck.Equals, "invalid limit none")
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/jobs?cursor=-1", nil), ck.Equals, 400)
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/jobs?order=Id", nil), ck.Equals, 400)
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/jobs?after=yesterday", nil), ck.Equals, 400)
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/unknown", nil), ck.Equals, 404)
+
+	// the store handler doesn't need appengine
+	handler := ApiStoreHandler(nil, func(*http.Request) context.Context { return context.Background() },
+		func(context.Context) JobStore { return store }, mrt.LoggerFn)
+	req, _ := http.NewRequest("GET", "/api/jobs", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	c.Assert(w.Code, ck.Equals, 200)
+}
+
+func (mrt *MapreduceTests) TestApiJobTasks(c *ck.C) {
+	store := NewMemoryJobStore()
+
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "/mr/test", WriterNames: []string{}})
+	c.Assert(err, ck.IsNil)
+	firstId, err := store.AllocateTaskIds(3)
+	c.Assert(err, ck.IsNil)
+	taskIds := makeTaskIds(firstId, 3)
+	tasks := []JobTask{
+		{Status: TaskStatusDone, Type: TaskTypeMap, Result: `"first"`},
+		{Status: TaskStatusDone, Type: TaskTypeMap, Result: `"second"`},
+		{Status: TaskStatusRunning, Type: TaskTypeMap},
+	}
+	c.Assert(createTasks(store, jobId, taskIds, tasks, StageMapping, mrt.nullLog), ck.IsNil)
+
+	var job apiJob
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", fmt.Sprintf("/api/job?id=%d", jobId), &job), ck.Equals, 200)
+	c.Assert(job.Job.Id, ck.Equals, jobId)
+	c.Assert(job.Job.Stage, ck.Equals, StageMapping)
+	c.Assert(job.Tasks, ck.DeepEquals, map[TaskStatus]int{TaskStatusDone: 2, TaskStatusRunning: 1})
+
+	var taskList map[string][]JobTask
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", fmt.Sprintf("/api/tasks?id=%d", jobId), &taskList), ck.Equals, 200)
+	c.Assert(taskList["Tasks"], ck.HasLen, 3)
+
+	taskList = nil
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", fmt.Sprintf("/api/tasks?id=%d&status=running&status=failed", jobId), &taskList), ck.Equals, 200)
+	c.Assert(taskList["Tasks"], ck.HasLen, 1)
+	c.Assert(taskList["Tasks"][0].Id, ck.Equals, taskIds[2])
+
+	var results map[string][]interface{}
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", fmt.Sprintf("/api/results?id=%d", jobId), &results), ck.Equals, 200)
+	c.Assert(results["Results"], ck.DeepEquals, []interface{}{"first", "second", nil})
+
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/job?id=12345", nil), ck.Equals, 404)
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/tasks?id=12345", nil), ck.Equals, 404)
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", "/api/job?id=bad", nil), ck.Equals, 400)
+
+	// changes have to be POSTed
+	c.Assert(mrt.apiRequest(c, store, nil, "GET", fmt.Sprintf("/api/cancel?id=%d", jobId), nil), ck.Equals, 405)
+
+	// running jobs have to be cancelled before they're deleted
+	c.Assert(mrt.apiRequest(c, store, nil, "POST", fmt.Sprintf("/api/delete?id=%d", jobId), nil), ck.Equals, 400)
+
+	var cancelled JobInfo
+	c.Assert(mrt.apiRequest(c, store, nil, "POST", fmt.Sprintf("/api/cancel?id=%d", jobId), &cancelled), ck.Equals, 200)
+	c.Assert(cancelled.Stage, ck.Equals, StageCancelled)
+	c.Assert(mrt.apiRequest(c, store, nil, "POST", fmt.Sprintf("/api/cancel?id=%d", jobId), nil), ck.Equals, 400)
+
+	c.Assert(mrt.apiRequest(c, store, nil, "POST", fmt.Sprintf("/api/delete?id=%d", jobId), nil), ck.Equals, 200)
+	_, err = store.GetJob(jobId)
+	c.Assert(err, ck.NotNil)
+	c.Assert(mrt.apiRequest(c, store, nil, "POST", fmt.Sprintf("/api/delete?id=%d", jobId), nil), ck.Equals, 404)
+}
+
+func (mrt *MapreduceTests) TestApiRetryJob(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	// runStage runs each of the posted tasks, and then the monitor which starts the next stage
+	runStage := func() {
+		posted := u.posted
+		u.posted = nil
+
+		monitorUrl := ""
+		for _, taskUrl := range posted {
+			if strings.Contains(taskUrl, "-monitor") {
+				monitorUrl = taskUrl
+			} else {
+				serve(taskUrl)
+			}
+		}
+
+		c.Assert(monitorUrl, ck.Not(ck.Equals), "")
+		serve(monitorUrl)
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	// running jobs can't be retried
+	c.Assert(mrt.apiRequest(c, store, u, "POST", fmt.Sprintf("/api/retry?id=%d", jobId), nil), ck.Equals, 400)
+
+	// cancel the job once it's reducing; the monitor cleans up after it
+	mapUrls := u.posted
+	runStage()
+	started, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(started.Stage, ck.Equals, StageReducing)
+
+	c.Assert(mrt.apiRequest(c, store, u, "POST", fmt.Sprintf("/api/cancel?id=%d", jobId), nil), ck.Equals, 200)
+	runStage()
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageCancelled)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	var retried JobInfo
+	c.Assert(mrt.apiRequest(c, store, u, "POST", fmt.Sprintf("/api/retry?id=%d", jobId), &retried), ck.Equals, 200)
+	c.Assert(retried.Stage, ck.Equals, StageMapping)
+	c.Assert(retried.FirstTaskId, ck.Equals, started.MapTaskIds[0])
+	c.Assert(retried.TaskCount, ck.Equals, 5)
+	c.Assert(retried.StartTime.After(started.StartTime), ck.Equals, true)
+	c.Assert(retried.StageStartTime.Equal(retried.StartTime), ck.Equals, true)
+	c.Assert(u.posted, ck.DeepEquals, mapUrls)
+
+	// the reduce tasks are gone, and the map tasks are ready to go again
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks, ck.HasLen, 5)
+	for _, task := range tasks {
+		c.Check(task.Type, ck.Equals, TaskTypeMap)
+		c.Check(task.Status, ck.Equals, TaskStatusPending)
+		c.Check(task.Retries, ck.Equals, 0)
+		c.Check(task.Result, ck.Equals, "")
+		c.Check(task.StartTime.Equal(retried.StartTime), ck.Equals, true)
+	}
+
+	for _, stage := range []JobStage{StageReducing, StageDone} {
+		runStage()
+
+		info, err := store.GetJob(jobId)
+		c.Assert(err, ck.IsNil)
+		c.Assert(info.Stage, ck.Equals, stage)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	// finished jobs can't be retried either
+	c.Assert(RetryJobWithStore(appwrap.StubContext(), store, u, jobId, mrt.nullLog), ck.NotNil)
+}
+
+// testRetryRaceStore runs race before the first job update, as if another retry got there first
+type testRetryRaceStore struct {
+	JobStore
+	race func()
+}
+
+func (s *testRetryRaceStore) UpdateJob(jobId int64, f func(job *JobInfo) error) (JobInfo, error) {
+	if s.race != nil {
+		s.race()
+		s.race = nil
+	}
+
+	return s.JobStore.UpdateJob(jobId, f)
+}
+
+func (mrt *MapreduceTests) TestRetryJobRace(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(CancelJobWithStore(store, jobId), ck.IsNil)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	_, err = store.UpdateTask(tasks[0].Id, func(task *JobTask) error {
+		task.Status = TaskStatusDone
+		task.Result = "done"
+		return nil
+	})
+	c.Assert(err, ck.IsNil)
+	u.posted = nil
+
+	// the job is restarted after the retry loads it but before it claims it
+	racing := &testRetryRaceStore{JobStore: store, race: func() {
+		_, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+			job.Stage = StageMapping
+			return nil
+		})
+		c.Assert(err, ck.IsNil)
+	}}
+	c.Assert(RetryJobWithStore(appwrap.StubContext(), racing, u, jobId, mrt.nullLog), ck.ErrorMatches, ".*already map")
+
+	// the tasks weren't touched and nothing was posted
+	task, err := store.GetTask(tasks[0].Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+	c.Assert(task.Result, ck.Equals, "done")
+	c.Assert(u.posted, ck.HasLen, 0)
+}
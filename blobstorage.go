@@ -0,0 +1,237 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// BlobStore is the small part of an object store (like Google Cloud Storage or S3) which
+// BlobIntermediateStorage needs. Object names use / as a separator.
+type BlobStore interface {
+	// Put stores everything read from r as the named object, replacing any object which already
+	// has that name. The object must not become visible if r returns an error; r is usually being
+	// written to while Put runs, so implementations should stream it (with a multipart or resumable
+	// upload) rather than reading it all into memory.
+	Put(c context.Context, name string, r io.Reader) error
+	Get(c context.Context, name string) (io.ReadCloser, error)
+	// Delete removes the named object; deleting an object which doesn't exist is not an error
+	Delete(c context.Context, name string) error
+	// List returns the names of all of the objects whose names start with prefix
+	List(c context.Context, prefix string) ([]string, error)
+}
+
+// BlobIntermediateStorage is an IntermediateStorage which keeps intermediate data in the block
+// format as objects in a BlobStore, with names starting with Prefix. Like FileIntermediateStorage
+// the objects for each job share a prefix, so it implements IntermediateJobCleaner.
+type BlobIntermediateStorage struct {
+	Store  BlobStore
+	Prefix string
+}
+
+func NewBlobIntermediateStorage(store BlobStore, prefix string) *BlobIntermediateStorage {
+	return &BlobIntermediateStorage{Store: store, Prefix: prefix}
+}
+
+func (bs *BlobIntermediateStorage) jobPrefix(jobId int64) string {
+	return fmt.Sprintf("%sjob-%d/", bs.Prefix, jobId)
+}
+
+func (bs *BlobIntermediateStorage) CreateIntermediate(c context.Context, handler KeyValueHandler) (SingleIntermediateStorageWriter, error) {
+	name := bs.Prefix
+	if jobId, ok := JobIdFromContext(c); ok {
+		name = bs.jobPrefix(jobId)
+	}
+
+	// random names keep writers on different servers from colliding
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("creating intermediate name: %s", err)
+	}
+	name += "intermediate-" + hex.EncodeToString(id)
+
+	// the upload reads from the pipe as the block writer fills it
+	reader, writer := io.Pipe()
+	upload := &blobUpload{writer: writer, done: make(chan error, 1)}
+	go func() {
+		err := bs.Store.Put(c, name, reader)
+		// unblock the writer if Put gave up early
+		reader.CloseWithError(fmt.Errorf("upload of %s stopped: %v", name, err))
+		upload.done <- err
+	}()
+
+	return &blobIntermediateWriter{NewBlockIntermediateWriter(upload, handler), name}, nil
+}
+
+func (bs *BlobIntermediateStorage) Iterator(c context.Context, name string, handler KeyValueHandler) (IntermediateStorageIterator, error) {
+	r, err := bs.Store.Get(c, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBlockIntermediateIterator(r, handler), nil
+}
+
+func (bs *BlobIntermediateStorage) RemoveIntermediate(c context.Context, name string) error {
+	return bs.Store.Delete(c, name)
+}
+
+// RemoveJobIntermediates deletes all of the objects written by map and reduce tasks for a job. It
+// should only be called once the job has finished.
+func (bs *BlobIntermediateStorage) RemoveJobIntermediates(c context.Context, jobId int64) error {
+	names, err := bs.Store.List(c, bs.jobPrefix(jobId))
+	if err != nil {
+		return fmt.Errorf("listing intermediates: %s", err)
+	}
+
+	for _, name := range names {
+		if err := bs.Store.Delete(c, name); err != nil {
+			return fmt.Errorf("removing intermediate %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// blobUpload is the io.WriteCloser a BlobIntermediateWriter writes to; Close waits for the
+// BlobStore to finish storing the object and returns the error from Put
+type blobUpload struct {
+	writer *io.PipeWriter
+	done   chan error
+}
+
+func (u *blobUpload) Write(data []byte) (int, error) {
+	return u.writer.Write(data)
+}
+
+func (u *blobUpload) Close() error {
+	u.writer.Close()
+	return <-u.done
+}
+
+type blobIntermediateWriter struct {
+	*BlockIntermediateWriter
+	name string
+}
+
+func (w *blobIntermediateWriter) ToName() string {
+	return w.name
+}
+
+// DirectoryBlobStore is a BlobStore which keeps objects as files under Dir. It's meant for tests
+// and for running BlobIntermediateStorage without an object store; objects only appear once Put
+// has read all of their data, just as they do in real object stores.
+type DirectoryBlobStore struct {
+	Dir string
+}
+
+func NewDirectoryBlobStore(dir string) *DirectoryBlobStore {
+	return &DirectoryBlobStore{Dir: dir}
+}
+
+func (ds *DirectoryBlobStore) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+
+	return filepath.Join(ds.Dir, clean), nil
+}
+
+func (ds *DirectoryBlobStore) Put(c context.Context, name string, r io.Reader) error {
+	path, err := ds.path(name)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// temporary files start with a . so List() skips them
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	} else if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (ds *DirectoryBlobStore) Get(c context.Context, name string) (io.ReadCloser, error) {
+	path, err := ds.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (ds *DirectoryBlobStore) Delete(c context.Context, name string) error {
+	path, err := ds.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *DirectoryBlobStore) List(c context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(ds.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ds.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,183 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) TestDirectoryBlobStore(c *ck.C) {
+	dir, err := ioutil.TempDir("", "blobs")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	ctx := appwrap.StubContext()
+	store := NewDirectoryBlobStore(dir)
+
+	names, err := store.List(ctx, "")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.HasLen, 0)
+
+	c.Assert(store.Put(ctx, "a/one", strings.NewReader("first")), ck.IsNil)
+	c.Assert(store.Put(ctx, "a/two", strings.NewReader("second")), ck.IsNil)
+	c.Assert(store.Put(ctx, "b/three", strings.NewReader("third")), ck.IsNil)
+	c.Assert(store.Put(ctx, "a/one", strings.NewReader("replaced")), ck.IsNil)
+
+	r, err := store.Get(ctx, "a/one")
+	c.Assert(err, ck.IsNil)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(string(data), ck.Equals, "replaced")
+
+	names, err = store.List(ctx, "a/")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.DeepEquals, []string{"a/one", "a/two"})
+
+	// failed uploads don't leave anything behind
+	c.Assert(store.Put(ctx, "a/broken", io.MultiReader(strings.NewReader("partial"), &testErrReader{})), ck.NotNil)
+	_, err = store.Get(ctx, "a/broken")
+	c.Assert(os.IsNotExist(err), ck.Equals, true)
+
+	c.Assert(store.Delete(ctx, "a/one"), ck.IsNil)
+	c.Assert(store.Delete(ctx, "a/one"), ck.IsNil)
+	names, err = store.List(ctx, "")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.DeepEquals, []string{"a/two", "b/three"})
+
+	c.Assert(store.Put(ctx, "../escape", strings.NewReader("x")), ck.ErrorMatches, "invalid object name.*")
+}
+
+// testErrReader fails every read
+type testErrReader struct{}
+
+func (r *testErrReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("read failed")
+}
+
+// testFailingBlobStore fails uploads once it has read a few bytes
+type testFailingBlobStore struct {
+	*DirectoryBlobStore
+}
+
+func (fs testFailingBlobStore) Put(c context.Context, name string, r io.Reader) error {
+	io.ReadFull(r, make([]byte, 10))
+	return fmt.Errorf("upload failed")
+}
+
+func (mrt *MapreduceTests) TestBlobIntermediateStorage(c *ck.C) {
+	dir, err := ioutil.TempDir("", "blobs")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	ctx := appwrap.StubContext()
+	store := NewDirectoryBlobStore(dir)
+	storage := NewBlobIntermediateStorage(store, "intermediates/")
+	handler := testStringHandler{}
+
+	write := func(ctx context.Context, storage IntermediateStorage, items int) (string, error) {
+		w, err := storage.CreateIntermediate(ctx, handler)
+		c.Assert(err, ck.IsNil)
+		for i := 0; i < items; i++ {
+			if err := w.WriteMappedData(MappedData{Key: fmt.Sprintf("key %d", i), Value: fmt.Sprintf("value %d", i)}); err != nil {
+				w.Close(ctx)
+				return "", err
+			}
+		}
+
+		return w.ToName(), w.Close(ctx)
+	}
+
+	// enough data for several blocks, so it's streamed through the upload
+	name, err := write(withJobId(ctx, 7), storage, 50000)
+	c.Assert(err, ck.IsNil)
+	c.Assert(strings.HasPrefix(name, "intermediates/job-7/"), ck.Equals, true)
+
+	iter, err := storage.Iterator(ctx, name, handler)
+	c.Assert(err, ck.IsNil)
+	count := 0
+	for item, valid, err := iter.Next(); valid; item, valid, err = iter.Next() {
+		c.Assert(err, ck.IsNil)
+		c.Assert(item.Key, ck.Equals, fmt.Sprintf("key %d", count))
+		count++
+	}
+	iter.Close()
+	c.Assert(count, ck.Equals, 50000)
+
+	other, err := write(withJobId(ctx, 7), storage, 10)
+	c.Assert(err, ck.IsNil)
+	c.Assert(other, ck.Not(ck.Equals), name)
+	_, err = write(withJobId(ctx, 8), storage, 10)
+	c.Assert(err, ck.IsNil)
+
+	c.Assert(storage.RemoveIntermediate(ctx, other), ck.IsNil)
+	names, err := store.List(ctx, "")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.HasLen, 2)
+
+	c.Assert(storage.RemoveJobIntermediates(ctx, 7), ck.IsNil)
+	names, err = store.List(ctx, "")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.HasLen, 1)
+	c.Assert(strings.HasPrefix(names[0], "intermediates/job-8/"), ck.Equals, true)
+
+	// upload errors come back from the writer
+	failing := NewBlobIntermediateStorage(testFailingBlobStore{store}, "failing/")
+	_, err = write(ctx, failing, 50000)
+	c.Assert(err, ck.ErrorMatches, ".*upload failed.*")
+	names, err = store.List(ctx, "failing/")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.HasLen, 0)
+}
+
+type testLocalBlobStorage struct {
+	testLocalWordCount
+	*BlobIntermediateStorage
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerBlobStorage(c *ck.C) {
+	dir, err := ioutil.TempDir("", "blobs")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	store := NewDirectoryBlobStore(dir)
+	u := &testLocalBlobStorage{
+		testLocalWordCount:      testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}},
+		BlobIntermediateStorage: NewBlobIntermediateStorage(store, "mr/"),
+	}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	info, _, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+
+	names, err := store.List(appwrap.StubContext(), "")
+	c.Assert(err, ck.IsNil)
+	c.Assert(names, ck.HasLen, 0)
+}
@@ -0,0 +1,269 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+)
+
+// The block intermediate format is a compact binary alternative to the json lines written by
+// LineOutputWriter.WriteMappedData. Files start with blockFormatMagic, followed by blocks which
+// each have a header of three little endian uint32s (the compressed length, the uncompressed
+// length and the CRC-32C of the compressed data) and then the deflated records. The records use
+// the same length prefixed encoding as spills. A header with both lengths zero ends the file, so
+// truncated files are caught as well as corrupted ones.
+const blockFormatMagic = "MRB1"
+
+// records are collected until a block has this many bytes before it is compressed
+const blockFormatSize = 64 * 1024
+
+const blockHeaderSize = 12
+
+// blocks only go over blockFormatSize by a single record, so anything this big means the header
+// is corrupt
+const maxBlockSize = 1 << 30
+
+var blockCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeRecord writes a single item in the length prefixed format used by spills and blocks
+func writeRecord(w io.Writer, handler KeyValueHandler, item MappedData) error {
+	key := handler.KeyDump(item.Key)
+	value, err := handler.ValueDump(item.Value)
+	if err != nil {
+		return fmt.Errorf("error dumping item value: %s", err)
+	}
+
+	keyLen := int32(len(key))
+	if key == nil {
+		// the key is loaded from the value
+		keyLen = -1
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, keyLen); err != nil {
+		return err
+	} else if err := binary.Write(w, binary.LittleEndian, int32(len(value))); err != nil {
+		return err
+	} else if _, err := w.Write(key); err != nil {
+		return err
+	} else if _, err := w.Write(value); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readRecord reads an item written by writeRecord
+func readRecord(r io.Reader, handler KeyValueHandler) (MappedData, error) {
+	var keyLen, valueLen int32
+
+	if err := binary.Read(r, binary.LittleEndian, &keyLen); err != nil {
+		return MappedData{}, fmt.Errorf("error reading key length: %s", err)
+	} else if err := binary.Read(r, binary.LittleEndian, &valueLen); err != nil {
+		return MappedData{}, fmt.Errorf("error reading value length: %s", err)
+	} else if keyLen < -1 || valueLen < 0 {
+		return MappedData{}, fmt.Errorf("invalid record lengths %d/%d", keyLen, valueLen)
+	}
+
+	keyBytes := []byte{}
+	if keyLen > 0 {
+		keyBytes = make([]byte, keyLen)
+	}
+	valueBytes := make([]byte, valueLen)
+
+	var m MappedData
+
+	if _, err := io.ReadFull(r, keyBytes); err != nil {
+		return MappedData{}, fmt.Errorf("error reading key: %s", err)
+	} else if _, err := io.ReadFull(r, valueBytes); err != nil {
+		return MappedData{}, fmt.Errorf("error reading value: %s", err)
+	} else if m.Value, err = handler.ValueLoad(valueBytes); err != nil {
+		return MappedData{}, fmt.Errorf("error loading value: %s", err)
+	} else if keyLen == -1 {
+		m.Key = m.Value
+	} else if m.Key, err = handler.KeyLoad(keyBytes); err != nil {
+		return MappedData{}, fmt.Errorf("error loading key: %s", err)
+	}
+
+	return m, nil
+}
+
+// BlockIntermediateWriter writes intermediate data in the block format; it's normally embedded
+// in a SingleIntermediateStorageWriter which provides ToName()
+type BlockIntermediateWriter struct {
+	w       io.WriteCloser
+	handler KeyValueHandler
+	block   bytes.Buffer
+	started bool
+}
+
+func NewBlockIntermediateWriter(w io.WriteCloser, handler KeyValueHandler) *BlockIntermediateWriter {
+	return &BlockIntermediateWriter{w: w, handler: handler}
+}
+
+func (bw *BlockIntermediateWriter) WriteMappedData(item MappedData) error {
+	if err := writeRecord(&bw.block, bw.handler, item); err != nil {
+		return err
+	} else if bw.block.Len() >= blockFormatSize {
+		return bw.flush()
+	}
+
+	return nil
+}
+
+// flush compresses and writes out the current block (which may be empty)
+func (bw *BlockIntermediateWriter) flush() error {
+	if !bw.started {
+		if _, err := bw.w.Write([]byte(blockFormatMagic)); err != nil {
+			return err
+		}
+		bw.started = true
+	}
+
+	compressed := &bytes.Buffer{}
+	if bw.block.Len() > 0 {
+		fw, _ := flate.NewWriter(compressed, flate.DefaultCompression)
+		fw.Write(bw.block.Bytes())
+		fw.Close()
+	}
+
+	header := make([]byte, blockHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(compressed.Len()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(bw.block.Len()))
+	binary.LittleEndian.PutUint32(header[8:12], crc32.Checksum(compressed.Bytes(), blockCrcTable))
+
+	bw.block.Reset()
+
+	if _, err := bw.w.Write(header); err != nil {
+		return err
+	} else if _, err := bw.w.Write(compressed.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close writes out the last block and the end of file marker before closing the underlying writer
+func (bw *BlockIntermediateWriter) Close(c context.Context) error {
+	if bw.block.Len() > 0 {
+		if err := bw.flush(); err != nil {
+			bw.w.Close()
+			return err
+		}
+	}
+
+	// an empty block marks the end of the file
+	if err := bw.flush(); err != nil {
+		bw.w.Close()
+		return err
+	}
+
+	return bw.w.Close()
+}
+
+// BlockIntermediateIterator reads intermediate data written by a BlockIntermediateWriter
+type BlockIntermediateIterator struct {
+	r       *bufio.Reader
+	closer  io.Closer
+	handler KeyValueHandler
+	block   *bytes.Reader
+	started bool
+	done    bool
+}
+
+func NewBlockIntermediateIterator(r io.ReadCloser, handler KeyValueHandler) IntermediateStorageIterator {
+	return &BlockIntermediateIterator{
+		r:       bufio.NewReader(r),
+		closer:  r,
+		handler: handler,
+	}
+}
+
+func (bi *BlockIntermediateIterator) Close() error {
+	return bi.closer.Close()
+}
+
+func (bi *BlockIntermediateIterator) Next() (MappedData, bool, error) {
+	for !bi.done && (bi.block == nil || bi.block.Len() == 0) {
+		if err := bi.nextBlock(); err != nil {
+			return MappedData{}, false, err
+		}
+	}
+
+	if bi.done {
+		return MappedData{}, false, nil
+	}
+
+	item, err := readRecord(bi.block, bi.handler)
+	if err != nil {
+		return MappedData{}, false, fmt.Errorf("corrupt intermediate block: %s", err)
+	}
+
+	return item, true, nil
+}
+
+// nextBlock reads, checks and decompresses the next block
+func (bi *BlockIntermediateIterator) nextBlock() error {
+	if !bi.started {
+		magic := make([]byte, len(blockFormatMagic))
+		if _, err := io.ReadFull(bi.r, magic); err != nil {
+			return fmt.Errorf("error reading intermediate file header: %s", err)
+		} else if string(magic) != blockFormatMagic {
+			return fmt.Errorf("not a block intermediate file")
+		}
+		bi.started = true
+	}
+
+	header := make([]byte, blockHeaderSize)
+	if _, err := io.ReadFull(bi.r, header); err != nil {
+		return fmt.Errorf("intermediate file is truncated: %s", err)
+	}
+
+	compressedLen := binary.LittleEndian.Uint32(header[0:4])
+	rawLen := binary.LittleEndian.Uint32(header[4:8])
+	crc := binary.LittleEndian.Uint32(header[8:12])
+
+	if compressedLen == 0 && rawLen == 0 {
+		bi.done = true
+		return nil
+	} else if compressedLen > maxBlockSize || rawLen > maxBlockSize {
+		return fmt.Errorf("corrupt intermediate block header")
+	}
+
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(bi.r, compressed); err != nil {
+		return fmt.Errorf("intermediate file is truncated: %s", err)
+	} else if crc32.Checksum(compressed, blockCrcTable) != crc {
+		return fmt.Errorf("intermediate block failed checksum")
+	}
+
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return fmt.Errorf("corrupt intermediate block: %s", err)
+	} else if uint32(len(raw)) != rawLen {
+		return fmt.Errorf("intermediate block is %d bytes instead of %d", len(raw), rawLen)
+	}
+
+	bi.block = bytes.NewReader(raw)
+	return nil
+}
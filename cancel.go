@@ -0,0 +1,111 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// errJobCancelled is returned by tasks which stop because their job was cancelled
+var errJobCancelled = fmt.Errorf("job cancelled")
+
+// how often running tasks check to see if their job has been cancelled
+var cancelCheckInterval = 10 * time.Second
+
+// CancelJob stops a job which keeps its state in the appengine datastore
+func CancelJob(ds appwrap.Datastore, jobId int64) error {
+	return CancelJobWithStore(datastoreJobStore{ds: ds}, jobId)
+}
+
+// CancelJobWithStore stops a running job. Tasks which haven't started yet will not run, and running
+// tasks stop the next time they check the job (which they do every few seconds). The job's monitor
+// then removes the job's intermediate files and posts status=cancelled to the OnCompleteUrl. An
+// error is returned if the job has already finished.
+func CancelJobWithStore(store JobStore, jobId int64) error {
+	_, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+		if job.Stage == StageDone || job.Stage == StageFailed || job.Stage == StageCancelled {
+			return fmt.Errorf("job %d is already %s", jobId, job.Stage)
+		}
+
+		job.Stage = StageCancelled
+		job.UpdatedAt = time.Now()
+		return nil
+	})
+
+	return err
+}
+
+type cancelWatcherKey struct{}
+
+// watchForCancel returns a context which the map and reduce loops use to find out if the job has
+// been cancelled (via jobIsCancelled); the job is loaded every cancelCheckInterval until stop is
+// called
+func watchForCancel(c context.Context, store JobStore, jobId int64, log appwrap.Logging) (context.Context, func()) {
+	cancelled := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(cancelCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if job, err := store.GetJob(jobId); err != nil {
+					log.Warningf("failed to check for job cancellation: %s", err)
+				} else if job.Stage == StageCancelled {
+					log.Infof("job has been cancelled")
+					close(cancelled)
+					return
+				}
+			}
+		}
+	}()
+
+	return context.WithValue(c, cancelWatcherKey{}, cancelled), func() { close(stop) }
+}
+
+// jobIsCancelled returns true if c came from watchForCancel and the job has been cancelled
+func jobIsCancelled(c context.Context) bool {
+	if cancelled, ok := c.Value(cancelWatcherKey{}).(chan struct{}); ok {
+		select {
+		case <-cancelled:
+			return true
+		default:
+		}
+	}
+
+	return false
+}
+
+// jobCancelled is called by the monitors once they see the job has been cancelled. It removes the
+// intermediate files written by the job's tasks and lets the OnCompleteUrl know. Map tasks which
+// are running when this happens may still leave files behind, unless the pipeline is an
+// IntermediateJobCleaner.
+func jobCancelled(c context.Context, store JobStore, pipeline MapReducePipeline, job JobInfo, log appwrap.Logging) {
+	log.Infof("job was cancelled; cleaning up")
+
+	removeTaskIntermediates(c, store, pipeline, job, log)
+
+	if job.OnCompleteUrl != "" {
+		pipeline.PostStatus(c, fmt.Sprintf("%s?status=%s&id=%d", job.OnCompleteUrl, TaskStatusCancelled, job.Id), log)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testCancelPipeline counts words, and records the tasks it posts instead of running them
+type testCancelPipeline struct {
+	testLocalWordCount
+	posted []string
+}
+
+// newTestCancelPipeline returns a testCancelPipeline which writes its counts to 3 outputs
+func newTestCancelPipeline() *testCancelPipeline {
+	return &testCancelPipeline{testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}}
+}
+
+func (t *testCancelPipeline) PostTask(c context.Context, url string, jsonParameters string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (t *testCancelPipeline) PostStatus(c context.Context, url string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (mrt *MapreduceTests) TestCancelJob(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.OnCompleteUrl = "/done"
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) int {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	// 5 map tasks and the monitor
+	c.Assert(u.posted, ck.HasLen, 6)
+	posted := u.posted
+	u.posted = nil
+
+	mapUrls := []string{}
+	monitorUrl := ""
+	for _, taskUrl := range posted {
+		if strings.Contains(taskUrl, "/map-monitor") {
+			monitorUrl = taskUrl
+		} else {
+			mapUrls = append(mapUrls, taskUrl)
+		}
+	}
+	c.Assert(monitorUrl, ck.Not(ck.Equals), "")
+
+	// two of the maps finish before the job is cancelled
+	c.Assert(serve(mapUrls[0]), ck.Equals, 200)
+	c.Assert(serve(mapUrls[1]), ck.Equals, 200)
+	c.Assert(len(u.memoryIntermediateStorage.items) > 0, ck.Equals, true)
+
+	c.Assert(CancelJobWithStore(store, jobId), ck.IsNil)
+	c.Assert(CancelJobWithStore(store, jobId), ck.NotNil)
+
+	for _, taskUrl := range mapUrls[2:] {
+		c.Assert(serve(taskUrl), ck.Equals, 200)
+	}
+
+	c.Assert(serve(monitorUrl), ck.Equals, 200)
+	c.Assert(u.posted, ck.DeepEquals, []string{fmt.Sprintf("/done?status=cancelled&id=%d", jobId)})
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageCancelled)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks, ck.HasLen, 5)
+	for i, task := range tasks {
+		if i < 2 {
+			c.Check(task.Status, ck.Equals, TaskStatusDone)
+		} else {
+			c.Check(task.Status, ck.Equals, TaskStatusCancelled)
+		}
+	}
+
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+	c.Assert(len(u.results), ck.Equals, 0)
+}
+
+func (mrt *MapreduceTests) TestCancelFinishedJob(c *ck.C) {
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "/mr/test", WriterNames: []string{"output"}, RetryCount: 5})
+	c.Assert(err, ck.IsNil)
+	mrt.finishJob(c, store, jobId, "output")
+
+	c.Assert(CancelJobWithStore(store, jobId), ck.ErrorMatches, ".*already done")
+}
+
+func (mrt *MapreduceTests) TestCancelRunningMap(c *ck.C) {
+	defer func(interval time.Duration) { cancelCheckInterval = interval }(cancelCheckInterval)
+	cancelCheckInterval = time.Millisecond
+
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "/mr/test", WriterNames: []string{"output"}, RetryCount: 5})
+	c.Assert(err, ck.IsNil)
+
+	ctx, stop := watchForCancel(appwrap.StubContext(), store, jobId, mrt.nullLog)
+	defer stop()
+
+	c.Assert(jobIsCancelled(ctx), ck.Equals, false)
+	c.Assert(CancelJobWithStore(store, jobId), ck.IsNil)
+
+	for start := time.Now(); !jobIsCancelled(ctx); time.Sleep(time.Millisecond) {
+		c.Assert(time.Now().Sub(start) < 5*time.Second, ck.Equals, true)
+	}
+
+	u := &testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}
+	reader, err := FileLineInputReader{}.ReaderFromName(ctx, "testdata/pandp-1")
+	c.Assert(err, ck.IsNil)
+
+	_, err = mapperFunc(ctx, u, reader, newMapperOptions(JobInfo{}, 3, u, nil, nil), nil, mrt.nullLog)
+	c.Assert(err, ck.Equals, errJobCancelled)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
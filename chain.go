@@ -0,0 +1,315 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// Datastore entity kind for chains
+const ChainEntity = "MapReduceChain"
+
+// JobChain is the entity stored for each chain of jobs started by RunChain. The jobs in the chain
+// are the parents of their tasks, as usual; the chain just keeps track of them.
+type JobChain struct {
+	Stage         JobStage
+	JobCount      int       `datastore:",noindex"`
+	JobIds        []int64   `datastore:",noindex"` // the jobs which have been started, in order
+	OnCompleteUrl string    `datastore:",noindex"`
+	Error         string    `datastore:",noindex"`
+	StartTime     time.Time `datastore:",noindex"`
+	UpdatedAt     time.Time
+
+	// filled in by the JobStore
+	Id int64 `datastore:"-"`
+}
+
+// MapReduceChain is a list of jobs which are run one after the other, with the outputs of each
+// job used as the inputs of the next. The names of the outputs (the Results of the final reduce
+// tasks, or map tasks for MapOnly jobs, as returned by GetJobTaskResults) become the reader names
+// for the next job, so the InputReader for every job after the first must accept the names from
+// the previous job's OutputWriter; the Inputs for those jobs are ignored.
+//
+// The OnCompleteUrl of the jobs in the chain is replaced with a url handled by the handler
+// returned by MapReduceChainHandler, which starts the next job (or fails the whole chain).
+type MapReduceChain struct {
+	Jobs []MapReduceJob
+
+	// UrlPrefix is the base url path used for the chain, and must match the baseUrl
+	// passed into MapReduceChainHandler()
+	UrlPrefix string
+
+	// OnCompleteUrl is the url to post to when the chain is complete; it's used just like
+	// MapReduceJob.OnCompleteUrl, but the id is for the chain
+	OnCompleteUrl string
+}
+
+// this is returned when the chain has already moved on from the job we're looking at
+var errChainConflict = fmt.Errorf("chain conflict detected")
+
+// job returns the job at index, pointed at the chain handler
+func (chain MapReduceChain) job(index int) MapReduceJob {
+	job := chain.Jobs[index]
+	job.OnCompleteUrl = chain.UrlPrefix + "/next"
+	return job
+}
+
+// RunChain starts a chain of jobs which keep their state in the appengine datastore, returning
+// the id of the chain
+func RunChain(c context.Context, ds appwrap.Datastore, chain MapReduceChain) (int64, error) {
+	return RunChainWithStore(c, NewDatastoreJobStore(c, ds), chain, appwrap.NewAppengineLogging(c))
+}
+
+// RunChainWithStore starts a chain of jobs which keep their state in store, logging to log
+func RunChainWithStore(c context.Context, store JobStore, chain MapReduceChain, log appwrap.Logging) (int64, error) {
+	if len(chain.Jobs) == 0 {
+		return 0, fmt.Errorf("no jobs in chain")
+	}
+
+	readerNames, err := chain.Jobs[0].Inputs.ReaderNames()
+	if err != nil {
+		return 0, fmt.Errorf("forming reader names: %s", err)
+	} else if len(readerNames) == 0 {
+		return 0, fmt.Errorf("no input readers")
+	}
+
+	chainId, err := store.CreateChain(JobChain{
+		Stage:         StageFormation,
+		JobCount:      len(chain.Jobs),
+		OnCompleteUrl: chain.OnCompleteUrl,
+		StartTime:     time.Now(),
+		UpdatedAt:     time.Now(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("creating chain: %s", err)
+	}
+
+	if err := startChainJob(c, store, chain, chainId, 0, readerNames, log); err != nil {
+		if _, innerErr := markChainFailed(store, chainId, err); innerErr != nil {
+			log.Errorf("failed to log chain %d as failed: %s", chainId, innerErr)
+		}
+
+		return 0, err
+	}
+
+	return chainId, nil
+}
+
+// startChainJob starts the job at index. The job is recorded in the chain before any of its
+// tasks are started so the chain handler can always find it.
+func startChainJob(c context.Context, store JobStore, chain MapReduceChain, chainId int64, index int, readerNames []string, log appwrap.Logging) error {
+	job := chain.job(index)
+
+	jobId, writerNames, err := newJob(c, store, job, chainId)
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.UpdateChain(chainId, func(jobChain *JobChain) error {
+		if len(jobChain.JobIds) != index || jobChain.Stage == StageFailed {
+			return errChainConflict
+		}
+
+		jobChain.JobIds = append(jobChain.JobIds, jobId)
+		jobChain.Stage = StageRunning
+		jobChain.UpdatedAt = time.Now()
+		return nil
+	}); err == errChainConflict {
+		// someone else already started this job (or failed the chain), so we're not needed
+		log.Infof("chain has already moved on; removing duplicate job %d", jobId)
+		if err := store.RemoveJob(jobId); err != nil {
+			log.Errorf("failed to remove duplicate job %d: %s", jobId, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("adding job to chain: %s", err)
+	}
+
+	log.Infof("starting job %d (%d of %d) with %d inputs", jobId, index+1, len(chain.Jobs), len(readerNames))
+
+	return startJob(c, store, job, jobId, readerNames, writerNames, log)
+}
+
+// markChainFailed marks the chain as failed unless it's already complete; the chain as it was
+// before it was failed is returned
+func markChainFailed(store JobStore, chainId int64, err error) (prev JobChain, finalErr error) {
+	_, finalErr = store.UpdateChain(chainId, func(chain *JobChain) error {
+		prev = *chain
+
+		if chain.Stage == StageDone || chain.Stage == StageFailed {
+			return errChainConflict
+		}
+
+		chain.Stage = StageFailed
+		chain.Error = err.Error()
+		chain.UpdatedAt = time.Now()
+		return nil
+	})
+
+	return
+}
+
+func chainFailed(c context.Context, store JobStore, taskIntf TaskInterface, chainId int64, err error, log appwrap.Logging) {
+	log.Errorf("chainFailed: %s", err)
+
+	if prevChain, markErr := markChainFailed(store, chainId, err); markErr == errChainConflict {
+		log.Infof("chain was already %s", prevChain.Stage)
+	} else if markErr != nil {
+		log.Errorf("failed to log chain as failed: %s", markErr)
+	} else if prevChain.OnCompleteUrl != "" {
+		taskIntf.PostStatus(c, fmt.Sprintf("%s?status=error&error=%s&id=%d", prevChain.OnCompleteUrl,
+			url.QueryEscape(err.Error()), chainId), log)
+	}
+}
+
+type chainHandler struct {
+	chain      MapReduceChain
+	getContext func(r *http.Request) context.Context
+	getStore   func(c context.Context) JobStore
+	getLogger  func(c context.Context) appwrap.Logging
+}
+
+// MapReduceChainHandler returns an http.Handler which moves chains started by RunChain from one
+// job to the next. It must be served at chain.UrlPrefix, and each of the jobs in the chain also
+// need their own MapReduceHandler.
+func MapReduceChainHandler(chain MapReduceChain, getContext func(r *http.Request) context.Context) http.Handler {
+	return MapReduceChainStoreHandler(chain, getContext, func(c context.Context) JobStore {
+		return NewDatastoreJobStore(c, appwrap.NewAppengineDatastore(c))
+	}, appwrap.NewAppengineLogging)
+}
+
+// MapReduceChainStoreHandler is like MapReduceChainHandler, but is used for chains started by
+// RunChainWithStore. As with MapReduceStoreHandler, getStore and getLogger return the JobStore
+// and logger to use for each request.
+func MapReduceChainStoreHandler(chain MapReduceChain, getContext func(r *http.Request) context.Context,
+	getStore func(c context.Context) JobStore, getLogger func(c context.Context) appwrap.Logging) http.Handler {
+
+	return chainHandler{chain, getContext, getStore, getLogger}
+}
+
+func (h chainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.getContext(r)
+	store := h.getStore(c)
+	log := h.getLogger(c)
+
+	if !strings.HasSuffix(r.URL.Path, "/next") {
+		http.Error(w, "unknown request url", http.StatusNotFound)
+		return
+	}
+
+	jobId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		log.Errorf("failed to load job %d: %s", jobId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chain, err := store.GetChain(job.ChainId)
+	if err != nil {
+		log.Errorf("failed to load chain for job %d: %s", jobId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log = appwrap.PrefixLogger{Logging: log, Prefix: fmt.Sprintf("chain %d: ", chain.Id)}
+
+	index := -1
+	for i, id := range chain.JobIds {
+		if id == jobId {
+			index = i
+		}
+	}
+
+	if chain.Stage == StageDone || chain.Stage == StageFailed {
+		log.Infof("ignoring job %d; chain is already %s", jobId, chain.Stage)
+		return
+	} else if index < 0 {
+		// this shouldn't happen since jobs are added to the chain before they start; the retry
+		// will sort it out if it does
+		log.Errorf("job %d is not part of the chain", jobId)
+		http.Error(w, "job not found in chain", http.StatusInternalServerError)
+		return
+	} else if index != len(chain.JobIds)-1 {
+		log.Infof("ignoring job %d; chain has already moved on", jobId)
+		return
+	} else if chain.JobCount != len(h.chain.Jobs) {
+		chainFailed(c, store, h.chain.Jobs[0], chain.Id,
+			fmt.Errorf("chain was started with %d jobs but handler has %d", chain.JobCount, len(h.chain.Jobs)), log)
+		return
+	}
+
+	taskIntf := h.chain.Jobs[index]
+
+	if status := r.FormValue("status"); status != string(TaskStatusDone) {
+		chainFailed(c, store, taskIntf, chain.Id, fmt.Errorf("job %d failed: %s", jobId, r.FormValue("error")), log)
+		return
+	}
+
+	if index == chain.JobCount-1 {
+		if _, err := store.UpdateChain(chain.Id, func(jobChain *JobChain) error {
+			if jobChain.Stage != StageRunning {
+				return errChainConflict
+			}
+
+			jobChain.Stage = StageDone
+			jobChain.UpdatedAt = time.Now()
+			return nil
+		}); err == errChainConflict {
+			log.Infof("chain was already complete")
+		} else if err != nil {
+			log.Errorf("failed to mark chain done: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else if chain.OnCompleteUrl != "" {
+			log.Infof("chain complete after %s", time.Now().Sub(chain.StartTime))
+			taskIntf.PostStatus(c, fmt.Sprintf("%s?status=%s&id=%d", chain.OnCompleteUrl, TaskStatusDone, chain.Id), log)
+		}
+
+		return
+	}
+
+	results, err := jobTaskResults(store, job)
+	if err != nil {
+		log.Errorf("failed to load results for job %d: %s", jobId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	readerNames := make([]string, 0, len(results))
+	for _, result := range results {
+		if name, ok := result.(string); ok && name != "" {
+			readerNames = append(readerNames, name)
+		}
+	}
+
+	if len(readerNames) == 0 {
+		chainFailed(c, store, taskIntf, chain.Id, fmt.Errorf("job %d has no outputs", jobId), log)
+	} else if err := startChainJob(c, store, h.chain, chain.Id, index+1, readerNames, log); err != nil {
+		chainFailed(c, store, taskIntf, chain.Id, fmt.Errorf("starting job %d: %s", index+1, err), log)
+	}
+}
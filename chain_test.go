@@ -0,0 +1,216 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testChainPipeline records the tasks it posts instead of running them
+type testChainPipeline struct {
+	testUniqueWordCount
+	posted []string
+}
+
+func (t *testChainPipeline) PostTask(c context.Context, url string, jsonParameters string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (t *testChainPipeline) PostStatus(c context.Context, url string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (mrt *MapreduceTests) chain(pipe MapReducePipeline, count int) MapReduceChain {
+	chain := MapReduceChain{UrlPrefix: "/chain", OnCompleteUrl: "/done"}
+	for i := 0; i < count; i++ {
+		chain.Jobs = append(chain.Jobs, MapReduceJob{
+			MapReducePipeline: pipe,
+			Outputs:           fileLineOutputWriter{[]string{"test1.out", "test2.out"}},
+			UrlPrefix:         fmt.Sprintf("/mr/job%d", i),
+		})
+	}
+
+	chain.Jobs[0].Inputs = FileLineInputReader{[]string{"testdata/pandp-1", "testdata/pandp-2"}}
+
+	return chain
+}
+
+// finishJob pretends job has run, with reduce tasks which wrote to the outputs
+func (mrt *MapreduceTests) finishJob(c *ck.C, store JobStore, jobId int64, outputs ...string) {
+	firstId, err := store.AllocateTaskIds(len(outputs))
+	c.Assert(err, ck.IsNil)
+
+	tasks := make([]JobTask, len(outputs))
+	for i := range outputs {
+		tasks[i] = JobTask{Status: TaskStatusDone, Type: TaskTypeReduce, Result: fmt.Sprintf(`"%s"`, outputs[i])}
+	}
+
+	c.Assert(createTasks(store, jobId, makeTaskIds(firstId, len(outputs)), tasks, StageReducing, mrt.nullLog), ck.IsNil)
+	_, err = store.UpdateJob(jobId, func(job *JobInfo) error {
+		job.Stage = StageDone
+		return nil
+	})
+	c.Assert(err, ck.IsNil)
+}
+
+func (mrt *MapreduceTests) serveChain(handler http.Handler, url string) int {
+	req, _ := http.NewRequest("POST", url, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func (mrt *MapreduceTests) TestChain(c *ck.C) {
+	store := NewMemoryJobStore()
+	pipe := &testChainPipeline{testUniqueWordCount: newTestUniqueWordCount()}
+	chain := mrt.chain(pipe, 2)
+	handler := MapReduceChainStoreHandler(chain, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	chainId, err := RunChainWithStore(appwrap.StubContext(), store, chain, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	jobChain, err := store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.Stage, ck.Equals, StageRunning)
+	c.Assert(jobChain.JobIds, ck.HasLen, 1)
+
+	firstId := jobChain.JobIds[0]
+	job, err := store.GetJob(firstId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.ChainId, ck.Equals, chainId)
+	c.Assert(job.OnCompleteUrl, ck.Equals, "/chain/next")
+	c.Assert(pipe.posted, ck.HasLen, 3)
+
+	mrt.finishJob(c, store, firstId, "out/a;1", "out/b")
+	next := fmt.Sprintf("/chain/next?status=done&id=%d", firstId)
+	c.Assert(mrt.serveChain(handler, next), ck.Equals, 200)
+
+	jobChain, err = store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.JobIds, ck.HasLen, 2)
+
+	secondId := jobChain.JobIds[1]
+	tasks, err := store.JobTasks(secondId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks, ck.HasLen, 2)
+	c.Assert(strings.Contains(tasks[0].Url, "reader=out%2Fa%3B1&"), ck.Equals, true)
+	c.Assert(strings.Contains(tasks[1].Url, "reader=out%2Fb&"), ck.Equals, true)
+
+	// the same notification again is ignored
+	c.Assert(mrt.serveChain(handler, next), ck.Equals, 200)
+	jobChain, err = store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.JobIds, ck.HasLen, 2)
+
+	// a failed job fails the chain
+	pipe.posted = nil
+	c.Assert(mrt.serveChain(handler, fmt.Sprintf("/chain/next?status=error&error=boom&id=%d", secondId)), ck.Equals, 200)
+	jobChain, err = store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.Stage, ck.Equals, StageFailed)
+	c.Assert(jobChain.Error, ck.Equals, fmt.Sprintf("job %d failed: boom", secondId))
+	c.Assert(pipe.posted, ck.HasLen, 1)
+	c.Assert(strings.HasPrefix(pipe.posted[0], "/done?status=error&"), ck.Equals, true)
+	c.Assert(strings.HasSuffix(pipe.posted[0], fmt.Sprintf("&id=%d", chainId)), ck.Equals, true)
+}
+
+func (mrt *MapreduceTests) TestChainComplete(c *ck.C) {
+	store := NewMemoryJobStore()
+	pipe := &testChainPipeline{testUniqueWordCount: newTestUniqueWordCount()}
+	chain := mrt.chain(pipe, 1)
+	// nothing here needs appengine
+	handler := MapReduceChainStoreHandler(chain, func(*http.Request) context.Context { return context.Background() },
+		func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	chainId, err := RunChainWithStore(context.Background(), store, chain, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	jobChain, err := store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	mrt.finishJob(c, store, jobChain.JobIds[0], "out")
+
+	pipe.posted = nil
+	c.Assert(mrt.serveChain(handler, fmt.Sprintf("/chain/next?status=done&id=%d", jobChain.JobIds[0])), ck.Equals, 200)
+
+	jobChain, err = store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.Stage, ck.Equals, StageDone)
+	c.Assert(jobChain.UpdatedAt.After(time.Time{}), ck.Equals, true)
+	c.Assert(pipe.posted, ck.DeepEquals, []string{fmt.Sprintf("/done?status=done&id=%d", chainId)})
+}
+
+func (mrt *MapreduceTests) TestChainJobFails(c *ck.C) {
+	store := NewMemoryJobStore()
+	pipe := &testChainPipeline{testUniqueWordCount: newTestUniqueWordCount()}
+	chain := mrt.chain(testFailingMapPipeline{pipe}, 2)
+	chain.Jobs[0].JobParameters = "job parameter"
+	chainHandler := MapReduceChainStoreHandler(chain, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+	jobHandler := MapReduceStoreHandler("/mr/job0", chain.Jobs[0].MapReducePipeline, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{chain.Jobs[0].JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		jobHandler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	chainId, err := RunChainWithStore(appwrap.StubContext(), store, chain, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	jobChain, err := store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	jobId := jobChain.JobIds[0]
+
+	// the second map task fails, and the monitor fails the job
+	c.Assert(pipe.posted, ck.HasLen, 3)
+	posted := pipe.posted
+	pipe.posted = nil
+	serve(posted[0])
+	serve(posted[1])
+	c.Assert(strings.Contains(posted[2], "/map-monitor"), ck.Equals, true)
+	serve(posted[2])
+
+	job, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.Stage, ck.Equals, StageFailed)
+	c.Assert(pipe.posted, ck.HasLen, 1)
+	c.Assert(strings.HasPrefix(pipe.posted[0], "/chain/next?status=error&"), ck.Equals, true)
+
+	// which fails the chain without starting the next job
+	next := pipe.posted[0]
+	pipe.posted = nil
+	c.Assert(mrt.serveChain(chainHandler, next), ck.Equals, 200)
+
+	jobChain, err = store.GetChain(chainId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobChain.Stage, ck.Equals, StageFailed)
+	c.Assert(jobChain.JobIds, ck.DeepEquals, []int64{jobId})
+	c.Assert(jobChain.Error, ck.Equals, fmt.Sprintf("job %d failed: taskError map had an error", jobId))
+	c.Assert(pipe.posted, ck.HasLen, 1)
+	c.Assert(strings.HasPrefix(pipe.posted[0], "/done?status=error&"), ck.Equals, true)
+	c.Assert(strings.HasSuffix(pipe.posted[0], fmt.Sprintf("&id=%d", chainId)), ck.Equals, true)
+}
@@ -0,0 +1,241 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// intermediateTracker keeps track of the intermediate files a map task has created and not yet
+// removed, and saves them in the task's Intermediates so they can be removed if the task is
+// retried or the job never finishes
+type intermediateTracker struct {
+	mtx   sync.Mutex
+	names []string
+	dirty bool
+	save  func(names []string) error
+}
+
+type intermediateTrackerKey struct{}
+
+// newIntermediateTracker returns the tracker for an attempt at a map task; speculative attempts
+// keep their names in SpeculativeIntermediates instead of Intermediates
+func newIntermediateTracker(store JobStore, task JobTask, speculative bool) *intermediateTracker {
+	names := task.Intermediates
+	if speculative {
+		names = task.SpeculativeIntermediates
+	}
+
+	return &intermediateTracker{
+		names: append([]string(nil), names...),
+		save: func(names []string) error {
+			_, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+				if speculative {
+					task.SpeculativeIntermediates = names
+				} else {
+					task.Intermediates = names
+				}
+				return nil
+			})
+			return err
+		},
+	}
+}
+
+// withIntermediateTracker returns a context which makes trackIntermediate and untrackIntermediate
+// record names in tracker
+func withIntermediateTracker(c context.Context, tracker *intermediateTracker) context.Context {
+	return context.WithValue(c, intermediateTrackerKey{}, tracker)
+}
+
+// trackerFromContext returns the tracker in c, or nil if there isn't one
+func trackerFromContext(c context.Context) *intermediateTracker {
+	if c == nil {
+		// some tests merge spills without a context
+		return nil
+	}
+
+	tracker, _ := c.Value(intermediateTrackerKey{}).(*intermediateTracker)
+	return tracker
+}
+
+// trackIntermediate records an intermediate file which was just created, if c has a tracker
+func trackIntermediate(c context.Context, name string) {
+	if tracker := trackerFromContext(c); tracker != nil {
+		tracker.mtx.Lock()
+		defer tracker.mtx.Unlock()
+
+		tracker.names = append(tracker.names, name)
+		tracker.dirty = true
+	}
+}
+
+// untrackIntermediate forgets about an intermediate file which has been removed
+func untrackIntermediate(c context.Context, name string) {
+	if tracker := trackerFromContext(c); tracker != nil {
+		tracker.mtx.Lock()
+		defer tracker.mtx.Unlock()
+
+		for i := range tracker.names {
+			if tracker.names[i] == name {
+				tracker.names = append(tracker.names[:i], tracker.names[i+1:]...)
+				tracker.dirty = true
+				break
+			}
+		}
+	}
+}
+
+// flushIntermediates saves the names recorded by the tracker in c, if there is one. It's called
+// as intermediate files are written so that they aren't lost if the task dies.
+func flushIntermediates(c context.Context) error {
+	if tracker := trackerFromContext(c); tracker != nil {
+		return tracker.flush()
+	}
+
+	return nil
+}
+
+func (t *intermediateTracker) flush() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if !t.dirty {
+		return nil
+	} else if err := t.save(append([]string{}, t.names...)); err != nil {
+		return fmt.Errorf("saving intermediate names: %s", err)
+	}
+
+	t.dirty = false
+	return nil
+}
+
+// removeExcept removes every tracked intermediate file which isn't in keep and saves what's left.
+// Map tasks use it when they start, to clean up after earlier attempts (everything but what their
+// checkpoint refers to), and when they finish, to clean up after spill merges which failed.
+func (t *intermediateTracker) removeExcept(c context.Context, intStorage IntermediateStorage, keep map[string]int, log appwrap.Logging) error {
+	t.mtx.Lock()
+	kept := []string{}
+	for _, name := range t.names {
+		if _, ok := keep[name]; ok {
+			kept = append(kept, name)
+		} else if err := intStorage.RemoveIntermediate(c, name); err != nil {
+			log.Errorf("failed to remove intermediate file %s: %s", name, err)
+			kept = append(kept, name)
+		} else {
+			log.Infof("removed leftover intermediate file %s", name)
+			t.dirty = true
+		}
+	}
+	t.names = kept
+	t.mtx.Unlock()
+
+	return t.flush()
+}
+
+// taskIntermediates returns the names of the intermediate files a task is responsible for when its
+// job has stopped without finishing. That's everything the task's attempts recorded. Tasks
+// saved before Intermediates existed fall back to the output of completed map tasks (or what
+// unfinished ones wrote before their last checkpoint) and the input of reduce tasks which didn't
+// finish (finished reduces remove their own inputs).
+func taskIntermediates(job JobInfo, task JobTask, log appwrap.Logging) []string {
+	names := append(append([]string{}, task.Intermediates...), task.SpeculativeIntermediates...)
+
+	if task.Type == TaskTypeMap && task.Status == TaskStatusDone && !job.MapOnly {
+		result, err := parseMapResult(task.Result)
+		if err != nil {
+			log.Errorf("cannot unmarshal map shard names: %s", err)
+		}
+
+		for name := range result.Names {
+			names = append(names, name)
+		}
+	} else if task.Type == TaskTypeMap && task.Checkpoint != "" {
+		// the intermediate files written before the task's last checkpoint
+		var checkpoint mapCheckpoint
+		if err := json.Unmarshal([]byte(task.Checkpoint), &checkpoint); err != nil {
+			log.Errorf("cannot unmarshal map checkpoint: %s", err)
+		}
+
+		for name := range checkpoint.Names {
+			names = append(names, name)
+		}
+	} else if (task.Type == TaskTypeReduce || task.Type == TaskTypeCombine) && task.Status != TaskStatusDone && len(task.ReadFrom) > 0 {
+		var readFrom []string
+		if shardReader, err := zlib.NewReader(bytes.NewBuffer(task.ReadFrom)); err != nil {
+			log.Errorf("cannot read reduce shard names: %s", err)
+		} else {
+			shardJson, _ := ioutil.ReadAll(shardReader)
+			if err := json.Unmarshal(shardJson, &readFrom); err != nil {
+				log.Errorf("cannot unmarshal reduce shard names: %s", err)
+			}
+		}
+
+		names = append(names, readFrom...)
+	}
+
+	// the same file shows up in both a map's Intermediates and its Result
+	seen := make(map[string]bool, len(names))
+	unique := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
+
+// removeTaskIntermediates removes the intermediate files for all of the tasks in a job which has
+// failed, been cancelled, or is being removed, followed by anything else the IntermediateStorage
+// has for the job if it's an IntermediateJobCleaner. Errors are logged and otherwise ignored.
+func removeTaskIntermediates(c context.Context, store JobStore, intStorage IntermediateStorage, job JobInfo, log appwrap.Logging) {
+	if tasks, err := gatherTasks(store, job); err != nil {
+		log.Errorf("failed to load tasks to remove intermediate files: %s", err)
+	} else {
+		for _, task := range tasks {
+			for _, name := range taskIntermediates(job, task, log) {
+				if err := intStorage.RemoveIntermediate(c, name); err != nil {
+					log.Errorf("failed to remove intermediate file: %s", err.Error())
+				}
+			}
+		}
+	}
+
+	removeJobIntermediates(c, intStorage, job.Id, log)
+}
+
+// RemoveJobWithStore deletes a job and its tasks, along with any intermediate files the job's
+// tasks left behind in intStorage (which is normally the job's MapReducePipeline). Jobs which are
+// still running should be cancelled first.
+func RemoveJobWithStore(c context.Context, store JobStore, intStorage IntermediateStorage, jobId int64, log appwrap.Logging) error {
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		return fmt.Errorf("loading job: %s", err)
+	}
+
+	removeTaskIntermediates(c, store, intStorage, job, log)
+
+	return store.RemoveJob(jobId)
+}
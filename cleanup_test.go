@@ -0,0 +1,177 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testFailingMapPipeline runs a word counting pipeline, but the map task for the input containing
+// "enumeration" (input 2) fails with a fatal error
+type testFailingMapPipeline struct {
+	MapReducePipeline
+}
+
+func (t testFailingMapPipeline) Map(item interface{}, status StatusUpdateFunc) ([]MappedData, error) {
+	mapped, err := t.MapReducePipeline.Map(item, status)
+	for _, data := range mapped {
+		if data.Key == "enumeration" {
+			return nil, FatalError{fmt.Errorf("map had an error")}
+		}
+	}
+
+	return mapped, err
+}
+
+// startCleanupJob starts a word count job whose tasks are run by calling the returned function;
+// pipe runs the tasks, which are posted to u (pipe is usually u itself)
+func (mrt *MapreduceTests) startCleanupJob(c *ck.C, store JobStore, pipe MapReducePipeline, u *testCancelPipeline) (int64, []string, string, func(string)) {
+	job := mrt.localJob(pipe, u.testMemoryOutput)
+	job.OnCompleteUrl = "/done"
+	handler := MapReduceStoreHandler("/mr/test", pipe, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	mapUrls := []string{}
+	monitorUrl := ""
+	for _, taskUrl := range u.posted {
+		if strings.Contains(taskUrl, "/map-monitor") {
+			monitorUrl = taskUrl
+		} else {
+			mapUrls = append(mapUrls, taskUrl)
+		}
+	}
+	u.posted = nil
+
+	return jobId, mapUrls, monitorUrl, serve
+}
+
+func (mrt *MapreduceTests) TestMapRetryRemovesIntermediates(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	jobId, mapUrls, _, serve := mrt.startCleanupJob(c, store, u, u)
+
+	resultNames := func(task JobTask) []string {
+		result, err := parseMapResult(task.Result)
+		c.Assert(err, ck.IsNil)
+		names := []string{}
+		for name := range result.Names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	serve(mapUrls[0])
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	task := tasks[0]
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+	sort.Strings(task.Intermediates)
+	c.Assert(task.Intermediates, ck.DeepEquals, resultNames(task))
+	firstNames := task.Intermediates
+
+	// an earlier attempt died after writing a file, and then the task was run again
+	w, err := u.CreateIntermediate(appwrap.StubContext(), u)
+	c.Assert(err, ck.IsNil)
+	w.Close(appwrap.StubContext())
+
+	_, err = store.UpdateTask(task.Id, func(task *JobTask) error {
+		task.Status = TaskStatusPending
+		task.Intermediates = append(task.Intermediates, w.ToName())
+		return nil
+	})
+	c.Assert(err, ck.IsNil)
+
+	serve(mapUrls[0])
+
+	task, err = store.GetTask(task.Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+	sort.Strings(task.Intermediates)
+	c.Assert(task.Intermediates, ck.DeepEquals, resultNames(task))
+
+	// only the latest results are left
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, len(task.Intermediates))
+	for _, name := range append(firstNames, w.ToName()) {
+		_, exists := u.memoryIntermediateStorage.items[name]
+		c.Check(exists, ck.Equals, false, ck.Commentf("intermediate %s", name))
+	}
+}
+
+func (mrt *MapreduceTests) TestFailedJobRemovesIntermediates(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	jobId, mapUrls, monitorUrl, serve := mrt.startCleanupJob(c, store, testFailingMapPipeline{u}, u)
+
+	for _, taskUrl := range mapUrls {
+		serve(taskUrl)
+	}
+	c.Assert(len(u.memoryIntermediateStorage.items) > 0, ck.Equals, true)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks[1].Status, ck.Equals, TaskStatusFailed)
+
+	// the monitor notices the failed task and cleans up after the job
+	serve(monitorUrl)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageFailed)
+
+	c.Assert(u.posted, ck.HasLen, 1)
+	c.Assert(u.posted[0], ck.Matches, `/done\?status=error&error=.*map\+had\+an\+error.*&id=`+fmt.Sprint(jobId))
+}
+
+func (mrt *MapreduceTests) TestDeleteJobRemovesIntermediates(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	jobId, mapUrls, _, serve := mrt.startCleanupJob(c, store, u, u)
+
+	for _, taskUrl := range mapUrls {
+		serve(taskUrl)
+	}
+	c.Assert(len(u.memoryIntermediateStorage.items) > 0, ck.Equals, true)
+
+	// the job is deleted before its monitor gets a chance to clean up after the cancel
+	c.Assert(mrt.apiRequest(c, store, u, "POST", fmt.Sprintf("/api/cancel?id=%d", jobId), nil), ck.Equals, 200)
+	c.Assert(mrt.apiRequest(c, store, u, "POST", fmt.Sprintf("/api/delete?id=%d", jobId), nil), ck.Equals, 200)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	_, err := store.GetJob(jobId)
+	c.Assert(err, ck.NotNil)
+}
@@ -0,0 +1,338 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// Jobs which salt hot keys have a combine stage between the map and reduce stages when any of
+// the map tasks found hot keys. Each combine task reads one of the salted shards the map tasks
+// wrote, combines all of the values for each key into one using the pipeline's Combiner, and
+// writes the combined values into intermediate files for the shards the keys belong to. The
+// reduce tasks then read those along with the map tasks' unsalted output.
+
+// startCombineStage creates and posts a combine task for each of the salted shards which have
+// intermediate files, and then starts the combine monitor. It returns the http status for the
+// map monitor task which called it.
+func startCombineStage(c context.Context, store JobStore, pipeline MapReducePipeline, job JobInfo, saltedNames [][]string, log appwrap.Logging) int {
+	jobId := job.Id
+
+	firstId, err := store.AllocateTaskIds(len(saltedNames))
+	if err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to allocate ids for combine tasks: %s", err.Error()), log)
+		return 200
+	}
+	taskIds := makeTaskIds(firstId, len(saltedNames))
+	tasks := make([]JobTask, 0, len(saltedNames))
+
+	for shard, names := range saltedNames {
+		if len(names) == 0 {
+			continue
+		}
+
+		namesJson, _ := json.Marshal(names)
+		namesZ := &bytes.Buffer{}
+		w := zlib.NewWriter(namesZ)
+		w.Write(namesJson)
+		w.Close()
+
+		tasks = append(tasks, JobTask{
+			Status:   TaskStatusPending,
+			Url:      fmt.Sprintf("%s/combine?taskId=%d&shard=%d", job.UrlPrefix, taskIds[len(tasks)], shard),
+			ReadFrom: namesZ.Bytes(),
+			Type:     TaskTypeCombine,
+		})
+	}
+
+	taskIds = taskIds[0:len(tasks)]
+
+	if err := createTasks(store, jobId, taskIds, tasks, StageCombining, log); err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to create combine tasks: %s", err.Error()), log)
+		return 200
+	}
+
+	for i := range tasks {
+		if err := pipeline.PostTask(c, tasks[i].Url, job.JsonParameters, log); err != nil {
+			jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to post combine task: %s", err.Error()), log)
+			return 200
+		}
+	}
+
+	log.Infof("tasks queue up; starting combine monitor")
+
+	if err := pipeline.PostStatus(c, fmt.Sprintf("%s/combine-monitor?jobId=%d", job.UrlPrefix, jobId), log); err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to start combine monitor: %s", err.Error()), log)
+	}
+
+	return 200
+}
+
+func combineMonitorTask(c context.Context, store JobStore, pipeline MapReducePipeline, jobId int64, r *http.Request, timeout time.Duration, log appwrap.Logging) int {
+	start := time.Now()
+
+	job, err := waitForStageCompletion(c, store, pipeline, jobId, StageCombining, StageReducing, timeout, log)
+	if err != nil {
+		log.Criticalf("waitForStageCompletion() failed: %s", err)
+		return 200
+	} else if job.Stage == StageCancelled {
+		jobCancelled(c, store, pipeline, job, log)
+		return 200
+	} else if job.Stage == StageCombining {
+		log.Infof("wait timed out -- returning an error and letting us automatically restart")
+		return 500
+	}
+
+	log.Infof("combine stage completed -- stage is now %s", job.Stage)
+
+	tasks, err := store.JobTasks(jobId)
+	if err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("error loading tasks after combine complete: %s", err.Error()), log)
+		return 200
+	}
+
+	// the salted names have all been combined, so only the unsalted ones matter now
+	storageNames, _, err := mapOutputs(tasks, len(job.WriterNames), log)
+	if err != nil {
+		jobFailed(c, store, pipeline, jobId, err, log)
+		return 200
+	}
+
+	for _, task := range tasks {
+		if task.Type != TaskTypeCombine {
+			continue
+		}
+
+		var combinedNames map[string]int
+		if err := json.Unmarshal([]byte(task.Result), &combinedNames); err != nil {
+			jobFailed(c, store, pipeline, jobId, fmt.Errorf("cannot unmarshal combined shard names: %s", err.Error()), log)
+			return 200
+		}
+
+		for name, shard := range combinedNames {
+			storageNames[shard] = append(storageNames[shard], name)
+		}
+	}
+
+	status := startReduceStage(c, store, pipeline, job, storageNames, log)
+	log.Infof("combining complete after %s of monitoring ", time.Now().Sub(start))
+	return status
+}
+
+func combineTask(c context.Context, store JobStore, baseUrl string, mr MapReducePipeline, taskId int64, w http.ResponseWriter, r *http.Request, log appwrap.Logging) {
+	var finalErr error
+	var result map[string]int
+
+	start := time.Now()
+
+	jsonParameters := r.FormValue("json")
+	mr.SetMapParameters(jsonParameters)
+	mr.SetShardParameters(jsonParameters)
+
+	task, err, retry := startTask(c, store, mr, taskId, log)
+	if err == errJobCancelled {
+		log.Infof("job has been cancelled; not running task")
+		return
+	} else if err == errJobPaused {
+		log.Infof("job is paused; task deferred")
+		return
+	} else if err == errTaskAlreadyDone {
+		log.Infof("task has already been completed")
+		return
+	} else if err != nil && retry {
+		log.Criticalf("failed updating task to running: %s", err)
+		http.Error(w, err.Error(), 500) // this will run us again
+		return
+	} else if err != nil {
+		log.Criticalf("(fatal) failed updating task to running: %s", err)
+		http.Error(w, err.Error(), 200) // this will run us again
+		return
+	}
+
+	c, stopWatching := watchForCancel(c, store, task.JobId, log)
+	defer stopWatching()
+	c = withJobId(c, task.JobId)
+
+	// clean up whatever earlier attempts at this task left behind
+	tracker := newIntermediateTracker(store, task, false)
+	c = withIntermediateTracker(c, tracker)
+	if err := tracker.removeExcept(c, mr, nil, log); err != nil {
+		log.Errorf("failed to clean up after earlier attempts: %s", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 16384)
+			bytes := runtime.Stack(stack, false)
+			log.Criticalf("panic inside of combine task %d: %s\n%s\n", taskId, r, stack[0:bytes])
+
+			if err := tracker.flush(); err != nil {
+				log.Errorf("failed to save intermediate names: %s", err)
+			}
+
+			if err := retryTask(c, store, mr, task.JobId, taskId, log); err != nil {
+				panic(fmt.Errorf("failed to retry task after panic: %s", err))
+			}
+		}
+	}()
+
+	if job, err := store.GetJob(task.JobId); err != nil {
+		finalErr = tryAgainError{fmt.Errorf("error loading job: %s", err)}
+	} else if sharder, err := newKeySharder(mr, job); err != nil {
+		finalErr = err
+	} else {
+		namesReader, _ := zlib.NewReader(bytes.NewBuffer(task.ReadFrom))
+		namesJson, _ := ioutil.ReadAll(namesReader)
+		var names []string
+		json.Unmarshal(namesJson, &names)
+
+		result, finalErr = combineFunc(c, mr, sharder, len(job.WriterNames), names, log)
+	}
+
+	if err := tracker.flush(); err != nil {
+		log.Errorf("failed to save intermediate names: %s", err)
+	}
+
+	if err := endTask(c, store, mr, task.JobId, taskId, finalErr, result, nil, log); err != nil {
+		log.Criticalf("Could not finish task: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof("combiner done after %s", time.Now().Sub(start))
+}
+
+// combineFunc merges the intermediate files in names, which were written by map tasks for one of
+// the salted shards, and combines the values for each key into one. The combined values are
+// written into an intermediate file for each of the shards which have any, and the names of
+// those files are returned along with the shard each is for. The input files are removed once
+// they have been combined.
+func combineFunc(c context.Context, mr MapReducePipeline, sharder keySharder, shardCount int, names []string, log appwrap.Logging) (map[string]int, error) {
+	combiner, ok := mr.(Combiner)
+	if !ok {
+		return nil, fmt.Errorf("salting hot keys requires a Combiner")
+	}
+
+	merger := newMerger(mr)
+
+	toClose := make([]io.Closer, 0, len(names))
+	defer func() {
+		for _, c := range toClose {
+			c.Close()
+		}
+	}()
+
+	for _, name := range names {
+		iterator, err := mr.Iterator(c, name, mr)
+		if err != nil {
+			return nil, tryAgainError{fmt.Errorf("cannot open intermediate file %s: %s", name, err)}
+		}
+		toClose = append(toClose, iterator)
+
+		if err := merger.addSource(iterator); err != nil {
+			return nil, tryAgainError{fmt.Errorf("error adding iterator to merger: %s", err)}
+		}
+	}
+
+	// there's only one value for each key at this point, and few keys are hot, so this is small
+	dataSets := make([]mappedDataList, shardCount)
+	for i := range dataSets {
+		dataSets[i] = mappedDataList{data: make([]MappedData, 0), compare: mr}
+	}
+
+	item, err := merger.next()
+	for item != nil && err == nil {
+		if jobIsCancelled(c) {
+			return nil, errJobCancelled
+		}
+
+		key := item.Key
+		values := []interface{}{item.Value}
+		for item, err = merger.next(); item != nil && err == nil && mr.Equal(key, item.Key); item, err = merger.next() {
+			values = append(values, item.Value)
+		}
+
+		if err != nil {
+			break
+		}
+
+		value := values[0]
+		if len(values) > 1 {
+			if value, err = combiner.Combine(key, values); err != nil {
+				if _, ok := err.(FatalError); ok {
+					err = err.(FatalError).Err
+				} else {
+					err = tryAgainError{err}
+				}
+
+				return nil, err
+			}
+		}
+
+		shard := sharder.Shard(key, shardCount)
+		dataSets[shard].data = append(dataSets[shard].data, MappedData{Key: key, Value: value})
+	}
+
+	if err != nil {
+		return nil, tryAgainError{err}
+	}
+
+	combinedNames := make(map[string]int)
+	for shard, dataSet := range dataSets {
+		if len(dataSet.data) == 0 {
+			continue
+		}
+
+		w, err := mr.CreateIntermediate(c, mr)
+		if err != nil {
+			return nil, tryAgainError{fmt.Errorf("failed to create intermediate file: %s", err)}
+		}
+		trackIntermediate(c, w.ToName())
+
+		for _, item := range dataSet.data {
+			if err := w.WriteMappedData(item); err != nil {
+				w.Close(c)
+				return nil, tryAgainError{fmt.Errorf("error writing intermediate file: %s", err)}
+			}
+		}
+
+		if err := w.Close(c); err != nil {
+			return nil, tryAgainError{fmt.Errorf("failed to close intermediate file: %s", err)}
+		}
+
+		combinedNames[w.ToName()] = shard
+	}
+
+	for _, name := range names {
+		if err := mr.RemoveIntermediate(c, name); err != nil {
+			log.Errorf("failed to remove intermediate file: %s", err.Error())
+		}
+	}
+
+	log.Infof("combined %d salted files into %d", len(names), len(combinedNames))
+
+	return combinedNames, nil
+}
@@ -2,11 +2,12 @@ package mapreduce
 
 import (
 	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -23,6 +24,21 @@ table,td,th {
 
 <h2>Jobs</h2>
 
+<form method="get" action="./">
+    Url prefix (exact) <input name="prefix" value="{{.Query.UrlPrefix}}">
+    Stage <select name="stage">
+        <option value="">any</option>
+        {{range .Stages}}<option{{if eq . $.Query.Stage}} selected{{end}}>{{.}}</option>{{end}}
+    </select>
+    From <input type="datetime-local" name="after" value="{{formTime .Query.After}}">
+    To <input type="datetime-local" name="before" value="{{formTime .Query.Before}}">
+    Order <select name="order">
+        {{range .Orders}}<option value="{{.Order}}"{{if eq .Order $.Query.Order}} selected{{end}}>{{.Name}}</option>{{end}}
+    </select>
+    Per page <input name="limit" size="4" value="{{.Query.Limit}}">
+    <input type="submit" value="Show">
+</form>
+
 <table>
 <tr>
     <th align="center">Id</th>
@@ -31,14 +47,14 @@ table,td,th {
     <th align="center">Start Time</th>
     <th align="center">Updated Time</th>
     <th align="center">Duration</th>
+    <th align="center">Progress</th>
     <th></td>
 </tr>
 
 {{range $index, $job := .Jobs}}
 <tr>
-    {{$key := index $.Keys $index}} 
     <td>
-        {{ $id:=$key.IntID }}
+        {{ $id:=$job.Id }}
 	<a href="job?id={{$id}}">{{$id}}</a>
     </td>
     <td>{{$job.UrlPrefix}}</td>
@@ -46,12 +62,21 @@ table,td,th {
     <td>{{$job.StartTime}}</td>
     <td>{{$job.UpdatedAt}}</td>
     <td>{{$job.Duration}}</td>
-    <td><button onclick="location.href='delete?id={{$id}}'">Delete</button></td>
+    <td>{{$job.Progress}}</td>
+    <td>
+        <button onclick="location.href='cancel?id={{$id}}'">Cancel</button>
+        <button onclick="location.href='delete?id={{$id}}'">Delete</button>
+    </td>
 </tr>
 {{end}}
 
 </table>
 
+<p>
+{{if .Query.Cursor}}<a href="{{.FirstPage}}">First page</a>{{end}}
+{{if .NextPage}}<a href="{{.NextPage}}">Next page</a>{{end}}
+</p>
+
 `
 
 const jobPage = `<html><head><title>MapReduce Console</title><style>
@@ -64,7 +89,45 @@ table,td,th {
 <h1>MapReduce Task</h1>
 
 <p>Job Id {{.Id}}</p>
-<p>{{.Pending}} Pending / {{.Running}} Running / {{.Done}} Done / {{.Failed }} Failed</p>
+<p>{{.Pending}} Pending / {{.Running}} Running / {{.Done}} Done / {{.Failed }} Failed / {{.Cancelled}} Cancelled</p>
+{{if .Progress}}<p>Stage {{.Stage}} is {{.Progress}} done</p>{{end}}
+
+{{if .Counters}}
+<h2>Counters</h2>
+<p>Totals for the completed stages</p>
+<table>
+<tr>
+    <th align="center">Counter</th>
+    <th align="center">Value</th>
+</tr>
+{{range .Counters}}
+<tr>
+    <td>{{.Name}}</td>
+    <td align="right">{{.Value}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Tasks</h2>
+
+<form method="get" action="job">
+    <input type="hidden" name="id" value="{{.Id}}">
+    Type <select name="type">
+        <option value="">{{if .StageTasks}}current stage{{else}}any{{end}}</option>
+        {{range .Types}}<option{{if eq . $.Type}} selected{{end}}>{{.}}</option>{{end}}
+    </select>
+    Status <select name="status">
+        <option value="">any</option>
+        {{range .Statuses}}<option{{if eq . $.Status}} selected{{end}}>{{.}}</option>{{end}}
+    </select>
+    <input type="submit" value="Show">
+</form>
+
+<p>Tasks {{.First}} to {{.Last}} of {{.Total}}
+{{if .PrevPage}}<a href="{{.PrevPage}}">Previous page</a>{{end}}
+{{if .NextPage}}<a href="{{.NextPage}}">Next page</a>{{end}}
+</p>
 
 <table>
 <tr>
@@ -74,20 +137,26 @@ table,td,th {
     <th align="center">Run Count</th>
     <th align="center">Start Time</th>
     <th align="center">Update Time</th>
+    <th align="center">Progress</th>
+    <th align="center">Records Read</th>
     <th align="center">Info</th>
+    <th align="center">Counters</th>
 </tr>
 
 {{range $index, $task := .Tasks}}
 <tr>
     <td>
-        {{$key := index $.TaskKeys $index}} {{ $key.IntID }}
+        {{ $task.Id }}
     </td>
     <td align="center">{{$task.Type}}</td>
     <td align="center">{{$task.Status}}</td>
     <td align="center">{{$task.Retries}}</td>
     <td align="center">{{$task.StartTime}}</td>
     <td align="center">{{$task.UpdatedAt}}</td>
+    <td align="center">{{percent $task.Progress}}</td>
+    <td align="right">{{$task.ProgressRecords}}</td>
     <td align="center">{{$task.Info}}</td>
+    <td>{{range counters $task.Counters}}{{.Name}}: {{.Value}}<br>{{end}}</td>
 </tr>
 
 {{end}}
@@ -96,35 +165,63 @@ table,td,th {
 
 `
 
+// ConsoleHandler serves a simple console for jobs which keep their state in the appengine datastore.
+// Deleting a job from it leaves the job's intermediate files behind; use ConsoleHandlerWithStorage
+// to remove them as well.
 func ConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	ds := appwrap.NewAppengineDatastore(c)
+	consoleHandler(c, w, r, NewDatastoreJobStore(c, appwrap.NewAppengineDatastore(c)), nil)
+}
+
+// ConsoleHandlerWithStorage returns a console handler for jobs which keep their state in the
+// appengine datastore; deleting a job removes its intermediate files from intStorage (normally
+// the jobs' MapReducePipeline)
+func ConsoleHandlerWithStorage(intStorage IntermediateStorage) http.HandlerFunc {
+	return ConsoleStoreHandler(intStorage, func(c context.Context) JobStore {
+		return NewDatastoreJobStore(c, appwrap.NewAppengineDatastore(c))
+	})
+}
 
+// ConsoleStoreHandler returns a console handler for jobs which keep their state in the JobStore
+// returned by getStore. If intStorage is nil, deleting a job leaves its intermediate files behind.
+func ConsoleStoreHandler(intStorage IntermediateStorage, getStore func(c context.Context) JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		consoleHandler(c, w, r, getStore(c), intStorage)
+	}
+}
+
+func consoleHandler(c context.Context, w http.ResponseWriter, r *http.Request, store JobStore, intStorage IntermediateStorage) {
 	if strings.HasSuffix(r.URL.Path, "/job") {
 		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		taskType := TaskType(r.FormValue("type"))
+		status := TaskStatus(r.FormValue("status"))
+		start, _ := strconv.Atoi(r.FormValue("start"))
+		if start < 0 {
+			start = 0
+		}
 
 		var tasks []JobTask
-		var taskKeys []*datastore.Key
-		if job, err := GetJob(ds, id); err != nil {
+		var job JobInfo
+		if j, err := store.GetJob(id); err != nil {
 			http.Error(w, "Internal error reading job: "+err.Error(), http.StatusInternalServerError)
 			return
+		} else if taskType == "" {
+			job = j
+			tasks, err = jobPageTasks(store, j)
+			if err != nil {
+				http.Error(w, "Internal error reading tasks: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if tl, err := store.JobTasks(id); err != nil {
+			http.Error(w, "Internal error reading tasks: "+err.Error(), http.StatusInternalServerError)
+			return
 		} else {
-			switch job.Stage {
-			case StageMapping, StageReducing:
-				if tl, err := GetJobTasks(ds, job); err != nil {
-					http.Error(w, "Internal error reading tasks: "+err.Error(), http.StatusInternalServerError)
-					return
-				} else {
-					tasks = tl
-					taskKeys = makeTaskKeys(ds, job.FirstTaskId, job.TaskCount)
-				}
-			default:
-				jobKey := datastore.NewKey(c, JobEntity, "", id, nil)
-				if tk, err := datastore.NewQuery(TaskEntity).Filter("Job =", jobKey).GetAll(c, &tasks); err != nil {
-					http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
-					return
-				} else {
-					taskKeys = tk
+			job = j
+			tasks = make([]JobTask, 0, len(tl))
+			for _, task := range tl {
+				if task.Type == taskType {
+					tasks = append(tasks, task)
 				}
 			}
 		}
@@ -133,6 +230,7 @@ func ConsoleHandler(w http.ResponseWriter, r *http.Request) {
 		pending := 0
 		done := 0
 		failed := 0
+		cancelled := 0
 		for i := range tasks {
 			switch tasks[i].Status {
 			case TaskStatusPending:
@@ -143,41 +241,161 @@ func ConsoleHandler(w http.ResponseWriter, r *http.Request) {
 				done++
 			case TaskStatusFailed:
 				failed++
+			case TaskStatusCancelled:
+				cancelled++
+			}
+		}
+
+		if status != "" {
+			matching := make([]JobTask, 0, len(tasks))
+			for _, task := range tasks {
+				if task.Status == status {
+					matching = append(matching, task)
+				}
+			}
+			tasks = matching
+		}
+
+		total := len(tasks)
+		if start > total {
+			start = total
+		}
+		end := start + consoleTaskPageSize
+		if end > total {
+			end = total
+		}
+		tasks = tasks[start:end]
+
+		pageUrl := func(start int) string {
+			params := url.Values{"id": []string{strconv.FormatInt(id, 10)}}
+			if taskType != "" {
+				params.Set("type", string(taskType))
+			}
+			if status != "" {
+				params.Set("status", string(status))
+			}
+			if start > 0 {
+				params.Set("start", strconv.Itoa(start))
 			}
+
+			return "job?" + params.Encode()
+		}
+
+		prevPage, nextPage := "", ""
+		if start > 0 {
+			prev := start - consoleTaskPageSize
+			if prev < 0 {
+				prev = 0
+			}
+			prevPage = pageUrl(prev)
+		}
+		if end < total {
+			nextPage = pageUrl(end)
 		}
 
-		t := template.New("main")
+		first := start + 1
+		if total == 0 {
+			first = 0
+		}
+
+		stageTasks := job.Stage == StageMapping || job.Stage == StageCombining || job.Stage == StageReducing
+
+		t := template.New("main").Funcs(template.FuncMap{"counters": sortedCounters, "percent": percent})
 		t, _ = t.Parse(jobPage)
 		if err := t.Execute(w, struct {
-			Id                             int64
-			Tasks                          []JobTask
-			TaskKeys                       []*datastore.Key
-			Pending, Running, Done, Failed int
-		}{id, tasks, taskKeys, pending, running, done, failed}); err != nil {
+			Id                                        int64
+			Tasks                                     []JobTask
+			Pending, Running, Done, Failed, Cancelled int
+			Counters                                  []counterValue
+			Stage                                     JobStage
+			Progress                                  string
+			StageTasks                                bool
+			Type                                      TaskType
+			Types                                     []TaskType
+			Status                                    TaskStatus
+			Statuses                                  []TaskStatus
+			First, Last, Total                        int
+			PrevPage, NextPage                        string
+		}{id, tasks, pending, running, done, failed, cancelled, sortedCounters(job.Counters),
+			job.Stage, describeStageProgress(job, time.Now()), stageTasks,
+			taskType, []TaskType{TaskTypeMap, TaskTypeCombine, TaskTypeReduce},
+			status, []TaskStatus{TaskStatusPending, TaskStatusRunning, TaskStatusDone, TaskStatusFailed, TaskStatusCancelled},
+			first, end, total, prevPage, nextPage}); err != nil {
 			http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 	} else if strings.HasSuffix(r.URL.Path, "/delete") {
 		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
 
-		if err := RemoveJob(ds, id); err != nil {
+		if intStorage == nil {
+			if err := store.RemoveJob(id); err != nil {
+				http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if err := RemoveJobWithStore(c, store, intStorage, id, appwrap.NewAppengineLogging(c)); err != nil {
 			http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		jobList(w, r, id)
+		jobList(w, r, store, id)
+	} else if strings.HasSuffix(r.URL.Path, "/cancel") {
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		if err := CancelJobWithStore(store, id); err != nil {
+			http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jobList(w, r, store, 0)
 	} else {
-		jobList(w, r, 0)
+		jobList(w, r, store, 0)
 	}
 }
 
-func jobList(w http.ResponseWriter, r *http.Request, skipId int64) {
+// jobPageTasks returns the tasks shown for a job; that's the tasks for the current stage while the
+// job is running, and all of them once it has finished
+func jobPageTasks(store JobStore, job JobInfo) ([]JobTask, error) {
+	switch job.Stage {
+	case StageMapping, StageCombining, StageReducing:
+		return gatherTasks(store, job)
+	default:
+		return store.JobTasks(job.Id)
+	}
+}
+
+// how many tasks the job page shows at once
+const consoleTaskPageSize = 100
+
+// how many jobs the console lists on each page by default, and at most
+const consoleJobPageSize = 50
+const consoleMaxJobPageSize = 500
+
+// jobOrderNames are the orders the console offers for the job list
+var jobOrderNames = []struct {
+	Order JobOrder
+	Name  string
+}{
+	{OrderByUpdated, "Recently updated"},
+	{OrderByUpdatedAsc, "Least recently updated"},
+	{OrderByStarted, "Recently started"},
+	{OrderByStartedAsc, "Least recently started"},
+}
+
+func jobList(w http.ResponseWriter, r *http.Request, store JobStore, skipId int64) {
 	c := appengine.NewContext(r)
 
-	q := datastore.NewQuery(JobEntity).Order("-UpdatedAt")
-	var jobs []JobInfo
-	keys, err := q.GetAll(c, &jobs)
+	query, err := jobQueryFromForm(r, consoleJobPageSize, consoleMaxJobPageSize)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Order = query.order()
+
+	jobs, cursor, err := store.QueryJobs(query)
+	if _, ok := err.(invalidJobCursorError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -185,12 +403,14 @@ func jobList(w http.ResponseWriter, r *http.Request, skipId int64) {
 	type annotatedJob struct {
 		JobInfo
 		Duration time.Duration
+		Progress string
 	}
-	annotatedList := make([]annotatedJob, 0, len(keys))
+	annotatedList := make([]annotatedJob, 0, len(jobs))
 
-	for i, key := range keys {
-		if key.IntID() != skipId {
-			job := annotatedJob{JobInfo: jobs[i]}
+	now := time.Now()
+	for i := range jobs {
+		if jobs[i].Id != skipId {
+			job := annotatedJob{JobInfo: jobs[i], Progress: describeStageProgress(jobs[i], now)}
 			if !jobs[i].StartTime.IsZero() {
 				job.Duration = jobs[i].UpdatedAt.Sub(jobs[i].StartTime)
 			}
@@ -201,14 +421,49 @@ func jobList(w http.ResponseWriter, r *http.Request, skipId int64) {
 
 	log.Infof(c, "%d jobs %d annotatedList", len(jobs), len(annotatedList))
 
-	t := template.New("main")
+	// the page links keep the filters but not the job id from cancel or delete
+	pageUrl := func(cursor string) string {
+		params := url.Values{}
+		for _, name := range []string{"prefix", "stage", "after", "before", "order", "limit"} {
+			if value := r.FormValue(name); value != "" {
+				params.Set(name, value)
+			}
+		}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+
+		return "./?" + params.Encode()
+	}
+
+	nextPage := ""
+	if cursor != "" {
+		nextPage = pageUrl(cursor)
+	}
+
+	t := template.New("main").Funcs(template.FuncMap{"formTime": formTime})
 	t, _ = t.Parse(main)
 	err = t.Execute(w, struct {
-		Jobs []annotatedJob
-		Keys []*datastore.Key
-	}{annotatedList, keys})
+		Jobs      []annotatedJob
+		Query     JobQuery
+		Stages    []JobStage
+		Orders    interface{}
+		FirstPage string
+		NextPage  string
+	}{annotatedList, query,
+		[]JobStage{StageFormation, StageMapping, StageCombining, StageReducing, StageDone, StageFailed, StageCancelled},
+		jobOrderNames, pageUrl(""), nextPage})
 	if err != nil {
 		http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// formTime formats a time for a datetime-local form input; zero times are left blank
+func formTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format("2006-01-02T15:04")
+}
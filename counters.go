@@ -0,0 +1,186 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Names of the counters the framework keeps for every job
+const (
+	CounterMapInputRecords     = "map input records"  // items read by map tasks
+	CounterMapOutputRecords    = "map output records" // items returned by Map and MapComplete
+	CounterSpills              = "spills"             // spills written by map tasks
+	CounterSpilledBytes        = "spilled bytes"      // dumped size of the mapped items in those spills
+	CounterReduceInputKeys     = "reduce input keys"  // keys passed to the reducer
+	CounterReduceOutputRecords = "reduce output records"
+)
+
+// Counters is a set of named int64 counters kept by a single task. Once the task is done its
+// counters are saved in the JobTask, and they are added into the job's totals when its stage
+// completes. Counters may be updated from multiple goroutines; methods on a nil Counters do
+// nothing.
+type Counters struct {
+	mtx    sync.Mutex
+	values map[string]int64
+}
+
+// CounterMapper may optionally be implemented by a MapReducePipeline which keeps its own
+// counters. If it is, MapCounters is used instead of Mapper.Map.
+type CounterMapper interface {
+	MapCounters(item interface{}, statusUpdate StatusUpdateFunc, counters *Counters) ([]MappedData, error)
+}
+
+// CounterReducer may optionally be implemented by a MapReducePipeline which keeps its own
+// counters. If it is, ReduceCounters is used instead of Reducer.Reduce (but not instead of
+// StreamingReducer.ReduceStream or EmitReducer.ReduceEmit; see CounterStreamingReducer and
+// CounterEmitReducer for those).
+type CounterReducer interface {
+	ReduceCounters(key interface{}, values []interface{}, statusUpdate StatusUpdateFunc, counters *Counters) (result interface{}, err error)
+}
+
+// CounterStreamingReducer may optionally be implemented by a StreamingReducer which keeps its own
+// counters. If it is, ReduceStreamCounters is used instead of StreamingReducer.ReduceStream.
+type CounterStreamingReducer interface {
+	ReduceStreamCounters(key interface{}, values ReduceValueIterator, statusUpdate StatusUpdateFunc, counters *Counters) (result interface{}, err error)
+}
+
+// CounterEmitReducer may optionally be implemented by an EmitReducer which keeps its own
+// counters. If it is, ReduceEmitCounters is used instead of EmitReducer.ReduceEmit.
+type CounterEmitReducer interface {
+	ReduceEmitCounters(key interface{}, values ReduceValueIterator, emit EmitFunc, statusUpdate StatusUpdateFunc, counters *Counters) error
+}
+
+// NewCounters returns an empty set of counters
+func NewCounters() *Counters {
+	return &Counters{values: make(map[string]int64)}
+}
+
+// Increment adds delta to the named counter
+func (c *Counters) Increment(name string, delta int64) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[name] += delta
+}
+
+// Get returns the value of the named counter, which is zero if it has never been incremented
+func (c *Counters) Get(name string) int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[name]
+}
+
+// Values returns a copy of all of the counters
+func (c *Counters) Values() map[string]int64 {
+	values := make(map[string]int64)
+	if c == nil {
+		return values
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for name, value := range c.values {
+		values[name] = value
+	}
+
+	return values
+}
+
+// add adds all of values into the counters
+func (c *Counters) add(values map[string]int64) {
+	for name, value := range values {
+		c.Increment(name, value)
+	}
+}
+
+// encode returns the counters as they are saved in JobTasks and JobInfos, which is "" if there
+// aren't any
+func (c *Counters) encode() string {
+	values := c.Values()
+	if len(values) == 0 {
+		return ""
+	}
+
+	countersJson, _ := json.Marshal(values)
+	return string(countersJson)
+}
+
+// DecodeCounters parses the Counters field of a JobTask or JobInfo
+func DecodeCounters(encoded string) (map[string]int64, error) {
+	values := make(map[string]int64)
+	if encoded == "" {
+		return values, nil
+	} else if err := json.Unmarshal([]byte(encoded), &values); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal counters: %s", err)
+	}
+
+	return values, nil
+}
+
+// addTaskCounters adds the counters saved in each of the tasks into the encoded job counters
+func addTaskCounters(jobCounters string, tasks []JobTask) (string, error) {
+	totals := NewCounters()
+	if values, err := DecodeCounters(jobCounters); err != nil {
+		return "", err
+	} else {
+		totals.add(values)
+	}
+
+	for _, task := range tasks {
+		if values, err := DecodeCounters(task.Counters); err != nil {
+			return "", fmt.Errorf("task %d: %s", task.Id, err)
+		} else {
+			totals.add(values)
+		}
+	}
+
+	return totals.encode(), nil
+}
+
+// counterValue is a single counter, for displaying on the console
+type counterValue struct {
+	Name  string
+	Value int64
+}
+
+type counterValueList []counterValue
+
+func (l counterValueList) Len() int           { return len(l) }
+func (l counterValueList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l counterValueList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// sortedCounters returns the encoded counters sorted by name; counters which can't be decoded
+// are left out
+func sortedCounters(encoded string) []counterValue {
+	values, _ := DecodeCounters(encoded)
+	list := make(counterValueList, 0, len(values))
+	for name, value := range values {
+		list = append(list, counterValue{name, value})
+	}
+
+	sort.Sort(list)
+	return list
+}
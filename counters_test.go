@@ -0,0 +1,198 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	ck "gopkg.in/check.v1"
+)
+
+// testCountingWordCount keeps its own counters alongside the built in ones
+type testCountingWordCount struct {
+	testLocalWordCount
+}
+
+func (t *testCountingWordCount) MapCounters(item interface{}, status StatusUpdateFunc, counters *Counters) ([]MappedData, error) {
+	if strings.TrimSpace(item.(string)) == "" {
+		counters.Increment("blank lines", 1)
+	}
+
+	return t.Map(item, status)
+}
+
+func (t *testCountingWordCount) ReduceCounters(key interface{}, values []interface{}, status StatusUpdateFunc, counters *Counters) (interface{}, error) {
+	if len(values) == 1 {
+		counters.Increment("unique words", 1)
+	}
+
+	return t.Reduce(key, values, status)
+}
+
+// testCountingEmitWordCount counts the words it emits a second line for
+type testCountingEmitWordCount struct {
+	testLocalEmitWordCount
+}
+
+func (t *testCountingEmitWordCount) ReduceEmitCounters(key interface{}, values ReduceValueIterator, emit EmitFunc, status StatusUpdateFunc, counters *Counters) error {
+	emitCounting := func(result interface{}) error {
+		if strings.HasSuffix(result.(string), ": repeated") {
+			counters.Increment("repeated words", 1)
+		}
+		return emit(result)
+	}
+
+	return t.ReduceEmit(key, values, emitCounting, status)
+}
+
+func (mrt *MapreduceTests) TestCounters(c *ck.C) {
+	counters := NewCounters()
+	c.Assert(counters.encode(), ck.Equals, "")
+	counters.Increment("a", 2)
+	counters.Increment("a", 3)
+	counters.Increment("b", -1)
+	c.Assert(counters.Get("a"), ck.Equals, int64(5))
+	c.Assert(counters.Get("c"), ck.Equals, int64(0))
+	c.Assert(counters.Values(), ck.DeepEquals, map[string]int64{"a": 5, "b": -1})
+
+	var none *Counters
+	none.Increment("a", 1)
+	c.Assert(none.Get("a"), ck.Equals, int64(0))
+	c.Assert(none.encode(), ck.Equals, "")
+
+	totals, err := addTaskCounters(`{"a":1}`, []JobTask{{Counters: counters.encode()}, {}, {Counters: `{"c":7}`}})
+	c.Assert(err, ck.IsNil)
+	values, err := DecodeCounters(totals)
+	c.Assert(err, ck.IsNil)
+	c.Assert(values, ck.DeepEquals, map[string]int64{"a": 6, "b": -1, "c": 7})
+	c.Assert(sortedCounters(totals), ck.DeepEquals, []counterValue{{"a", 6}, {"b", -1}, {"c", 7}})
+
+	_, err = addTaskCounters("", []JobTask{{Counters: "not json"}})
+	c.Assert(err, ck.NotNil)
+}
+
+func (mrt *MapreduceTests) TestJobStageCompleteCounters(c *ck.C) {
+	store := NewMemoryJobStore()
+
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}})
+	c.Assert(err, ck.IsNil)
+
+	runStage := func(stage, nextStage JobStage, counters ...string) JobInfo {
+		firstId, err := store.AllocateTaskIds(len(counters))
+		c.Assert(err, ck.IsNil)
+		taskIds := makeTaskIds(firstId, len(counters))
+		tasks := make([]JobTask, len(taskIds))
+		for i := range tasks {
+			tasks[i] = JobTask{Status: TaskStatusDone, Type: TaskTypeMap, Counters: counters[i]}
+		}
+		c.Assert(createTasks(store, jobId, taskIds, tasks, stage, mrt.nullLog), ck.IsNil)
+
+		advanced, job, err := jobStageComplete(store, jobId, taskIds, stage, nextStage, mrt.nullLog)
+		c.Assert(err, ck.IsNil)
+		c.Assert(advanced, ck.Equals, true)
+		return job
+	}
+
+	runStage(StageMapping, StageReducing, `{"a":1}`, `{"a":2,"b":1}`)
+	job := runStage(StageReducing, StageDone, `{"c":5}`, "")
+
+	values, err := DecodeCounters(job.Counters)
+	c.Assert(err, ck.IsNil)
+	c.Assert(values, ck.DeepEquals, map[string]int64{"a": 3, "b": 1, "c": 5})
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerCounters(c *ck.C) {
+	u := &testCountingWordCount{testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	info, tasks, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	// work out what the counters should be from the inputs and expected results
+	lines, blank := 0, 0
+	for i := 1; i <= 5; i++ {
+		input, err := ioutil.ReadFile(fmt.Sprintf("testdata/pandp-%d", i))
+		c.Assert(err, ck.IsNil)
+		for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+			lines++
+			if strings.TrimSpace(line) == "" {
+				blank++
+			}
+		}
+	}
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	words, unique, dumped := 0, 0, 0
+	results := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	for _, result := range results {
+		count, err := strconv.Atoi(result[strings.LastIndex(result, " ")+1:])
+		c.Assert(err, ck.IsNil)
+		words += count
+		if count == 1 {
+			unique++
+		}
+
+		// each word is spilled as the word and a value of 1
+		dumped += count * (strings.LastIndex(result, ": ") + 1)
+	}
+
+	values, err := DecodeCounters(info.Counters)
+	c.Assert(err, ck.IsNil)
+	c.Check(values[CounterMapInputRecords], ck.Equals, int64(lines))
+	c.Check(values[CounterMapOutputRecords], ck.Equals, int64(words))
+	c.Check(values[CounterSpills], ck.Equals, int64(5))
+	c.Check(values[CounterSpilledBytes], ck.Equals, int64(dumped))
+	c.Check(values[CounterReduceInputKeys], ck.Equals, int64(len(results)))
+	c.Check(values[CounterReduceOutputRecords], ck.Equals, int64(len(results)))
+	c.Check(values["blank lines"], ck.Equals, int64(blank))
+	c.Check(values["unique words"], ck.Equals, int64(unique))
+
+	// the totals are the sums of the tasks' counters
+	taskTotal := int64(0)
+	for _, task := range tasks {
+		taskValues, err := DecodeCounters(task.Counters)
+		c.Assert(err, ck.IsNil)
+		taskTotal += taskValues[CounterMapInputRecords]
+	}
+	c.Assert(taskTotal, ck.Equals, int64(lines))
+}
+
+func (mrt *MapreduceTests) TestEmitReducerCounters(c *ck.C) {
+	u := &testCountingEmitWordCount{testLocalEmitWordCount{testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 2}}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	info, _, err := LocalRunner{}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	repeated := 0
+	for _, line := range strings.Split(strings.TrimRight(string(expected), "\n"), "\n") {
+		if !strings.HasSuffix(line, ": 1") {
+			repeated++
+		}
+	}
+
+	values, err := DecodeCounters(info.Counters)
+	c.Assert(err, ck.IsNil)
+	c.Check(values["repeated words"], ck.Equals, int64(repeated))
+	c.Check(values[CounterReduceOutputRecords], ck.Equals, int64(len(u.lines())))
+}
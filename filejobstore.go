@@ -0,0 +1,294 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// jobStoreChange is a single record in the log kept by a file job store. It holds the jobs, tasks
+// and chains which were written by one change to the store (nil entries are ones which were
+// removed), along with any id counters which moved. After the log is compacted its only record
+// holds the whole store.
+type jobStoreChange struct {
+	Jobs        map[int64]*JobInfo  `json:",omitempty"`
+	Tasks       map[int64]*JobTask  `json:",omitempty"`
+	Chains      map[int64]*JobChain `json:",omitempty"`
+	NextJobId   int64               `json:",omitempty"`
+	NextTaskId  int64               `json:",omitempty"`
+	NextChainId int64               `json:",omitempty"`
+}
+
+// the log is compacted once it's twice the size it was after it was last compacted, but never
+// while it's smaller than this
+var minJobStoreCompactSize int64 = 1 << 20
+
+// jobStoreLog is the file a file job store appends its changes to
+type jobStoreLog struct {
+	path          string
+	lock          *os.File
+	log           *os.File
+	size          int64
+	compactedSize int64
+}
+
+// NewFileJobStore returns a JobStore which is kept in memory, but which appends every change to
+// a (json) log at path so jobs survive restarts. Each change is synced to disk before the call
+// making it returns, and the log is rewritten from scratch once it grows to twice the size of the
+// store. The file is created if it doesn't already exist.
+//
+// Only one process may use the file at a time; an exclusive lock on path + ".lock" is held until
+// the returned store is closed (it implements io.Closer), and opening a store which is already
+// open fails.
+func NewFileJobStore(path string) (JobStore, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		lock.Close()
+		return nil, fmt.Errorf("job store %s is in use by another process", path)
+	} else if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	m := newMemoryJobStore()
+	if err := m.replay(path); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	// starting with a freshly compacted log drops any record which was cut short by a crash
+	m.file = &jobStoreLog{path: path, lock: lock}
+	if err := m.compact(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// replay applies the records in the log at path to the store. Only the last record can have been
+// cut short by a crash, so a last record which can't be read is ignored.
+func (m *memoryJobStore) replay(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a record without its newline was never finished
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var change jobStoreChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("reading job store %s: %s", path, err)
+		}
+
+		m.apply(change)
+	}
+}
+
+// apply makes the changes in a log record to the store
+func (m *memoryJobStore) apply(change jobStoreChange) {
+	for id, job := range change.Jobs {
+		if job == nil {
+			delete(m.Jobs, id)
+		} else {
+			m.Jobs[id] = *job
+		}
+	}
+
+	for id, task := range change.Tasks {
+		if task == nil {
+			delete(m.Tasks, id)
+		} else {
+			m.Tasks[id] = *task
+		}
+	}
+
+	for id, chain := range change.Chains {
+		if chain == nil {
+			delete(m.Chains, id)
+		} else {
+			m.Chains[id] = *chain
+		}
+	}
+
+	if change.NextJobId != 0 {
+		m.NextJobId = change.NextJobId
+	}
+	if change.NextTaskId != 0 {
+		m.NextTaskId = change.NextTaskId
+	}
+	if change.NextChainId != 0 {
+		m.NextChainId = change.NextChainId
+	}
+}
+
+// save appends change to the store's log (if it has one) and syncs it; the lock must be held
+func (m *memoryJobStore) save(change jobStoreChange) error {
+	if m.file == nil {
+		return nil
+	} else if m.file.log == nil {
+		return fmt.Errorf("job store %s is closed", m.file.path)
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if _, err := m.file.log.Write(data); err != nil {
+		// don't leave a partial record in front of the next one
+		m.file.log.Truncate(m.file.size)
+		return err
+	} else if err := m.file.log.Sync(); err != nil {
+		return err
+	}
+
+	m.file.size += int64(len(data))
+	if m.file.size >= minJobStoreCompactSize && m.file.size >= 2*m.file.compactedSize {
+		return m.compact()
+	}
+
+	return nil
+}
+
+// compact replaces the store's log with a single record holding the whole store; the lock must
+// be held. The record is written to a temporary file which is synced before it's renamed over
+// the log, and the directory is synced afterwards so the rename survives a crash as well.
+func (m *memoryJobStore) compact() error {
+	all := jobStoreChange{
+		Jobs:        make(map[int64]*JobInfo, len(m.Jobs)),
+		Tasks:       make(map[int64]*JobTask, len(m.Tasks)),
+		Chains:      make(map[int64]*JobChain, len(m.Chains)),
+		NextJobId:   m.NextJobId,
+		NextTaskId:  m.NextTaskId,
+		NextChainId: m.NextChainId,
+	}
+
+	for id := range m.Jobs {
+		job := m.Jobs[id]
+		all.Jobs[id] = &job
+	}
+	for id := range m.Tasks {
+		task := m.Tasks[id]
+		all.Tasks[id] = &task
+	}
+	for id := range m.Chains {
+		chain := m.Chains[id]
+		all.Chains[id] = &chain
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	dir := filepath.Dir(m.file.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(m.file.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	} else if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	} else if err := os.Rename(tmp.Name(), m.file.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	} else if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(m.file.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+
+	if m.file.log != nil {
+		m.file.log.Close()
+	}
+
+	m.file.log = log
+	m.file.size = int64(len(data))
+	m.file.compactedSize = m.file.size
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// Close closes the log of a store returned by NewFileJobStore and releases its lock, after which
+// the store can't be changed. It does nothing for stores which are only kept in memory.
+func (m *memoryJobStore) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.file == nil || m.file.log == nil {
+		return nil
+	}
+
+	err := m.file.log.Close()
+	m.file.log = nil
+
+	// closing the file releases the lock
+	if lockErr := m.file.lock.Close(); err == nil {
+		err = lockErr
+	}
+
+	return err
+}
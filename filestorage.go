@@ -0,0 +1,169 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+type jobIdKey struct{}
+
+// withJobId returns a context which carries the id of the job a task belongs to; map and
+// reduce tasks pass it to their IntermediateStorage so intermediates can be grouped by job
+func withJobId(c context.Context, jobId int64) context.Context {
+	return context.WithValue(c, jobIdKey{}, jobId)
+}
+
+// JobIdFromContext returns the id of the job which is running when IntermediateStorage methods are
+// called from map and reduce tasks. Jobs run by LocalRunner have no id.
+func JobIdFromContext(c context.Context) (int64, bool) {
+	jobId, ok := c.Value(jobIdKey{}).(int64)
+	return jobId, ok
+}
+
+// IntermediateJobCleaner is implemented by IntermediateStorage which can remove everything written
+// for a job. If the pipeline implements it, RemoveJobIntermediates is called once the job is done,
+// has failed, or has been cancelled, which cleans up after tasks that were retried or stopped
+// partway through.
+type IntermediateJobCleaner interface {
+	RemoveJobIntermediates(c context.Context, jobId int64) error
+}
+
+// removeJobIntermediates calls RemoveJobIntermediates if taskIntf implements IntermediateJobCleaner
+func removeJobIntermediates(c context.Context, taskIntf interface{}, jobId int64, log appwrap.Logging) {
+	if cleaner, ok := taskIntf.(IntermediateJobCleaner); ok {
+		if err := cleaner.RemoveJobIntermediates(c, jobId); err != nil {
+			log.Errorf("failed to remove intermediate files for job %d: %s", jobId, err)
+		}
+	}
+}
+
+// FileIntermediateStorage is an IntermediateStorage which keeps intermediate data in files under
+// Root, using the block format. Intermediates written by map and reduce tasks go into a directory
+// for their job, which lets RemoveJobIntermediates clean up whatever failed tasks left behind. The
+// names it returns are relative to Root, so they stay valid if Root is on a filesystem that is
+// shared between servers. It is safe for concurrent use.
+type FileIntermediateStorage struct {
+	Root string
+}
+
+func NewFileIntermediateStorage(root string) *FileIntermediateStorage {
+	return &FileIntermediateStorage{Root: root}
+}
+
+func (fs *FileIntermediateStorage) jobDir(jobId int64) string {
+	return fmt.Sprintf("job-%d", jobId)
+}
+
+// path turns a name returned by ToName() into a path under Root
+func (fs *FileIntermediateStorage) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid intermediate name %q", name)
+	}
+
+	return filepath.Join(fs.Root, clean), nil
+}
+
+func (fs *FileIntermediateStorage) CreateIntermediate(c context.Context, handler KeyValueHandler) (SingleIntermediateStorageWriter, error) {
+	dir := ""
+	if jobId, ok := JobIdFromContext(c); ok {
+		dir = fs.jobDir(jobId)
+	}
+
+	if err := os.MkdirAll(filepath.Join(fs.Root, dir), 0755); err != nil {
+		return nil, fmt.Errorf("creating intermediate directory: %s", err)
+	}
+
+	// TempFile picks a name nobody else is using, even with other processes sharing Root
+	f, err := ioutil.TempFile(filepath.Join(fs.Root, dir), "intermediate-")
+	if err != nil {
+		return nil, fmt.Errorf("creating intermediate file: %s", err)
+	}
+
+	name := filepath.ToSlash(filepath.Join(dir, filepath.Base(f.Name())))
+
+	return &fileIntermediateWriter{NewBlockIntermediateWriter(f, handler), name}, nil
+}
+
+func (fs *FileIntermediateStorage) Iterator(c context.Context, name string, handler KeyValueHandler) (IntermediateStorageIterator, error) {
+	path, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	counter := &countingReadCloser{ReadCloser: f}
+	return &fileIntermediateIterator{NewBlockIntermediateIterator(counter, handler), counter, info.Size()}, nil
+}
+
+// RemoveIntermediate removes a single intermediate file; removing one which is already gone is not
+// an error, since cleanup after a cancelled or failed job can overlap with the tasks' own
+func (fs *FileIntermediateStorage) RemoveIntermediate(c context.Context, name string) error {
+	path, err := fs.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveJobIntermediates removes all of the intermediate files written by map and reduce tasks for
+// a job. It should only be called once the job has finished.
+func (fs *FileIntermediateStorage) RemoveJobIntermediates(c context.Context, jobId int64) error {
+	return os.RemoveAll(filepath.Join(fs.Root, fs.jobDir(jobId)))
+}
+
+type fileIntermediateWriter struct {
+	*BlockIntermediateWriter
+	name string
+}
+
+func (w *fileIntermediateWriter) ToName() string {
+	return w.name
+}
+
+// fileIntermediateIterator is a ProgressReader for intermediate files; what's been read includes
+// whatever the iterator has buffered
+type fileIntermediateIterator struct {
+	IntermediateStorageIterator
+	counter *countingReadCloser
+	size    int64
+}
+
+func (fi *fileIntermediateIterator) Progress() (consumed, total int64) {
+	return fi.counter.count, fi.size
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+type testStringHandler struct {
+	StringKeyHandler
+	StringValueHandler
+}
+
+func (mrt *MapreduceTests) writeFileIntermediate(c *ck.C, ctx context.Context, storage *FileIntermediateStorage, items int) string {
+	w, err := storage.CreateIntermediate(ctx, testStringHandler{})
+	c.Assert(err, ck.IsNil)
+	for i := 0; i < items; i++ {
+		c.Assert(w.WriteMappedData(MappedData{Key: fmt.Sprintf("key %d", i), Value: fmt.Sprintf("value %d", i)}), ck.IsNil)
+	}
+	c.Assert(w.Close(ctx), ck.IsNil)
+
+	return w.ToName()
+}
+
+func (mrt *MapreduceTests) readFileIntermediate(c *ck.C, ctx context.Context, storage *FileIntermediateStorage, name string) int {
+	iter, err := storage.Iterator(ctx, name, testStringHandler{})
+	c.Assert(err, ck.IsNil)
+	defer iter.Close()
+
+	count := 0
+	for {
+		item, valid, err := iter.Next()
+		c.Assert(err, ck.IsNil)
+		if !valid {
+			// the whole file has been read
+			c.Assert(readProgress(iter), ck.Equals, 1.0)
+			return count
+		}
+
+		c.Assert(item.Key, ck.Equals, fmt.Sprintf("key %d", count))
+		c.Assert(item.Value, ck.Equals, fmt.Sprintf("value %d", count))
+		count++
+	}
+}
+
+func (mrt *MapreduceTests) TestFileIntermediateStorage(c *ck.C) {
+	dir, err := ioutil.TempDir("", "intermediate")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	ctx := withJobId(appwrap.StubContext(), 12)
+	storage := NewFileIntermediateStorage(dir)
+
+	name := mrt.writeFileIntermediate(c, ctx, storage, 1000)
+	c.Assert(strings.HasPrefix(name, "job-12/"), ck.Equals, true)
+	c.Assert(mrt.readFileIntermediate(c, ctx, storage, name), ck.Equals, 1000)
+
+	// names are relative to the root, so another storage on the same directory can read them
+	c.Assert(mrt.readFileIntermediate(c, appwrap.StubContext(), NewFileIntermediateStorage(dir), name), ck.Equals, 1000)
+
+	c.Assert(storage.RemoveIntermediate(ctx, name), ck.IsNil)
+	_, err = storage.Iterator(ctx, name, testStringHandler{})
+	c.Assert(os.IsNotExist(err), ck.Equals, true)
+	c.Assert(storage.RemoveIntermediate(ctx, name), ck.IsNil)
+
+	for _, bad := range []string{"", "../outside", "/etc/passwd", "job-12/../../outside"} {
+		_, err := storage.Iterator(ctx, bad, testStringHandler{})
+		c.Check(err, ck.ErrorMatches, "invalid intermediate name.*")
+		c.Check(storage.RemoveIntermediate(ctx, bad), ck.ErrorMatches, "invalid intermediate name.*")
+	}
+
+	// intermediates written outside of a job go straight into the root
+	name = mrt.writeFileIntermediate(c, appwrap.StubContext(), storage, 10)
+	c.Assert(strings.Contains(name, "/"), ck.Equals, false)
+	c.Assert(mrt.readFileIntermediate(c, ctx, storage, name), ck.Equals, 10)
+}
+
+func (mrt *MapreduceTests) TestFileIntermediateStorageConcurrent(c *ck.C) {
+	dir, err := ioutil.TempDir("", "intermediate")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	ctx := withJobId(appwrap.StubContext(), 1)
+	storage := NewFileIntermediateStorage(dir)
+
+	names := make([]string, 20)
+	wg := sync.WaitGroup{}
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names[i] = mrt.writeFileIntermediate(c, ctx, storage, 100*i)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i, name := range names {
+		c.Assert(seen[name], ck.Equals, false)
+		seen[name] = true
+		c.Assert(mrt.readFileIntermediate(c, ctx, storage, name), ck.Equals, 100*i)
+	}
+}
+
+// testCleanupTasks records posted statuses for a pipeline which keeps intermediates in files
+type testCleanupTasks struct {
+	*FileIntermediateStorage
+	posted []string
+}
+
+func (t *testCleanupTasks) PostTask(c context.Context, url string, jsonParameters string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (t *testCleanupTasks) PostStatus(c context.Context, url string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (mrt *MapreduceTests) TestFileIntermediateStorageJobCleanup(c *ck.C) {
+	dir, err := ioutil.TempDir("", "intermediate")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	tasks := &testCleanupTasks{FileIntermediateStorage: NewFileIntermediateStorage(dir)}
+
+	// orphans left by failed tasks for two jobs
+	for _, jobId := range []int64{1, 2, 3} {
+		mrt.writeFileIntermediate(c, withJobId(appwrap.StubContext(), jobId), tasks.FileIntermediateStorage, 10)
+		mrt.writeFileIntermediate(c, withJobId(appwrap.StubContext(), jobId), tasks.FileIntermediateStorage, 10)
+	}
+
+	jobDirs := func() []string {
+		entries, err := ioutil.ReadDir(dir)
+		c.Assert(err, ck.IsNil)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	c.Assert(jobDirs(), ck.DeepEquals, []string{"job-1", "job-2", "job-3"})
+
+	c.Assert(tasks.RemoveJobIntermediates(appwrap.StubContext(), 1), ck.IsNil)
+	c.Assert(jobDirs(), ck.DeepEquals, []string{"job-2", "job-3"})
+
+	// finishing a job cleans up after it
+	jobComplete(appwrap.StubContext(), tasks, JobInfo{Id: 2, OnCompleteUrl: "/done"}, mrt.nullLog)
+	c.Assert(tasks.posted, ck.DeepEquals, []string{"/done?status=done&id=2"})
+	c.Assert(jobDirs(), ck.DeepEquals, []string{"job-3"})
+
+	// as does failing one
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "/mr/test", WriterNames: []string{"output"}, RetryCount: 5})
+	c.Assert(err, ck.IsNil)
+	mrt.writeFileIntermediate(c, withJobId(appwrap.StubContext(), jobId), tasks.FileIntermediateStorage, 10)
+	c.Assert(jobDirs(), ck.HasLen, 2)
+
+	jobFailed(appwrap.StubContext(), store, tasks, jobId, fmt.Errorf("failed"), mrt.nullLog)
+	c.Assert(jobDirs(), ck.DeepEquals, []string{"job-3"})
+
+	// removing a job without any intermediates is fine
+	c.Assert(tasks.RemoveJobIntermediates(appwrap.StubContext(), 1), ck.IsNil)
+}
+
+type testLocalFileStorage struct {
+	testLocalWordCount
+	*FileIntermediateStorage
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerFileStorage(c *ck.C) {
+	dir, err := ioutil.TempDir("", "intermediate")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	u := &testLocalFileStorage{
+		testLocalWordCount:      testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}},
+		FileIntermediateStorage: NewFileIntermediateStorage(filepath.Join(dir, "storage")),
+	}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	info, _, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+
+	// the reduces removed everything the maps wrote
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "storage"))
+	c.Assert(err, ck.IsNil)
+	c.Assert(entries, ck.HasLen, 0)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
@@ -30,6 +30,10 @@ func (mrt *MapreduceTests) ContextFn(*http.Request) context.Context {
 	return appwrap.StubContext()
 }
 
+func (mrt *MapreduceTests) LoggerFn(context.Context) appwrap.Logging {
+	return mrt.nullLog
+}
+
 var _ = check.Suite(&MapreduceTests{})
 
 func TestMapReduce(t *testing.T) { check.TestingT(t) }
@@ -0,0 +1,176 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// a key is hot if it makes up at least this fraction of the items in one of a map task's spills,
+// and there are at least hotKeyMinItems of them
+var hotKeyFraction = 0.01
+var hotKeyMinItems = 100
+
+// mapResult is the Result of a map task (other than for map only jobs)
+type mapResult struct {
+	// Names is the intermediate files the task wrote and the shard for each. Jobs which salt
+	// hot keys have twice as many shards as reducers; shard shardCount+i holds hot keys which
+	// are combined by the ith combine task.
+	Names map[string]int
+
+	// HotKeys is how many items the task mapped for each of the keys it found to be hot, by
+	// the base64 encoding of the dumped key
+	HotKeys map[string]int `json:",omitempty"`
+}
+
+// parseMapResult loads the Result of a map task. Tasks which finished before hot keys were
+// reported saved just the names.
+func parseMapResult(result string) (mapResult, error) {
+	var r mapResult
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		return mapResult{}, err
+	} else if r.Names != nil {
+		return r, nil
+	} else if err := json.Unmarshal([]byte(result), &r.Names); err != nil {
+		return mapResult{}, err
+	}
+
+	return r, nil
+}
+
+// hotKeyCounter finds the hot keys in a map task's spills, and moves the items for them into the
+// salted shards if the job salts hot keys
+type hotKeyCounter struct {
+	handler    KeyHandler
+	shardCount int
+	salt       bool
+	counts     map[string]int // by dumped key
+	nextSalt   int
+}
+
+func newHotKeyCounter(handler KeyHandler, shardCount int, salt bool) *hotKeyCounter {
+	return &hotKeyCounter{
+		handler:    handler,
+		shardCount: shardCount,
+		salt:       salt,
+		counts:     make(map[string]int),
+	}
+}
+
+// dataSetCount is how many data sets a map task needs
+func (h *hotKeyCounter) dataSetCount() int {
+	if h.salt {
+		return h.shardCount * 2
+	}
+
+	return h.shardCount
+}
+
+// spill counts the keys in the first shardCount data sets, which are about to be spilled. Keys
+// which are hot, or were hot in an earlier spill, have their items counted, and moved to the
+// salted data sets if the job salts hot keys. The data sets are left sorted.
+func (h *hotKeyCounter) spill(dataSets []mappedDataList) {
+	total := 0
+	for i := 0; i < h.shardCount; i++ {
+		total += len(dataSets[i].data)
+	}
+
+	threshold := int(hotKeyFraction * float64(total))
+	if threshold < hotKeyMinItems {
+		threshold = hotKeyMinItems
+	}
+
+	for i := 0; i < h.shardCount; i++ {
+		sort.Sort(dataSets[i])
+
+		data := dataSets[i].data
+		kept := data[0:0]
+		for first := 0; first < len(data); {
+			last := first + 1
+			for last < len(data) && h.handler.Equal(data[first].Key, data[last].Key) {
+				last++
+			}
+
+			run := data[first:last]
+			first = last
+
+			key := string(h.handler.KeyDump(run[0].Key))
+			_, hot := h.counts[key]
+			if hot || len(run) >= threshold {
+				h.counts[key] += len(run)
+				hot = true
+			}
+
+			if !hot || !h.salt {
+				kept = append(kept, run...)
+				continue
+			}
+
+			// spread the key over all of the salted shards
+			for _, item := range run {
+				salted := h.shardCount + h.nextSalt
+				dataSets[salted].data = append(dataSets[salted].data, item)
+				h.nextSalt = (h.nextSalt + 1) % h.shardCount
+			}
+		}
+
+		dataSets[i].data = kept
+	}
+}
+
+// report returns the counts for the hot keys, keyed by the base64 encoding of the dumped key
+func (h *hotKeyCounter) report() map[string]int {
+	if len(h.counts) == 0 {
+		return nil
+	}
+
+	report := make(map[string]int, len(h.counts))
+	for key, count := range h.counts {
+		report[base64.StdEncoding.EncodeToString([]byte(key))] = count
+	}
+
+	return report
+}
+
+// load restores the counts saved by report() so a map task resumed from a checkpoint keeps
+// treating the same keys as hot
+func (h *hotKeyCounter) load(report map[string]int) error {
+	for encoded, count := range report {
+		if key, err := base64.StdEncoding.DecodeString(encoded); err != nil {
+			return fmt.Errorf("decoding hot key: %s", err)
+		} else {
+			h.counts[string(key)] = count
+		}
+	}
+
+	return nil
+}
+
+// checkSaltHotKeys makes sure a job which salts hot keys can combine them. Jobs with
+// SeparateReduceItems never combine their values, so they can't salt hot keys either.
+func checkSaltHotKeys(job MapReduceJob) error {
+	if !job.SaltHotKeys || job.MapOnly {
+		return nil
+	} else if _, ok := job.MapReducePipeline.(Combiner); !ok {
+		return fmt.Errorf("salting hot keys requires a pipeline which implements Combiner")
+	} else if job.SeparateReduceItems {
+		return fmt.Errorf("salting hot keys can't be used with SeparateReduceItems")
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testSaltedWordCount counts words using a Combiner, which lets it salt hot keys
+type testSaltedWordCount struct {
+	*testCancelPipeline
+}
+
+func (t *testSaltedWordCount) Combine(key interface{}, values []interface{}) (interface{}, error) {
+	sum := 0
+	for _, value := range values {
+		sum += value.(int)
+	}
+
+	return sum, nil
+}
+
+func (t *testSaltedWordCount) Reduce(key interface{}, values []interface{}, status StatusUpdateFunc) (interface{}, error) {
+	sum, _ := t.Combine(key, values)
+	return fmt.Sprintf("%s: %d", key, sum), nil
+}
+
+func (mrt *MapreduceTests) TestHotKeyCounter(c *ck.C) {
+	newDataSets := func(count int) []mappedDataList {
+		dataSets := make([]mappedDataList, count)
+		for i := range dataSets {
+			dataSets[i] = mappedDataList{data: make([]MappedData, 0), compare: StringKeyHandler{}}
+		}
+
+		for i := 0; i < 1000; i++ {
+			dataSets[0].data = append(dataSets[0].data, MappedData{Key: fmt.Sprintf("cold-%d", i), Value: 1})
+		}
+		for i := 0; i < 200; i++ {
+			dataSets[1].data = append(dataSets[1].data, MappedData{Key: "hot", Value: 1})
+			dataSets[1].data = append(dataSets[1].data, MappedData{Key: "warm", Value: 1})
+		}
+
+		return dataSets
+	}
+
+	hot := newHotKeyCounter(StringKeyHandler{}, 2, false)
+	c.Assert(hot.dataSetCount(), ck.Equals, 2)
+	dataSets := newDataSets(2)
+	hot.spill(dataSets)
+	c.Assert(dataSets[0].data, ck.HasLen, 1000)
+	c.Assert(dataSets[1].data, ck.HasLen, 400)
+	c.Assert(hot.counts, ck.DeepEquals, map[string]int{"hot": 200, "warm": 200})
+
+	// once a key is hot it keeps being counted
+	dataSets = newDataSets(2)
+	dataSets[1].data = dataSets[1].data[:10]
+	hot.spill(dataSets)
+	c.Assert(hot.counts, ck.DeepEquals, map[string]int{"hot": 205, "warm": 205})
+
+	report := hot.report()
+	c.Assert(report, ck.DeepEquals, map[string]int{
+		base64.StdEncoding.EncodeToString([]byte("hot")):  205,
+		base64.StdEncoding.EncodeToString([]byte("warm")): 205,
+	})
+	resumed := newHotKeyCounter(StringKeyHandler{}, 2, false)
+	c.Assert(resumed.load(report), ck.IsNil)
+	c.Assert(resumed.counts, ck.DeepEquals, hot.counts)
+
+	// salted keys are spread over the salted data sets
+	hot = newHotKeyCounter(StringKeyHandler{}, 2, true)
+	c.Assert(hot.dataSetCount(), ck.Equals, 4)
+	dataSets = newDataSets(4)
+	hot.spill(dataSets)
+	c.Assert(dataSets[0].data, ck.HasLen, 1000)
+	c.Assert(dataSets[1].data, ck.HasLen, 0)
+	c.Assert(dataSets[2].data, ck.HasLen, 200)
+	c.Assert(dataSets[3].data, ck.HasLen, 200)
+	c.Assert(newHotKeyCounter(StringKeyHandler{}, 2, false).report(), ck.IsNil)
+}
+
+func (mrt *MapreduceTests) TestParseMapResult(c *ck.C) {
+	result, err := parseMapResult(`{"Names":{"a":1},"HotKeys":{"aG90":5}}`)
+	c.Assert(err, ck.IsNil)
+	c.Assert(result, ck.DeepEquals, mapResult{Names: map[string]int{"a": 1}, HotKeys: map[string]int{"aG90": 5}})
+
+	// the results of tasks which finished before hot keys were reported
+	result, err = parseMapResult(`{"a":1,"b":0}`)
+	c.Assert(err, ck.IsNil)
+	c.Assert(result, ck.DeepEquals, mapResult{Names: map[string]int{"a": 1, "b": 0}})
+
+	_, err = parseMapResult(`"output-1"`)
+	c.Assert(err, ck.NotNil)
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerSaltHotKeys(c *ck.C) {
+	u := &testSaltedWordCount{newTestCancelPipeline()}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.SaltHotKeys = true
+
+	info, tasks, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	counts := map[TaskType]int{}
+	for _, task := range tasks {
+		counts[task.Type]++
+		if task.Type == TaskTypeMap {
+			result, err := parseMapResult(task.Result)
+			c.Assert(err, ck.IsNil)
+			c.Check(result.HotKeys[base64.StdEncoding.EncodeToString([]byte("the"))] > 0, ck.Equals, true)
+		}
+	}
+	c.Assert(counts, ck.DeepEquals, map[TaskType]int{TaskTypeMap: 5, TaskTypeCombine: 3, TaskTypeReduce: 3})
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	// salting needs a Combiner
+	plain := &testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}
+	job = mrt.localJob(plain, plain.testMemoryOutput)
+	job.SaltHotKeys = true
+	_, _, err = LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.NotNil)
+
+	// and values which are never combined
+	job = mrt.localJob(u, u.testMemoryOutput)
+	job.SaltHotKeys = true
+	job.SeparateReduceItems = true
+	_, _, err = LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.ErrorMatches, ".*SeparateReduceItems")
+}
+
+func (mrt *MapreduceTests) TestSaltHotKeys(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := &testSaltedWordCount{newTestCancelPipeline()}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.SaltHotKeys = true
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	// runStage runs each of the posted tasks, and then the monitor which starts the next stage
+	runStage := func() {
+		posted := u.posted
+		u.posted = nil
+
+		monitorUrl := ""
+		for _, taskUrl := range posted {
+			if strings.Contains(taskUrl, "-monitor") {
+				monitorUrl = taskUrl
+			} else {
+				serve(taskUrl)
+			}
+		}
+
+		c.Assert(monitorUrl, ck.Not(ck.Equals), "")
+		serve(monitorUrl)
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	for _, stage := range []JobStage{StageCombining, StageReducing, StageDone} {
+		runStage()
+
+		info, err := store.GetJob(jobId)
+		c.Assert(err, ck.IsNil)
+		c.Assert(info.Stage, ck.Equals, stage)
+	}
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	combines := 0
+	for _, task := range tasks {
+		if task.Type == TaskTypeCombine {
+			combines++
+			c.Check(task.Status, ck.Equals, TaskStatusDone)
+		}
+	}
+	c.Assert(combines, ck.Equals, 3)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+
+	// salting needs a Combiner
+	plain := newTestCancelPipeline()
+	job = mrt.localJob(plain, plain.testMemoryOutput)
+	job.SaltHotKeys = true
+	_, err = RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.NotNil)
+
+	// and values which are never combined
+	job = mrt.localJob(u, u.testMemoryOutput)
+	job.SaltHotKeys = true
+	job.SeparateReduceItems = true
+	_, err = RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.ErrorMatches, ".*SeparateReduceItems")
+}
@@ -20,6 +20,8 @@ import (
 	"golang.org/x/net/context"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // InputReader is responsible for providing unique names for each of the input
@@ -34,11 +36,57 @@ type InputReader interface {
 	ReaderFromName(c context.Context, name string) (SingleInputReader, error)
 }
 
+// SplittableInputReader is an InputReader which can split a single input into smaller pieces, so
+// one huge input doesn't become one huge map task. Jobs with a SplitSize split each of the names
+// from ReaderNames before the map tasks are created, and each piece gets its own map task.
+type SplittableInputReader interface {
+	InputReader
+
+	// SplitReaderName returns the names of pieces of the named input which are about splitSize
+	// bytes each; ReaderFromName must accept them. Together the pieces must cover the input
+	// exactly once. Inputs which are smaller than splitSize come back as a single piece.
+	SplitReaderName(c context.Context, name string, splitSize int64) ([]string, error)
+}
+
+// splitReaderNames splits each of names into pieces of about splitSize bytes if inputs is a
+// SplittableInputReader; otherwise (or if splitSize is zero) names is returned as is
+func splitReaderNames(c context.Context, inputs InputReader, names []string, splitSize int64) ([]string, error) {
+	splitter, ok := inputs.(SplittableInputReader)
+	if !ok || splitSize <= 0 {
+		return names, nil
+	}
+
+	split := make([]string, 0, len(names))
+	for _, name := range names {
+		if pieces, err := splitter.SplitReaderName(c, name, splitSize); err != nil {
+			return nil, fmt.Errorf("splitting %s: %s", name, err)
+		} else {
+			split = append(split, pieces...)
+		}
+	}
+
+	return split, nil
+}
+
 type SingleInputReader interface {
 	Next() (interface{}, error)
 	Close() error
 }
 
+// CheckpointableInputReader is a SingleInputReader which can say how far it has gotten, and pick
+// up from there later. Map tasks for jobs with a CheckpointInterval save the position of these
+// readers periodically so they can resume from it if they are retried.
+type CheckpointableInputReader interface {
+	SingleInputReader
+
+	// Position returns where the next call to Next() will read from; it's only passed back to Seek
+	// so it can be in any format
+	Position() (string, error)
+
+	// Seek moves the reader to a position returned by Position, on a new reader for the same input
+	Seek(position string) error
+}
+
 type SingleLineReader struct {
 	bufReader *bufio.Reader
 	r         io.ReadCloser
@@ -52,10 +100,22 @@ func NewSingleLineInputReader(r io.ReadCloser) SingleInputReader {
 }
 
 type singleFileLineInputReader struct {
-	SingleInputReader
-	path string
+	path   string
+	file   *os.File
+	lines  *bufio.Reader
+	offset int64 // how many bytes of the file have been read, which is where the next line starts
+	start  int64 // where the piece of the file being read starts
+	end    int64 // -1 to read the whole file
+	size   int64
 }
 
+// fileRangeSeparator separates the path from the byte range in the names of pieces of files.
+// Paths can't contain it, so a path is never mistaken for a piece.
+const fileRangeSeparator = "\x00"
+
+// FileLineInputReader reads lines from files. It's a SplittableInputReader; pieces of files are
+// named by the path, a NUL byte, and start-end, where start and end are byte offsets which fall on
+// line boundaries.
 type FileLineInputReader struct {
 	Paths []string
 }
@@ -64,26 +124,185 @@ func (m FileLineInputReader) ReaderNames() ([]string, error) {
 	return m.Paths, nil
 }
 
-func (m FileLineInputReader) ReaderFromName(c context.Context, path string) (SingleInputReader, error) {
-	return newSingleFileLineInputReader(path)
+func (m FileLineInputReader) ReaderFromName(c context.Context, name string) (SingleInputReader, error) {
+	path, start, end, isRange := parseFileRange(name)
+	if !isRange {
+		return newSingleFileLineInputReader(path)
+	}
+
+	ir, err := newSingleFileLineInputReader(path)
+	if err != nil {
+		return nil, err
+	} else if err := ir.Seek(strconv.FormatInt(start, 10)); err != nil {
+		ir.Close()
+		return nil, err
+	}
+
+	ir.start, ir.end = start, end
+	return ir, nil
+}
+
+// SplitReaderName splits a file into pieces of about splitSize bytes; each piece ends just after
+// a newline so no line is split between pieces
+func (m FileLineInputReader) SplitReaderName(c context.Context, name string, splitSize int64) ([]string, error) {
+	path, start, end, isRange := parseFileRange(name)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !isRange {
+		if info, err := f.Stat(); err != nil {
+			return nil, err
+		} else {
+			start, end = 0, info.Size()
+		}
+	}
+
+	if end-start <= splitSize {
+		return []string{name}, nil
+	}
+
+	pieces := []string{}
+	for start < end {
+		pieceEnd := start + splitSize
+		if pieceEnd >= end {
+			pieceEnd = end
+		} else if pieceEnd, err = nextLineStart(f, pieceEnd, end); err != nil {
+			return nil, err
+		}
+
+		pieces = append(pieces, fileRangeName(path, start, pieceEnd))
+		start = pieceEnd
+	}
+
+	return pieces, nil
+}
+
+// nextLineStart returns the offset of the first line which starts at or after offset, or limit if
+// there isn't one before it
+func nextLineStart(f *os.File, offset int64, limit int64) (int64, error) {
+	// a line starts at offset if the byte before it is a newline
+	if _, err := f.Seek(offset-1, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	for pos := offset - 1; pos < limit; pos++ {
+		if b, err := r.ReadByte(); err == io.EOF {
+			return limit, nil
+		} else if err != nil {
+			return 0, err
+		} else if b == '\n' {
+			return pos + 1, nil
+		}
+	}
+
+	return limit, nil
+}
+
+// fileRangeName names the piece of the file at path from start up to end
+func fileRangeName(path string, start, end int64) string {
+	return fmt.Sprintf("%s%s%d-%d", path, fileRangeSeparator, start, end)
+}
+
+// parseFileRange splits a name returned by fileRangeName into its path and byte range; isRange
+// is false for plain paths
+func parseFileRange(name string) (path string, start, end int64, isRange bool) {
+	sep := strings.Index(name, fileRangeSeparator)
+	if sep < 0 {
+		return name, 0, 0, false
+	}
+
+	path = name[:sep]
+	if n, err := fmt.Sscanf(name[sep+1:], "%d-%d", &start, &end); err != nil || n != 2 || start < 0 || end < start ||
+		name != fileRangeName(path, start, end) {
+		// not something fileRangeName returned; opening it will fail
+		return name, 0, 0, false
+	}
+
+	return path, start, end, true
 }
 
-func newSingleFileLineInputReader(path string) (singleFileLineInputReader, error) {
+func newSingleFileLineInputReader(path string) (*singleFileLineInputReader, error) {
 	reader, err := os.Open(path)
 	if err != nil {
-		return singleFileLineInputReader{}, err
+		return nil, err
 	}
 
-	return singleFileLineInputReader{
-		SingleInputReader: NewSingleLineInputReader(reader),
-		path:              path,
+	info, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return &singleFileLineInputReader{
+		path:  path,
+		file:  reader,
+		lines: bufio.NewReader(reader),
+		end:   -1,
+		size:  info.Size(),
 	}, nil
 }
 
-func (ir singleFileLineInputReader) String() string {
+func (ir *singleFileLineInputReader) String() string {
 	return fmt.Sprintf("SingleFileLineInputReader(%s)", ir.path)
 }
 
+func (ir *singleFileLineInputReader) Next() (interface{}, error) {
+	if ir.end >= 0 && ir.offset >= ir.end {
+		// the rest of the file belongs to other pieces
+		return nil, nil
+	}
+
+	// this reads lines the same way SingleLineReader does, but counts the bytes as they're read so
+	// the offset is exact whatever the lines end with
+	s, err := ir.lines.ReadString('\n')
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	ir.offset += int64(len(s))
+	return s[0 : len(s)-1], nil
+}
+
+func (ir *singleFileLineInputReader) Close() error {
+	ir.lines = nil
+	return ir.file.Close()
+}
+
+// Progress is how many bytes of the reader's piece of the file have been read
+func (ir *singleFileLineInputReader) Progress() (consumed, total int64) {
+	if ir.end >= 0 {
+		return ir.offset - ir.start, ir.end - ir.start
+	}
+
+	return ir.offset, ir.size
+}
+
+// Position is the byte offset of the next line in the file
+func (ir *singleFileLineInputReader) Position() (string, error) {
+	return strconv.FormatInt(ir.offset, 10), nil
+}
+
+func (ir *singleFileLineInputReader) Seek(position string) error {
+	offset, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid position %s: %s", position, err)
+	} else if _, err := ir.file.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	// the old buffer is full of data from before the seek
+	ir.lines = bufio.NewReader(ir.file)
+	ir.offset = offset
+	return nil
+}
+
 func (ir SingleLineReader) Close() (err error) {
 	err = ir.r.Close()
 	ir.r = nil
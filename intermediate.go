@@ -21,6 +21,7 @@ import (
 	"golang.org/x/net/context"
 	"io"
 	"os"
+	"sync"
 )
 
 type KeyValueHandler interface {
@@ -59,6 +60,10 @@ func (sf *arrayIterator) Close() error {
 	return nil
 }
 
+func (sf *arrayIterator) Progress() (consumed, total int64) {
+	return int64(sf.nextIndex), int64(len(sf.data))
+}
+
 func (sf *arrayIterator) Next() (MappedData, bool, error) {
 	if sf.nextIndex >= len(sf.data) {
 		return MappedData{}, false, nil
@@ -73,23 +78,33 @@ func (sf *arrayIterator) Next() (MappedData, bool, error) {
 type memoryIntermediateStorage struct {
 	items    map[string][]MappedData
 	nextFile int
+	mtx      sync.Mutex
 }
 
 func (m *memoryIntermediateStorage) add(name string, data MappedData) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	m.items[name] = append(m.items[name], data)
 }
 
 func (m *memoryIntermediateStorage) CreateIntermediate(c context.Context, handler KeyValueHandler) (SingleIntermediateStorageWriter, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	if m.items == nil {
 		m.items = make(map[string][]MappedData)
 	}
 
 	name := fmt.Sprintf("%d", m.nextFile)
 	m.nextFile++
+	m.items[name] = nil
 	return &memoryIntermediateStorageWriter{name, m}, nil
 }
 
 func (m *memoryIntermediateStorage) Iterator(c context.Context, name string, handler KeyValueHandler) (IntermediateStorageIterator, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	if _, exists := m.items[name]; !exists {
 		return nil, os.ErrNotExist
 	}
@@ -97,6 +112,9 @@ func (m *memoryIntermediateStorage) Iterator(c context.Context, name string, han
 }
 
 func (m *memoryIntermediateStorage) RemoveIntermediate(c context.Context, name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	// eh. whatever.
 	delete(m.items, name)
 	return nil
@@ -186,3 +204,43 @@ func mergeIntermediate(w SingleIntermediateStorageWriter, handler KeyValueHandle
 
 	return nil
 }
+
+// combineIntermediate is like mergeIntermediate, but passes all of the values for each key through
+// the combiner and writes a single item for each key
+func combineIntermediate(w SingleIntermediateStorageWriter, handler KeyValueHandler, combiner Combiner, merger *mappedDataMerger) error {
+	var key interface{}
+	values := make([]interface{}, 0)
+
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		} else if len(values) == 1 {
+			return w.WriteMappedData(MappedData{Key: key, Value: values[0]})
+		} else if value, err := combiner.Combine(key, values); err != nil {
+			return err
+		} else {
+			return w.WriteMappedData(MappedData{Key: key, Value: value})
+		}
+	}
+
+	for !merger.empty() {
+		item, err := merger.next()
+		if err != nil {
+			return err
+		}
+
+		if len(values) > 0 && handler.Equal(key, item.Key) {
+			values = append(values, item.Value)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		key = item.Key
+		values = append(values[0:0], item.Value)
+	}
+
+	return flush()
+}
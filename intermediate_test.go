@@ -15,6 +15,10 @@
 package mapreduce
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
 	"github.com/pendo-io/appwrap"
 	ck "gopkg.in/check.v1"
 )
@@ -59,3 +63,65 @@ func (mrt *MapreduceTests) TestIntermediateMerge(c *ck.C) {
 	c.Assert(next, ck.Equals, int64(5000))
 
 }
+
+type testBufferCloser struct {
+	*bytes.Buffer
+}
+
+func (b testBufferCloser) Close() error { return nil }
+
+func (mrt *MapreduceTests) TestBlockIntermediateFormat(c *ck.C) {
+	ctx := appwrap.StubContext()
+	handler := struct {
+		StringKeyHandler
+		StringValueHandler
+	}{}
+
+	buf := &bytes.Buffer{}
+	w := NewBlockIntermediateWriter(testBufferCloser{buf}, handler)
+	for i := 0; i < 20000; i++ {
+		// values which aren't valid utf-8 survive
+		c.Assert(w.WriteMappedData(MappedData{Key: fmt.Sprintf("key %05d", i), Value: fmt.Sprintf("\xff\xfe %d", i)}), ck.IsNil)
+	}
+	c.Assert(w.Close(ctx), ck.IsNil)
+	data := buf.Bytes()
+
+	read := func(data []byte) (int, error) {
+		iter := NewBlockIntermediateIterator(ioutil.NopCloser(bytes.NewReader(data)), handler)
+		defer iter.Close()
+
+		count := 0
+		for {
+			item, valid, err := iter.Next()
+			if err != nil || !valid {
+				return count, err
+			}
+
+			c.Assert(item.Key, ck.Equals, fmt.Sprintf("key %05d", count))
+			c.Assert(item.Value, ck.Equals, fmt.Sprintf("\xff\xfe %d", count))
+			count++
+		}
+	}
+
+	count, err := read(data)
+	c.Assert(err, ck.IsNil)
+	c.Assert(count, ck.Equals, 20000)
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0x40
+	_, err = read(corrupt)
+	c.Assert(err, ck.ErrorMatches, ".*checksum.*")
+
+	_, err = read(data[0 : len(data)-blockHeaderSize])
+	c.Assert(err, ck.ErrorMatches, ".*truncated.*")
+
+	_, err = read([]byte(`{"key":"a","value":"b"}` + "\n"))
+	c.Assert(err, ck.ErrorMatches, "not a block intermediate file")
+
+	// empty files are fine too
+	buf.Reset()
+	c.Assert(NewBlockIntermediateWriter(testBufferCloser{buf}, handler).Close(ctx), ck.IsNil)
+	count, err = read(buf.Bytes())
+	c.Assert(err, ck.IsNil)
+	c.Assert(count, ck.Equals, 0)
+}
@@ -0,0 +1,245 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// JobOrder is the order QueryJobs returns jobs in. The values are the datastore sort orders.
+type JobOrder string
+
+const (
+	OrderByUpdated    = JobOrder("-UpdatedAt") // most recently updated first; the default
+	OrderByUpdatedAsc = JobOrder("UpdatedAt")
+	OrderByStarted    = JobOrder("-StartTime") // most recently started first
+	OrderByStartedAsc = JobOrder("StartTime")
+)
+
+// JobQuery selects a page of jobs for QueryJobs. Empty fields don't restrict the jobs returned.
+// UrlPrefix selects the jobs whose UrlPrefix is exactly the one given; it isn't matched as a
+// prefix of anything. After and Before select jobs by the time they're ordered by (UpdatedAt or
+// StartTime); After is inclusive and Before is not.
+//
+// The datastore needs a composite index on JobEntity for each combination of UrlPrefix and Stage
+// filters used along with the order. The index.yaml in this package has all of them, and they
+// need to be added to the app's own index.yaml.
+type JobQuery struct {
+	UrlPrefix string // matched exactly
+	Stage     JobStage
+	After     time.Time
+	Before    time.Time
+	Order     JobOrder // OrderByUpdated if empty
+	Limit     int      // how many jobs to return at most; zero returns all of them
+	Cursor    string   // returned by the same JobStore's QueryJobs call for the previous page
+}
+
+func (q JobQuery) order() JobOrder {
+	if q.Order == "" {
+		return OrderByUpdated
+	}
+
+	return q.Order
+}
+
+func (q JobQuery) validate() error {
+	switch q.order() {
+	case OrderByUpdated, OrderByUpdatedAsc, OrderByStarted, OrderByStartedAsc:
+	default:
+		return fmt.Errorf("unknown job order %s", q.Order)
+	}
+
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid job limit %d", q.Limit)
+	}
+
+	return nil
+}
+
+// invalidJobCursorError is returned by QueryJobs for a cursor the JobStore can't have returned
+type invalidJobCursorError string
+
+func (e invalidJobCursorError) Error() string {
+	return fmt.Sprintf("invalid job cursor %s", string(e))
+}
+
+// field returns the name of the property jobs are ordered by
+func (o JobOrder) field() string {
+	if o[0] == '-' {
+		return string(o[1:])
+	}
+
+	return string(o)
+}
+
+func (o JobOrder) descending() bool {
+	return o[0] == '-'
+}
+
+// jobTime returns the time the job is ordered by
+func (o JobOrder) jobTime(job JobInfo) time.Time {
+	if o.field() == "StartTime" {
+		return job.StartTime
+	}
+
+	return job.UpdatedAt
+}
+
+// jobQueryFromForm builds the JobQuery for the prefix, stage, after, before, order, cursor and
+// limit parameters which the console and api job lists share
+func jobQueryFromForm(r *http.Request, defaultLimit, maxLimit int) (JobQuery, error) {
+	query := JobQuery{
+		UrlPrefix: r.FormValue("prefix"),
+		Stage:     JobStage(r.FormValue("stage")),
+		Order:     JobOrder(r.FormValue("order")),
+		Cursor:    r.FormValue("cursor"),
+		Limit:     defaultLimit,
+	}
+
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err != nil || l <= 0 {
+			return JobQuery{}, fmt.Errorf("invalid limit %s", limitStr)
+		} else if l < maxLimit {
+			query.Limit = l
+		} else {
+			query.Limit = maxLimit
+		}
+	}
+
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"after", &query.After}, {"before", &query.Before}} {
+		if value := r.FormValue(param.name); value == "" {
+			continue
+		} else if t, err := parseFormTime(value); err != nil {
+			return JobQuery{}, fmt.Errorf("invalid %s time %s", param.name, value)
+		} else {
+			*param.t = t
+		}
+	}
+
+	return query, query.validate()
+}
+
+// parseFormTime accepts RFC 3339 times, as well as the dates and times html forms submit (which
+// are taken as UTC)
+func parseFormTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized time %s", value)
+}
+
+// The JobStores which keep their jobs in memory use cursors which hold the ordering time of the
+// last job on the page, along with how many jobs with that same time have been returned so far.
+// The next page starts at that time and skips those jobs, which works since jobs with the same
+// time are always sorted by id. The datastore uses its own cursors instead.
+func encodeJobCursor(at time.Time, skip int) string {
+	return fmt.Sprintf("%d:%d", at.UnixNano(), skip)
+}
+
+func decodeJobCursor(cursor string) (at time.Time, skip int, err error) {
+	if cursor == "" {
+		return time.Time{}, 0, nil
+	}
+
+	var nanos int64
+	if n, err := fmt.Sscanf(cursor, "%d:%d", &nanos, &skip); err != nil || n != 2 || skip < 0 {
+		return time.Time{}, 0, invalidJobCursorError(cursor)
+	}
+
+	return time.Unix(0, nanos), skip, nil
+}
+
+// jobQueryPage trims jobs, which were read starting at the query's cursor and ordered by it, to
+// a single page. The cursor for the next page is returned, or "" if this is the last one. Up to
+// one more job than the limit should be passed in so the last page can be recognized.
+func jobQueryPage(q JobQuery, jobs []JobInfo) ([]JobInfo, string) {
+	if q.Limit == 0 || len(jobs) <= q.Limit {
+		return jobs, ""
+	}
+
+	jobs = jobs[:q.Limit]
+	order := q.order()
+	last := order.jobTime(jobs[len(jobs)-1])
+
+	skip := 0
+	if cursorTime, cursorSkip, _ := decodeJobCursor(q.Cursor); q.Cursor != "" && cursorTime.Equal(last) {
+		// the whole page has the same time as the previous cursor
+		skip = cursorSkip
+	}
+
+	for _, job := range jobs {
+		if order.jobTime(job).Equal(last) {
+			skip++
+		}
+	}
+
+	return jobs, encodeJobCursor(last, skip)
+}
+
+// matchesJobQuery reports whether the job passes the query's filters, including starting at or
+// after the (decodeJobCursor) cursor; it's for stores which can't filter jobs themselves
+func matchesJobQuery(q JobQuery, job JobInfo) bool {
+	if q.UrlPrefix != "" && job.UrlPrefix != q.UrlPrefix {
+		return false
+	} else if q.Stage != "" && job.Stage != q.Stage {
+		return false
+	}
+
+	order := q.order()
+	at := order.jobTime(job)
+	if !q.After.IsZero() && at.Before(q.After) {
+		return false
+	} else if !q.Before.IsZero() && !at.Before(q.Before) {
+		return false
+	}
+
+	if cursorTime, _, _ := decodeJobCursor(q.Cursor); q.Cursor != "" {
+		if order.descending() && at.After(cursorTime) {
+			return false
+		} else if !order.descending() && at.Before(cursorTime) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jobsByQueryOrder sorts jobs the way the datastore does for an order, breaking ties by id
+type jobsByQueryOrder struct {
+	jobs  []JobInfo
+	order JobOrder
+}
+
+func (a jobsByQueryOrder) Len() int      { return len(a.jobs) }
+func (a jobsByQueryOrder) Swap(i, j int) { a.jobs[i], a.jobs[j] = a.jobs[j], a.jobs[i] }
+func (a jobsByQueryOrder) Less(i, j int) bool {
+	ti, tj := a.order.jobTime(a.jobs[i]), a.order.jobTime(a.jobs[j])
+	if ti.Equal(tj) {
+		return a.jobs[i].Id < a.jobs[j].Id
+	} else if a.order.descending() {
+		return ti.After(tj)
+	}
+
+	return ti.Before(tj)
+}
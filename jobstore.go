@@ -0,0 +1,821 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// JobStore persists the JobInfo and JobTask entities which track the progress of each job. Jobs
+// run on appengine use the datastore (NewDatastoreJobStore); NewMemoryJobStore and NewFileJobStore
+// allow the framework to run elsewhere. Jobs or tasks which don't exist are reported
+// as datastore.ErrNoSuchEntity by every implementation.
+type JobStore interface {
+	// CreateJob saves a new job and returns its id
+	CreateJob(job JobInfo) (int64, error)
+
+	// GetJob loads a job; the Id of the returned job is set
+	GetJob(jobId int64) (JobInfo, error)
+
+	// UpdateJob transactionally loads a job, passes it to f, and saves the modified job if
+	// f returns nil. Errors from f are returned as is. f must not use the JobStore.
+	UpdateJob(jobId int64, f func(job *JobInfo) error) (JobInfo, error)
+
+	// ListJobs returns all of the jobs, most recently updated first
+	ListJobs() ([]JobInfo, error)
+
+	// QueryJobs returns a page of the jobs which match the query, along with the cursor for the
+	// next page (which is empty after the last page). Cursors are only meaningful to the store
+	// which returned them.
+	QueryJobs(query JobQuery) ([]JobInfo, string, error)
+
+	// RemoveJob deletes a job along with all of its tasks
+	RemoveJob(jobId int64) error
+
+	// RemoveTasks deletes tasks without touching their job; tasks which don't exist are ignored
+	RemoveTasks(taskIds []int64) error
+
+	// AllocateTaskIds reserves count consecutive task ids and returns the first one
+	AllocateTaskIds(count int) (int64, error)
+
+	// PutTasks saves tasks using the (previously allocated) ids
+	PutTasks(taskIds []int64, tasks []JobTask) error
+
+	// GetTask loads a single task; the Id of the returned task is set
+	GetTask(taskId int64) (JobTask, error)
+
+	// GetTasks loads a list of tasks in the same order as the ids
+	GetTasks(taskIds []int64) ([]JobTask, error)
+
+	// UpdateTask loads a task, passes it to f, and saves the modified task if f returns nil. f
+	// may be called more than once and must not use the JobStore.
+	UpdateTask(taskId int64, f func(task *JobTask) error) (JobTask, error)
+
+	// JobTasks returns every task which was created for a job, including the tasks from stages
+	// which have already completed
+	JobTasks(jobId int64) ([]JobTask, error)
+
+	// CreateChain saves a new chain and returns its id
+	CreateChain(chain JobChain) (int64, error)
+
+	// GetChain loads a chain; the Id of the returned chain is set
+	GetChain(chainId int64) (JobChain, error)
+
+	// UpdateChain transactionally updates a chain the same way UpdateJob updates jobs
+	UpdateChain(chainId int64, f func(chain *JobChain) error) (JobChain, error)
+}
+
+// datastoreJobStore keeps jobs and tasks in the appengine datastore. The context is only needed to
+// allocate task ids.
+type datastoreJobStore struct {
+	c  context.Context
+	ds appwrap.Datastore
+}
+
+// NewDatastoreJobStore returns a JobStore which keeps jobs in the appengine datastore as JobEntity
+// and TaskEntity entities.
+func NewDatastoreJobStore(c context.Context, ds appwrap.Datastore) JobStore {
+	return datastoreJobStore{c: c, ds: ds}
+}
+
+func (s datastoreJobStore) jobKey(jobId int64) *datastore.Key {
+	return s.ds.NewKey(JobEntity, "", jobId, nil)
+}
+
+func (s datastoreJobStore) taskKeys(taskIds []int64) []*datastore.Key {
+	keys := make([]*datastore.Key, len(taskIds))
+	for i, id := range taskIds {
+		keys[i] = s.ds.NewKey(TaskEntity, "", id, nil)
+	}
+
+	return keys
+}
+
+// toEntity fills in the keys the datastore uses to find the tasks for a job
+func (s datastoreJobStore) toEntity(task *JobTask) {
+	task.Job = s.jobKey(task.JobId)
+	if task.Status == TaskStatusDone || task.Status == TaskStatusFailed {
+		task.Done = task.Job
+	} else {
+		task.Done = nil
+	}
+}
+
+func (s datastoreJobStore) fromEntity(taskId int64, task *JobTask) {
+	task.Id = taskId
+	if task.Job != nil {
+		task.JobId = task.Job.IntID()
+	}
+}
+
+func (s datastoreJobStore) CreateJob(job JobInfo) (int64, error) {
+	key, err := s.ds.Put(s.ds.NewKey(JobEntity, "", 0, nil), &job)
+	if err != nil {
+		return 0, err
+	}
+
+	return key.IntID(), nil
+}
+
+func (s datastoreJobStore) GetJob(jobId int64) (JobInfo, error) {
+	var job JobInfo
+	var getErr error
+
+	err := backoff.Retry(func() error {
+		if getErr = s.ds.Get(s.jobKey(jobId), &job); getErr == datastore.ErrNoSuchEntity {
+			// there's no point in retrying this
+			return nil
+		}
+
+		return getErr
+	}, mrBackOff())
+
+	if err == nil {
+		err = getErr
+	}
+
+	job.Id = jobId
+
+	return job, err
+}
+
+func (s datastoreJobStore) UpdateJob(jobId int64, f func(job *JobInfo) error) (JobInfo, error) {
+	var job JobInfo
+	var updateErr error
+
+	jobKey := s.jobKey(jobId)
+	if err := runInTransaction(s.ds, func(ds appwrap.Datastore) error {
+		job = JobInfo{}
+		if err := ds.Get(jobKey, &job); err != nil {
+			return err
+		}
+
+		// returning nil here commits a transaction which hasn't written anything
+		if updateErr = f(&job); updateErr != nil {
+			return nil
+		}
+
+		_, err := ds.Put(jobKey, &job)
+		return err
+	}); err != nil {
+		return JobInfo{}, err
+	}
+
+	job.Id = jobId
+
+	return job, updateErr
+}
+
+func (s datastoreJobStore) CreateChain(chain JobChain) (int64, error) {
+	key, err := s.ds.Put(s.ds.NewKey(ChainEntity, "", 0, nil), &chain)
+	if err != nil {
+		return 0, err
+	}
+
+	return key.IntID(), nil
+}
+
+func (s datastoreJobStore) GetChain(chainId int64) (JobChain, error) {
+	var chain JobChain
+	var getErr error
+
+	err := backoff.Retry(func() error {
+		if getErr = s.ds.Get(s.ds.NewKey(ChainEntity, "", chainId, nil), &chain); getErr == datastore.ErrNoSuchEntity {
+			return nil
+		}
+
+		return getErr
+	}, mrBackOff())
+
+	if err == nil {
+		err = getErr
+	}
+
+	chain.Id = chainId
+
+	return chain, err
+}
+
+func (s datastoreJobStore) UpdateChain(chainId int64, f func(chain *JobChain) error) (JobChain, error) {
+	var chain JobChain
+	var updateErr error
+
+	chainKey := s.ds.NewKey(ChainEntity, "", chainId, nil)
+	if err := runInTransaction(s.ds, func(ds appwrap.Datastore) error {
+		chain = JobChain{}
+		if err := ds.Get(chainKey, &chain); err != nil {
+			return err
+		}
+
+		if updateErr = f(&chain); updateErr != nil {
+			return nil
+		}
+
+		_, err := ds.Put(chainKey, &chain)
+		return err
+	}); err != nil {
+		return JobChain{}, err
+	}
+
+	chain.Id = chainId
+
+	return chain, updateErr
+}
+
+func (s datastoreJobStore) ListJobs() ([]JobInfo, error) {
+	var jobs []JobInfo
+	keys, err := s.ds.NewQuery(JobEntity).Order("-UpdatedAt").GetAll(&jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		jobs[i].Id = keys[i].IntID()
+	}
+
+	return jobs, nil
+}
+
+func (s datastoreJobStore) QueryJobs(query JobQuery) ([]JobInfo, string, error) {
+	if err := query.validate(); err != nil {
+		return nil, "", err
+	}
+
+	order := query.order()
+	field := order.field()
+
+	q := s.ds.NewQuery(JobEntity)
+	if query.UrlPrefix != "" {
+		q = q.Filter("UrlPrefix =", query.UrlPrefix)
+	}
+	if query.Stage != "" {
+		q = q.Filter("Stage =", string(query.Stage))
+	}
+	if !query.After.IsZero() {
+		q = q.Filter(field+" >=", query.After)
+	}
+	if !query.Before.IsZero() {
+		q = q.Filter(field+" <", query.Before)
+	}
+
+	// the datastore's own cursors are used here rather than encodeJobCursor's
+	if query.Cursor != "" {
+		if cursor, err := datastore.DecodeCursor(query.Cursor); err != nil {
+			return nil, "", invalidJobCursorError(query.Cursor)
+		} else {
+			q = q.Start(cursor)
+		}
+	}
+
+	q = q.Order(string(order))
+	if query.Limit > 0 {
+		// the extra job tells us whether there's another page
+		q = q.Limit(query.Limit + 1)
+	}
+
+	jobs := make([]JobInfo, 0)
+	var next datastore.Cursor
+	iter := q.Run()
+	for {
+		var job JobInfo
+		key, err := iter.Next(&job)
+		if err == datastore.Done {
+			return jobs, "", nil
+		} else if err != nil {
+			return nil, "", err
+		} else if query.Limit > 0 && len(jobs) == query.Limit {
+			return jobs, next.String(), nil
+		}
+
+		job.Id = key.IntID()
+		jobs = append(jobs, job)
+
+		if query.Limit > 0 && len(jobs) == query.Limit {
+			if next, err = iter.Cursor(); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+func (s datastoreJobStore) RemoveJob(jobId int64) error {
+	jobKey := s.jobKey(jobId)
+	q := s.ds.NewQuery(TaskEntity).Filter("Job =", jobKey).KeysOnly()
+	keys, err := q.GetAll(nil)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteKeys(append(keys, jobKey))
+}
+
+func (s datastoreJobStore) RemoveTasks(taskIds []int64) error {
+	return s.deleteKeys(s.taskKeys(taskIds))
+}
+
+// deleteKeys deletes entities a batch at a time
+func (s datastoreJobStore) deleteKeys(keys []*datastore.Key) error {
+	i := 0
+	for i < len(keys) {
+		last := i + 250
+		if last > len(keys) {
+			last = len(keys)
+		}
+
+		if err := s.ds.DeleteMulti(keys[i:last]); err != nil {
+			return err
+		}
+
+		i = last
+	}
+
+	return nil
+}
+
+func (s datastoreJobStore) AllocateTaskIds(count int) (int64, error) {
+	firstId, _, err := datastore.AllocateIDs(s.c, TaskEntity, nil, count)
+	return firstId, err
+}
+
+func (s datastoreJobStore) PutTasks(taskIds []int64, tasks []JobTask) error {
+	taskKeys := s.taskKeys(taskIds)
+	for i := range tasks {
+		s.toEntity(&tasks[i])
+	}
+
+	putSize := 64
+
+	i := 0
+	for i < len(tasks) {
+		if err := backoff.Retry(func() error {
+			last := i + putSize
+			if last > len(tasks) {
+				last = len(tasks)
+			}
+
+			if _, err := s.ds.PutMulti(taskKeys[i:last], tasks[i:last]); err != nil {
+				if putSize > 5 {
+					putSize /= 2
+				}
+
+				return err
+			}
+
+			i = last
+
+			return nil
+		}, mrBackOff()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s datastoreJobStore) GetTask(taskId int64) (JobTask, error) {
+	var task JobTask
+	var getErr error
+
+	taskKey := s.ds.NewKey(TaskEntity, "", taskId, nil)
+	err := backoff.Retry(func() error {
+		if getErr = s.ds.Get(taskKey, &task); getErr == datastore.ErrNoSuchEntity {
+			// there's no point in retrying this
+			return nil
+		}
+
+		return getErr
+	}, mrBackOff())
+
+	if err == nil {
+		err = getErr
+	}
+
+	if err != nil {
+		return JobTask{}, err
+	}
+
+	s.fromEntity(taskId, &task)
+
+	return task, nil
+}
+
+func (s datastoreJobStore) GetTasks(taskIds []int64) ([]JobTask, error) {
+	taskKeys := s.taskKeys(taskIds)
+	tasks := make([]JobTask, len(taskKeys))
+
+	i := 0
+	for i < len(taskKeys) {
+		last := i + 100
+		if last > len(taskKeys) {
+			last = len(taskKeys)
+		}
+
+		if err := s.ds.GetMulti(taskKeys[i:last], tasks[i:last]); err != nil {
+			return nil, err
+		}
+
+		i = last
+	}
+
+	for i := range tasks {
+		s.fromEntity(taskIds[i], &tasks[i])
+	}
+
+	return tasks, nil
+}
+
+func (s datastoreJobStore) UpdateTask(taskId int64, f func(task *JobTask) error) (JobTask, error) {
+	var task JobTask
+	var updateErr error
+
+	taskKey := s.ds.NewKey(TaskEntity, "", taskId, nil)
+	err := backoff.Retry(func() error {
+		task = JobTask{}
+		if err := s.ds.Get(taskKey, &task); err != nil {
+			return err
+		}
+
+		s.fromEntity(taskId, &task)
+		if updateErr = f(&task); updateErr != nil {
+			return nil
+		}
+
+		s.toEntity(&task)
+		_, err := s.ds.Put(taskKey, &task)
+		return err
+	}, mrBackOff())
+
+	if err != nil {
+		return task, err
+	}
+
+	return task, updateErr
+}
+
+func (s datastoreJobStore) JobTasks(jobId int64) ([]JobTask, error) {
+	var tasks []JobTask
+	keys, err := s.ds.NewQuery(TaskEntity).Filter("Job =", s.jobKey(jobId)).GetAll(&tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		s.fromEntity(keys[i].IntID(), &tasks[i])
+	}
+
+	return tasks, nil
+}
+
+// memoryJobStore keeps everything in maps. Entities are copied (via json) on the way in
+// and out so callers never share them with the store, just like the datastore.
+type memoryJobStore struct {
+	mtx         sync.Mutex
+	Jobs        map[int64]JobInfo
+	Tasks       map[int64]JobTask
+	Chains      map[int64]JobChain
+	NextJobId   int64
+	NextTaskId  int64
+	NextChainId int64
+
+	// if this is set every change to the store is appended to it
+	file *jobStoreLog
+}
+
+// NewMemoryJobStore returns a JobStore which keeps jobs in memory. It is safe for concurrent
+// use, but obviously only works when every task runs inside of the same process.
+func NewMemoryJobStore() JobStore {
+	return newMemoryJobStore()
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		Jobs:        make(map[int64]JobInfo),
+		Tasks:       make(map[int64]JobTask),
+		Chains:      make(map[int64]JobChain),
+		NextJobId:   1,
+		NextTaskId:  1,
+		NextChainId: 1,
+	}
+}
+
+func copyEntity(dst, src interface{}) {
+	// these are our own types, so this can't fail
+	data, _ := json.Marshal(src)
+	json.Unmarshal(data, dst)
+}
+
+func (m *memoryJobStore) CreateJob(job JobInfo) (int64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	id := m.NextJobId
+	m.NextJobId++
+
+	var stored JobInfo
+	copyEntity(&stored, job)
+	stored.Id = id
+	m.Jobs[id] = stored
+
+	return id, m.save(jobStoreChange{Jobs: map[int64]*JobInfo{id: &stored}, NextJobId: m.NextJobId})
+}
+
+func (m *memoryJobStore) GetJob(jobId int64) (JobInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var job JobInfo
+	if stored, exists := m.Jobs[jobId]; !exists {
+		return JobInfo{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&job, stored)
+	}
+
+	return job, nil
+}
+
+func (m *memoryJobStore) UpdateJob(jobId int64, f func(job *JobInfo) error) (JobInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var job JobInfo
+	if stored, exists := m.Jobs[jobId]; !exists {
+		return JobInfo{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&job, stored)
+	}
+
+	if err := f(&job); err != nil {
+		return job, err
+	}
+
+	var stored JobInfo
+	copyEntity(&stored, job)
+	stored.Id = jobId
+	m.Jobs[jobId] = stored
+
+	return job, m.save(jobStoreChange{Jobs: map[int64]*JobInfo{jobId: &stored}})
+}
+
+func (m *memoryJobStore) ListJobs() ([]JobInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	jobs := make([]JobInfo, 0, len(m.Jobs))
+	for _, stored := range m.Jobs {
+		var job JobInfo
+		copyEntity(&job, stored)
+		jobs = append(jobs, job)
+	}
+
+	sort.Sort(jobsByUpdate(jobs))
+
+	return jobs, nil
+}
+
+func (m *memoryJobStore) QueryJobs(query JobQuery) ([]JobInfo, string, error) {
+	if err := query.validate(); err != nil {
+		return nil, "", err
+	}
+
+	_, skip, err := decodeJobCursor(query.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	jobs := make([]JobInfo, 0)
+	for _, stored := range m.Jobs {
+		if matchesJobQuery(query, stored) {
+			var job JobInfo
+			copyEntity(&job, stored)
+			jobs = append(jobs, job)
+		}
+	}
+
+	sort.Sort(jobsByQueryOrder{jobs, query.order()})
+
+	if skip > len(jobs) {
+		jobs = jobs[:0]
+	} else {
+		jobs = jobs[skip:]
+	}
+
+	if query.Limit > 0 && len(jobs) > query.Limit+1 {
+		jobs = jobs[:query.Limit+1]
+	}
+
+	jobs, cursor := jobQueryPage(query, jobs)
+	return jobs, cursor, nil
+}
+
+type jobsByUpdate []JobInfo
+
+func (a jobsByUpdate) Len() int           { return len(a) }
+func (a jobsByUpdate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a jobsByUpdate) Less(i, j int) bool { return a[i].UpdatedAt.After(a[j].UpdatedAt) }
+
+func (m *memoryJobStore) RemoveJob(jobId int64) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	change := jobStoreChange{Jobs: map[int64]*JobInfo{jobId: nil}, Tasks: make(map[int64]*JobTask)}
+	for id, task := range m.Tasks {
+		if task.JobId == jobId {
+			delete(m.Tasks, id)
+			change.Tasks[id] = nil
+		}
+	}
+
+	delete(m.Jobs, jobId)
+
+	return m.save(change)
+}
+
+func (m *memoryJobStore) RemoveTasks(taskIds []int64) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	change := jobStoreChange{Tasks: make(map[int64]*JobTask, len(taskIds))}
+	for _, id := range taskIds {
+		delete(m.Tasks, id)
+		change.Tasks[id] = nil
+	}
+
+	return m.save(change)
+}
+
+func (m *memoryJobStore) AllocateTaskIds(count int) (int64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	first := m.NextTaskId
+	m.NextTaskId += int64(count)
+
+	return first, m.save(jobStoreChange{NextTaskId: m.NextTaskId})
+}
+
+func (m *memoryJobStore) PutTasks(taskIds []int64, tasks []JobTask) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	change := jobStoreChange{Tasks: make(map[int64]*JobTask, len(tasks))}
+	for i := range tasks {
+		var stored JobTask
+		copyEntity(&stored, tasks[i])
+		stored.Id = taskIds[i]
+		m.Tasks[taskIds[i]] = stored
+		change.Tasks[taskIds[i]] = &stored
+	}
+
+	return m.save(change)
+}
+
+func (m *memoryJobStore) GetTask(taskId int64) (JobTask, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var task JobTask
+	if stored, exists := m.Tasks[taskId]; !exists {
+		return JobTask{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&task, stored)
+	}
+
+	return task, nil
+}
+
+func (m *memoryJobStore) GetTasks(taskIds []int64) ([]JobTask, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	tasks := make([]JobTask, len(taskIds))
+	for i, id := range taskIds {
+		if stored, exists := m.Tasks[id]; !exists {
+			return nil, datastore.ErrNoSuchEntity
+		} else {
+			copyEntity(&tasks[i], stored)
+		}
+	}
+
+	return tasks, nil
+}
+
+func (m *memoryJobStore) UpdateTask(taskId int64, f func(task *JobTask) error) (JobTask, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var task JobTask
+	if stored, exists := m.Tasks[taskId]; !exists {
+		return JobTask{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&task, stored)
+	}
+
+	if err := f(&task); err != nil {
+		return task, err
+	}
+
+	var stored JobTask
+	copyEntity(&stored, task)
+	stored.Id = taskId
+	m.Tasks[taskId] = stored
+
+	return task, m.save(jobStoreChange{Tasks: map[int64]*JobTask{taskId: &stored}})
+}
+
+func (m *memoryJobStore) JobTasks(jobId int64) ([]JobTask, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	tasks := make([]JobTask, 0)
+	for _, stored := range m.Tasks {
+		if stored.JobId == jobId {
+			var task JobTask
+			copyEntity(&task, stored)
+			tasks = append(tasks, task)
+		}
+	}
+
+	sort.Sort(tasksById(tasks))
+
+	return tasks, nil
+}
+
+type tasksById []JobTask
+
+func (a tasksById) Len() int           { return len(a) }
+func (a tasksById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a tasksById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+func (m *memoryJobStore) CreateChain(chain JobChain) (int64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	id := m.NextChainId
+	m.NextChainId++
+
+	var stored JobChain
+	copyEntity(&stored, chain)
+	stored.Id = id
+	m.Chains[id] = stored
+
+	return id, m.save(jobStoreChange{Chains: map[int64]*JobChain{id: &stored}, NextChainId: m.NextChainId})
+}
+
+func (m *memoryJobStore) GetChain(chainId int64) (JobChain, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var chain JobChain
+	if stored, exists := m.Chains[chainId]; !exists {
+		return JobChain{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&chain, stored)
+	}
+
+	return chain, nil
+}
+
+func (m *memoryJobStore) UpdateChain(chainId int64, f func(chain *JobChain) error) (JobChain, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var chain JobChain
+	if stored, exists := m.Chains[chainId]; !exists {
+		return JobChain{}, datastore.ErrNoSuchEntity
+	} else {
+		copyEntity(&chain, stored)
+	}
+
+	if err := f(&chain); err != nil {
+		return chain, err
+	}
+
+	var stored JobChain
+	copyEntity(&stored, chain)
+	stored.Id = chainId
+	m.Chains[chainId] = stored
+
+	return chain, m.save(jobStoreChange{Chains: map[int64]*JobChain{chainId: &stored}})
+}
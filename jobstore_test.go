@@ -0,0 +1,317 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) checkJobStore(c *ck.C, store JobStore) {
+	jobId, err := store.CreateJob(JobInfo{UrlPrefix: "prefix", Stage: StageFormation})
+	c.Assert(err, ck.IsNil)
+
+	job, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.Id, ck.Equals, jobId)
+	c.Assert(job.UrlPrefix, ck.Equals, "prefix")
+
+	_, err = store.GetJob(jobId + 1000)
+	c.Assert(err, ck.Equals, datastore.ErrNoSuchEntity)
+
+	firstId, err := store.AllocateTaskIds(3)
+	c.Assert(err, ck.IsNil)
+	taskIds := makeTaskIds(firstId, 3)
+	tasks := make([]JobTask, len(taskIds))
+	for i := range tasks {
+		tasks[i] = JobTask{Status: TaskStatusPending, Type: TaskTypeMap, Url: fmt.Sprintf("url%d", i)}
+	}
+
+	c.Assert(createTasks(store, jobId, taskIds, tasks, StageMapping, mrt.nullLog), ck.IsNil)
+
+	gathered, err := store.GetTasks(taskIds)
+	c.Assert(err, ck.IsNil)
+	c.Assert(gathered, ck.HasLen, 3)
+	for i := range gathered {
+		c.Assert(gathered[i].Id, ck.Equals, taskIds[i])
+		c.Assert(gathered[i].JobId, ck.Equals, jobId)
+		c.Assert(gathered[i].Url, ck.Equals, fmt.Sprintf("url%d", i))
+	}
+
+	// failed updates leave the task alone
+	_, err = store.UpdateTask(taskIds[0], func(task *JobTask) error {
+		task.Status = TaskStatusRunning
+		return fmt.Errorf("not today")
+	})
+	c.Assert(err, ck.NotNil)
+
+	task, err := updateTask(store, taskIds[0], TaskStatusDone, 1, "", "result")
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+	c.Assert(task.Retries, ck.Equals, 1)
+	c.Assert(task.Result, ck.Equals, `"result"`)
+
+	task, err = store.GetTask(taskIds[1])
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusPending)
+
+	jobTasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobTasks, ck.HasLen, 3)
+
+	jobs, err := store.ListJobs()
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobs, ck.HasLen, 1)
+	c.Assert(jobs[0].Stage, ck.Equals, StageMapping)
+	c.Assert(jobs[0].TaskCount, ck.Equals, 3)
+	c.Assert(jobs[0].FirstTaskId, ck.Equals, firstId)
+	c.Assert(jobs[0].MapTaskIds, ck.DeepEquals, taskIds)
+
+	c.Assert(store.RemoveTasks(taskIds[2:]), ck.IsNil)
+	_, err = store.GetTask(taskIds[2])
+	c.Assert(err, ck.Equals, datastore.ErrNoSuchEntity)
+	jobTasks, err = store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobTasks, ck.HasLen, 2)
+
+	c.Assert(store.RemoveJob(jobId), ck.IsNil)
+	_, err = store.GetJob(jobId)
+	c.Assert(err, ck.Equals, datastore.ErrNoSuchEntity)
+	_, err = store.GetTask(taskIds[0])
+	c.Assert(err, ck.Equals, datastore.ErrNoSuchEntity)
+}
+
+func (mrt *MapreduceTests) TestMemoryJobStore(c *ck.C) {
+	mrt.checkJobStore(c, NewMemoryJobStore())
+}
+
+func (mrt *MapreduceTests) TestFileJobStore(c *ck.C) {
+	dir, err := ioutil.TempDir("", "jobstore")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.json")
+	store, err := NewFileJobStore(path)
+	c.Assert(err, ck.IsNil)
+	mrt.checkJobStore(c, store)
+
+	jobId, err := store.CreateJob(JobInfo{UrlPrefix: "saved"})
+	c.Assert(err, ck.IsNil)
+
+	// only one store may have the file open
+	_, err = NewFileJobStore(path)
+	c.Assert(err, ck.ErrorMatches, ".*in use by another process")
+	c.Assert(store.(io.Closer).Close(), ck.IsNil)
+	_, err = store.CreateJob(JobInfo{})
+	c.Assert(err, ck.ErrorMatches, ".*closed")
+
+	// a change which was cut short by a crash is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, ck.IsNil)
+	_, err = f.WriteString(`{"Jobs":{"100":{"UrlPrefix":"lost"`)
+	c.Assert(err, ck.IsNil)
+	c.Assert(f.Close(), ck.IsNil)
+
+	// everything should be there when the file is opened again
+	store, err = NewFileJobStore(path)
+	c.Assert(err, ck.IsNil)
+	defer store.(io.Closer).Close()
+	job, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.UrlPrefix, ck.Equals, "saved")
+	_, err = store.GetJob(100)
+	c.Assert(err, ck.Equals, datastore.ErrNoSuchEntity)
+
+	nextId, err := store.CreateJob(JobInfo{})
+	c.Assert(err, ck.IsNil)
+	c.Assert(nextId, ck.Equals, jobId+1)
+}
+
+func (mrt *MapreduceTests) TestFileJobStoreCompacts(c *ck.C) {
+	dir, err := ioutil.TempDir("", "jobstore")
+	c.Assert(err, ck.IsNil)
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { minJobStoreCompactSize = size }(minJobStoreCompactSize)
+	minJobStoreCompactSize = 4096
+
+	path := filepath.Join(dir, "jobs.json")
+	store, err := NewFileJobStore(path)
+	c.Assert(err, ck.IsNil)
+
+	jobId, err := store.CreateJob(JobInfo{UrlPrefix: "compact"})
+	c.Assert(err, ck.IsNil)
+	for i := 0; i < 1000; i++ {
+		_, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+			job.TaskCount = i
+			return nil
+		})
+		c.Assert(err, ck.IsNil)
+	}
+
+	// the log doesn't keep every update
+	info, err := os.Stat(path)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Size() < 2*minJobStoreCompactSize, ck.Equals, true)
+
+	c.Assert(store.(io.Closer).Close(), ck.IsNil)
+	store, err = NewFileJobStore(path)
+	c.Assert(err, ck.IsNil)
+	defer store.(io.Closer).Close()
+
+	job, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.UrlPrefix, ck.Equals, "compact")
+	c.Assert(job.TaskCount, ck.Equals, 999)
+}
+
+func (mrt *MapreduceTests) TestQueryJobs(c *ck.C) {
+	store := NewMemoryJobStore()
+
+	// pairs of jobs are updated at the same time, and they were started in the opposite order
+	base := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	jobIds := make([]int64, 7)
+	for i := range jobIds {
+		job := JobInfo{
+			UrlPrefix: "/mr/even",
+			Stage:     StageDone,
+			UpdatedAt: base.Add(time.Duration(i/2) * time.Minute),
+			StartTime: base.Add(-time.Duration(i) * time.Minute),
+		}
+		if i%2 == 1 {
+			job.UrlPrefix = "/mr/odd"
+		}
+		if i%3 == 0 {
+			job.Stage = StageFailed
+		}
+
+		jobId, err := store.CreateJob(job)
+		c.Assert(err, ck.IsNil)
+		jobIds[i] = jobId
+	}
+
+	query := func(q JobQuery) []int64 {
+		jobs, cursor, err := store.QueryJobs(q)
+		c.Assert(err, ck.IsNil)
+		c.Assert(cursor, ck.Equals, "")
+		ids := make([]int64, len(jobs))
+		for i := range jobs {
+			ids[i] = jobs[i].Id
+		}
+		return ids
+	}
+
+	// ties are broken by id
+	all := query(JobQuery{})
+	c.Assert(all, ck.DeepEquals, []int64{jobIds[6], jobIds[4], jobIds[5], jobIds[2], jobIds[3], jobIds[0], jobIds[1]})
+
+	c.Assert(query(JobQuery{Order: OrderByStartedAsc}), ck.DeepEquals,
+		[]int64{jobIds[6], jobIds[5], jobIds[4], jobIds[3], jobIds[2], jobIds[1], jobIds[0]})
+	c.Assert(query(JobQuery{UrlPrefix: "/mr/odd"}), ck.DeepEquals, []int64{jobIds[5], jobIds[3], jobIds[1]})
+	c.Assert(query(JobQuery{UrlPrefix: "/mr/even", Stage: StageFailed}), ck.DeepEquals, []int64{jobIds[6], jobIds[0]})
+	c.Assert(query(JobQuery{After: base.Add(time.Minute), Before: base.Add(3 * time.Minute)}), ck.DeepEquals,
+		[]int64{jobIds[4], jobIds[5], jobIds[2], jobIds[3]})
+	c.Assert(query(JobQuery{Order: OrderByStarted, After: base.Add(-2 * time.Minute)}), ck.DeepEquals,
+		[]int64{jobIds[0], jobIds[1], jobIds[2]})
+
+	// pages split the ties in every possible way
+	for limit := 1; limit <= len(jobIds); limit++ {
+		paged := []int64{}
+		q := JobQuery{Limit: limit}
+		for {
+			jobs, cursor, err := store.QueryJobs(q)
+			c.Assert(err, ck.IsNil)
+			c.Assert(len(jobs) <= limit, ck.Equals, true)
+			for _, job := range jobs {
+				paged = append(paged, job.Id)
+			}
+
+			if cursor == "" {
+				break
+			}
+			q.Cursor = cursor
+		}
+
+		c.Assert(paged, ck.DeepEquals, all, ck.Commentf("limit %d", limit))
+	}
+
+	_, _, err := store.QueryJobs(JobQuery{Cursor: "nonsense"})
+	c.Assert(err, ck.NotNil)
+	_, _, err = store.QueryJobs(JobQuery{Order: JobOrder("Id")})
+	c.Assert(err, ck.NotNil)
+}
+
+// testPoolPipeline counts words, running its tasks on a PoolTaskQueue
+type testPoolPipeline struct {
+	testLocalWordCount
+	*PoolTaskQueue
+}
+
+// TestJobStoreWithoutAppengine runs a job from start to finish using nothing from appengine; the
+// contexts are plain background contexts
+func (mrt *MapreduceTests) TestJobStoreWithoutAppengine(c *ck.C) {
+	ctx := context.Background()
+	store := NewMemoryJobStore()
+	q := NewPoolTaskQueue(3, 3)
+	u := &testPoolPipeline{
+		testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}},
+		PoolTaskQueue:      q,
+	}
+
+	var doneMtx sync.Mutex
+	done := []string{}
+	mux := http.NewServeMux()
+	mux.Handle("/mr/test/", MapReduceStoreHandler("/mr/test", u, func(r *http.Request) context.Context { return ctx },
+		func(context.Context) JobStore { return store }, mrt.LoggerFn))
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		doneMtx.Lock()
+		defer doneMtx.Unlock()
+		done = append(done, r.URL.String())
+	})
+	q.Handler = mux
+
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.OnCompleteUrl = "/done"
+	jobId, err := RunWithStore(ctx, store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	c.Assert(q.Shutdown(timeoutCtx), ck.IsNil)
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+	c.Assert(done, ck.DeepEquals, []string{fmt.Sprintf("/done?status=done&id=%d", jobId)})
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
@@ -0,0 +1,425 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// LocalRunner runs a MapReduceJob inside of the current process. It does not use the datastore
+// or task queues (so the TaskInterface of the pipeline is never called and OnCompleteUrl is
+// ignored), but the map, shuffle and reduce stages use the same code as jobs started with Run().
+// It is intended for tests and small batch jobs.
+type LocalRunner struct {
+	// Workers is the number of map or reduce tasks which are run at the same time. It
+	// defaults to the number of CPUs.
+	Workers int
+
+	// Log receives the log messages from the job; if it's nil they are discarded
+	Log appwrap.Logging
+}
+
+// localTaskFunc runs a single task, returning the value which becomes the task's Result; counters
+// become the task's Counters
+type localTaskFunc func(i int, statusFunc StatusUpdateFunc, counters *Counters) (interface{}, error)
+
+// Run executes the job and returns the final JobInfo for the job along with all of the map
+// and reduce tasks it ran. The Result for each task is set just as it is for jobs started
+// by Run(). An error is returned if the job could not be started or if any task failed.
+func (lr LocalRunner) Run(c context.Context, job MapReduceJob) (JobInfo, []JobTask, error) {
+	log := lr.Log
+	if log == nil {
+		log = appwrap.NullLogger{}
+	}
+
+	readerNames, err := job.Inputs.ReaderNames()
+	if err != nil {
+		return JobInfo{}, nil, fmt.Errorf("forming reader names: %s", err)
+	} else if readerNames, err = splitReaderNames(c, job.Inputs, readerNames, job.SplitSize); err != nil {
+		return JobInfo{}, nil, err
+	} else if len(readerNames) == 0 {
+		return JobInfo{}, nil, fmt.Errorf("no input readers")
+	}
+
+	writerNames, err := job.Outputs.WriterNames(c)
+	if err != nil {
+		return JobInfo{}, nil, fmt.Errorf("forming writer names: %s", err)
+	} else if len(writerNames) == 0 {
+		return JobInfo{}, nil, fmt.Errorf("no output writers")
+	} else if err := checkSaltHotKeys(job); err != nil {
+		return JobInfo{}, nil, err
+	}
+
+	info := newJobInfo(job, writerNames)
+	info.Stage = StageMapping
+	info.UpdatedAt = time.Now()
+	info.StartTime = time.Now()
+
+	if info.RetryCount == 0 {
+		// same default as createJob
+		info.RetryCount = 3
+	}
+
+	if job.MapOnly {
+		return lr.runMapOnly(c, job, info, readerNames, writerNames, log)
+	}
+
+	if info.TotalOrder {
+		if info.RangeBoundaries, err = sampleRangeBoundaries(c, job, readerNames, len(writerNames), log); err != nil {
+			return JobInfo{}, nil, fmt.Errorf("sampling range boundaries: %s", err)
+		}
+	}
+
+	sharder, err := newKeySharder(job.MapReducePipeline, info)
+	if err != nil {
+		return JobInfo{}, nil, err
+	}
+
+	job.SetMapParameters(job.JobParameters)
+	job.SetShardParameters(job.JobParameters)
+
+	mapTasks := make([]JobTask, len(readerNames))
+	for i, readerName := range readerNames {
+		mapTasks[i] = JobTask{
+			Status: TaskStatusPending,
+			Url:    fmt.Sprintf("%s/map?reader=%s&shards=%d", job.UrlPrefix, url.QueryEscape(readerName), len(writerNames)),
+			Type:   TaskTypeMap,
+		}
+	}
+
+	log.Infof("running %d map tasks", len(mapTasks))
+	mapErr := lr.runTasks(job, info, mapTasks, func(i int, statusFunc StatusUpdateFunc, counters *Counters) (interface{}, error) {
+		if reader, err := job.ReaderFromName(c, readerNames[i]); err != nil {
+			return nil, fmt.Errorf("error making reader: %s", err)
+		} else {
+			return mapperFunc(c, job.MapReducePipeline, reader, newMapperOptions(info, len(writerNames), sharder, nil, counters), statusFunc, log)
+		}
+	}, log)
+
+	storageNames, saltedNames, err := mapOutputs(mapTasks, len(writerNames), log)
+	if err != nil {
+		return lr.failed(c, job, info, mapTasks, nil, err, log)
+	} else if mapErr != nil {
+		return lr.failed(c, job, info, mapTasks, append(storageNames, saltedNames...), mapErr, log)
+	}
+
+	// the counters we encoded ourselves always decode
+	info.Counters, _ = addTaskCounters(info.Counters, mapTasks)
+
+	tasks := mapTasks
+	if saltedNames != nil {
+		combineTasks, err := lr.runCombine(c, job, info, sharder, saltedNames, storageNames, log)
+		tasks = append(tasks, combineTasks...)
+		if err != nil {
+			return lr.failed(c, job, info, tasks, append(storageNames, saltedNames...), err, log)
+		}
+	}
+
+	info.Stage = StageReducing
+	info.UpdatedAt = time.Now()
+
+	reduceShards := make([]int, 0, len(writerNames))
+	for shard := range writerNames {
+		if len(storageNames[shard]) > 0 {
+			reduceShards = append(reduceShards, shard)
+		}
+	}
+
+	if len(reduceShards) == 0 {
+		// just like the appengine version, an empty map still gets a single reduce task
+		log.Infof("no results from maps -- running noop reduce task")
+		reduceShards = append(reduceShards, 0)
+	}
+
+	reduceTasks := make([]JobTask, len(reduceShards))
+	for i, shard := range reduceShards {
+		reduceTasks[i] = JobTask{
+			Status:              TaskStatusPending,
+			Url:                 fmt.Sprintf("%s/reduce?shard=%d&writer=%s", job.UrlPrefix, shard, url.QueryEscape(writerNames[shard])),
+			SeparateReduceItems: job.SeparateReduceItems,
+			Type:                TaskTypeReduce,
+		}
+	}
+
+	job.SetReduceParameters(job.JobParameters)
+
+	log.Infof("running %d reduce tasks", len(reduceTasks))
+	reduceErr := lr.runTasks(job, info, reduceTasks, func(i int, statusFunc StatusUpdateFunc, counters *Counters) (interface{}, error) {
+		shard := reduceShards[i]
+
+		writer, err := job.WriterFromName(c, writerNames[shard])
+		if err != nil {
+			return nil, fmt.Errorf("error getting writer: %s", err.Error())
+		}
+
+		var reduceErr error
+		if len(storageNames[shard]) > 0 {
+			reduceErr = reduceFunc(c, job.MapReducePipeline, writer, storageNames[shard], job.SeparateReduceItems, statusFunc, counters, log)
+		}
+
+		writer.Close(c)
+
+		return writer.ToName(), reduceErr
+	}, log)
+
+	tasks = append(tasks, reduceTasks...)
+
+	if reduceErr != nil {
+		// successful reduces have already removed their inputs
+		for i, shard := range reduceShards {
+			if reduceTasks[i].Status == TaskStatusDone {
+				storageNames[shard] = nil
+			}
+		}
+
+		return lr.failed(c, job, info, tasks, storageNames, reduceErr, log)
+	}
+
+	info.Counters, _ = addTaskCounters(info.Counters, reduceTasks)
+	info.Stage = StageDone
+	info.StageProgress = 1
+	info.UpdatedAt = time.Now()
+	log.Infof("local job complete after %s", info.UpdatedAt.Sub(info.StartTime))
+
+	return info, tasks, nil
+}
+
+// runCombine runs a combine task for each of the salted shards which has intermediate files. The
+// files each task writes are added to storageNames, and the ones it read are removed from
+// saltedNames.
+func (lr LocalRunner) runCombine(c context.Context, job MapReduceJob, info JobInfo, sharder keySharder, saltedNames, storageNames [][]string, log appwrap.Logging) ([]JobTask, error) {
+	info.Stage = StageCombining
+	info.UpdatedAt = time.Now()
+
+	combineShards := make([]int, 0, len(saltedNames))
+	for shard, names := range saltedNames {
+		if len(names) > 0 {
+			combineShards = append(combineShards, shard)
+		}
+	}
+
+	combineTasks := make([]JobTask, len(combineShards))
+	for i, shard := range combineShards {
+		combineTasks[i] = JobTask{
+			Status: TaskStatusPending,
+			Url:    fmt.Sprintf("%s/combine?shard=%d", job.UrlPrefix, shard),
+			Type:   TaskTypeCombine,
+		}
+	}
+
+	log.Infof("running %d combine tasks", len(combineTasks))
+	combineErr := lr.runTasks(job, info, combineTasks, func(i int, statusFunc StatusUpdateFunc, counters *Counters) (interface{}, error) {
+		return combineFunc(c, job.MapReducePipeline, sharder, len(storageNames), saltedNames[combineShards[i]], log)
+	}, log)
+
+	for i, shard := range combineShards {
+		var combinedNames map[string]int
+		if combineTasks[i].Status != TaskStatusDone {
+			continue
+		} else if err := json.Unmarshal([]byte(combineTasks[i].Result), &combinedNames); err != nil {
+			return combineTasks, fmt.Errorf("cannot unmarshal combined shard names: %s", err)
+		}
+
+		// successful combines have already removed their inputs
+		saltedNames[shard] = nil
+		for name, shard := range combinedNames {
+			storageNames[shard] = append(storageNames[shard], name)
+		}
+	}
+
+	return combineTasks, combineErr
+}
+
+// runMapOnly runs the map tasks for a map only job, with each map task writing to its own writer
+func (lr LocalRunner) runMapOnly(c context.Context, job MapReduceJob, info JobInfo, readerNames, writerNames []string, log appwrap.Logging) (JobInfo, []JobTask, error) {
+	info.MapOnly = true
+
+	if len(writerNames) < len(readerNames) {
+		return lr.failed(c, job, info, nil, nil, fmt.Errorf("map only jobs need an output writer for each input reader (%d readers, %d writers)", len(readerNames), len(writerNames)), log)
+	}
+
+	job.SetMapParameters(job.JobParameters)
+
+	mapTasks := make([]JobTask, len(readerNames))
+	for i, readerName := range readerNames {
+		mapTasks[i] = JobTask{
+			Status: TaskStatusPending,
+			Url:    fmt.Sprintf("%s/map?reader=%s&writer=%s", job.UrlPrefix, url.QueryEscape(readerName), url.QueryEscape(writerNames[i])),
+			Type:   TaskTypeMap,
+		}
+	}
+
+	log.Infof("running %d map only tasks", len(mapTasks))
+	if err := lr.runTasks(job, info, mapTasks, func(i int, statusFunc StatusUpdateFunc, counters *Counters) (interface{}, error) {
+		reader, err := job.ReaderFromName(c, readerNames[i])
+		if err != nil {
+			return nil, fmt.Errorf("error making reader: %s", err)
+		}
+
+		writer, err := job.WriterFromName(c, writerNames[i])
+		if err != nil {
+			return nil, fmt.Errorf("error getting writer: %s", err.Error())
+		}
+
+		mapErr := mapOnlyFunc(c, job.MapReducePipeline, reader, writer, statusFunc, counters, log)
+		writer.Close(c)
+
+		return writer.ToName(), mapErr
+	}, log); err != nil {
+		return lr.failed(c, job, info, mapTasks, nil, err, log)
+	}
+
+	info.Counters, _ = addTaskCounters(info.Counters, mapTasks)
+	info.Stage = StageDone
+	info.StageProgress = 1
+	info.UpdatedAt = time.Now()
+	log.Infof("local job complete after %s", info.UpdatedAt.Sub(info.StartTime))
+
+	return info, mapTasks, nil
+}
+
+// failed marks the job as failed and removes any intermediate files the map tasks created
+func (lr LocalRunner) failed(c context.Context, job MapReduceJob, info JobInfo, tasks []JobTask, storageNames [][]string, err error, log appwrap.Logging) (JobInfo, []JobTask, error) {
+	log.Errorf("local job failed: %s", err)
+
+	for _, names := range storageNames {
+		for _, name := range names {
+			if err := job.RemoveIntermediate(c, name); err != nil {
+				log.Errorf("failed to remove intermediate file: %s", err.Error())
+			}
+		}
+	}
+
+	info.Stage = StageFailed
+	info.UpdatedAt = time.Now()
+
+	return info, tasks, err
+}
+
+// runTasks runs all of the tasks using a pool of lr.Workers goroutines, retrying tasks which return
+// a tryAgainError (or panic) the same way retryTask() does. The first task failure is returned.
+func (lr LocalRunner) runTasks(job MapReduceJob, info JobInfo, tasks []JobTask, f localTaskFunc, log appwrap.Logging) error {
+	workers := lr.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var mtx sync.Mutex
+	var firstErr error
+
+	next := make(chan int, len(tasks))
+	for i := range tasks {
+		next <- i
+	}
+	close(next)
+
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < workers && worker < len(tasks); worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				statusFunc := func(format string, paramList ...interface{}) {
+					mtx.Lock()
+					defer mtx.Unlock()
+					tasks[i].Info = fmt.Sprintf(format, paramList...)
+					tasks[i].UpdatedAt = time.Now()
+				}
+
+				for {
+					mtx.Lock()
+					if tasks[i].Retries > info.RetryCount {
+						tasks[i].Status = TaskStatusFailed
+						tasks[i].Info = "maximum retries exceeded"
+						if firstErr == nil {
+							firstErr = fmt.Errorf("failed task: %s", tasks[i].Info)
+						}
+						mtx.Unlock()
+						break
+					}
+
+					tasks[i].Status = TaskStatusRunning
+					tasks[i].Retries++
+					tasks[i].StartTime = time.Now()
+					tasks[i].UpdatedAt = tasks[i].StartTime
+					task := tasks[i]
+					mtx.Unlock()
+
+					job.Status(0, task)
+
+					counters := NewCounters()
+					result, err := lr.runTask(i, f, statusFunc, counters, log)
+
+					mtx.Lock()
+					tasks[i].UpdatedAt = time.Now()
+					if err == nil {
+						resultBytes, _ := json.Marshal(result)
+						tasks[i].Status = TaskStatusDone
+						tasks[i].Info = ""
+						tasks[i].Result = string(resultBytes)
+						tasks[i].Counters = counters.encode()
+						tasks[i].Progress = 1
+						task = tasks[i]
+						mtx.Unlock()
+
+						job.Status(0, task)
+						break
+					} else if _, ok := err.(tryAgainError); ok {
+						log.Infof("retrying task due to %s", err)
+						mtx.Unlock()
+						continue
+					}
+
+					tasks[i].Status = TaskStatusFailed
+					tasks[i].Info = err.Error()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed task: %s", err)
+					}
+					mtx.Unlock()
+					break
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// runTask runs a single attempt of a task, turning a panic into a retry just like the map and reduce
+// http handlers do
+func (lr LocalRunner) runTask(i int, f localTaskFunc, statusFunc StatusUpdateFunc, counters *Counters, log appwrap.Logging) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 16384)
+			bytes := runtime.Stack(stack, false)
+			log.Criticalf("panic inside of local task %d: %s\n%s\n", i, r, stack[0:bytes])
+			err = tryAgainError{fmt.Errorf("%s", r)}
+		}
+	}()
+
+	return f(i, statusFunc, counters)
+}
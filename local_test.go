@@ -0,0 +1,361 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testMemoryOutput collects everything written to it, keyed by writer name
+type testMemoryOutput struct {
+	mtx     sync.Mutex
+	count   int
+	results map[string][]string
+}
+
+func (o *testMemoryOutput) WriterNames(c context.Context) ([]string, error) {
+	names := make([]string, o.count)
+	for i := range names {
+		names[i] = fmt.Sprintf("output-%d", i)
+	}
+
+	return names, nil
+}
+
+func (o *testMemoryOutput) WriterFromName(c context.Context, name string) (SingleOutputWriter, error) {
+	return &testMemoryOutputWriter{name: name, output: o}, nil
+}
+
+func (o *testMemoryOutput) lines() []string {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	all := []string{}
+	for _, lines := range o.results {
+		all = append(all, lines...)
+	}
+
+	sort.Strings(all)
+	return all
+}
+
+type testMemoryOutputWriter struct {
+	name   string
+	output *testMemoryOutput
+	lines  []string
+}
+
+func (w *testMemoryOutputWriter) Write(data interface{}) error {
+	w.lines = append(w.lines, fmt.Sprintf("%s", data))
+	return nil
+}
+
+func (w *testMemoryOutputWriter) Close(c context.Context) error {
+	w.output.mtx.Lock()
+	defer w.output.mtx.Unlock()
+
+	if w.output.results == nil {
+		w.output.results = make(map[string][]string)
+	}
+
+	// a retried reduce replaces what it wrote before
+	w.output.results[w.name] = w.lines
+	return nil
+}
+
+func (w *testMemoryOutputWriter) ToName() string {
+	return w.name
+}
+
+type testLocalWordCount struct {
+	testUniqueWordCount
+	*testMemoryOutput
+}
+
+func (mrt *MapreduceTests) localJob(pipe MapReducePipeline, output OutputWriter) MapReduceJob {
+	return MapReduceJob{
+		MapReducePipeline: pipe,
+		Inputs:            FileLineInputReader{[]string{"testdata/pandp-1", "testdata/pandp-2", "testdata/pandp-3", "testdata/pandp-4", "testdata/pandp-5"}},
+		Outputs:           output,
+		UrlPrefix:         "/mr/test",
+		JobParameters:     "job parameter",
+	}
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerWordCount(c *ck.C) {
+	u := &testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	info, tasks, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+	c.Assert(len(tasks), ck.Equals, 8)
+
+	for _, task := range tasks {
+		c.Check(task.Status, ck.Equals, TaskStatusDone)
+		c.Check(task.Retries, ck.Equals, 1)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
+
+type testLocalReduceError struct {
+	testUniqueWordCount
+	*testMemoryOutput
+	fatal bool
+}
+
+func (t *testLocalReduceError) Reduce(key interface{}, values []interface{}, status StatusUpdateFunc) (interface{}, error) {
+	if key.(string) == "enumeration" {
+		err := fmt.Errorf("reduce had an error")
+		if t.fatal {
+			err = FatalError{err}
+		}
+
+		return nil, err
+	}
+
+	return t.testUniqueWordCount.Reduce(key, values, status)
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerReduceError(c *ck.C) {
+	for _, fatal := range []bool{true, false} {
+		u := &testLocalReduceError{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 2}, fatal: fatal}
+		job := mrt.localJob(u, u.testMemoryOutput)
+		job.RetryCount = 2
+
+		info, tasks, err := LocalRunner{}.Run(appwrap.StubContext(), job)
+		c.Assert(err, ck.NotNil)
+		c.Assert(info.Stage, ck.Equals, StageFailed)
+
+		failed := 0
+		for _, task := range tasks {
+			if task.Status == TaskStatusFailed {
+				failed++
+				c.Check(task.Type, ck.Equals, TaskTypeReduce)
+
+				if fatal {
+					c.Check(task.Retries, ck.Equals, 1)
+					c.Check(task.Info, ck.Equals, "reduce had an error")
+				} else {
+					c.Check(task.Retries, ck.Equals, 3)
+				}
+			}
+		}
+
+		c.Check(failed, ck.Equals, 1)
+		c.Check(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+	}
+}
+
+// testLocalStreamingWordCount counts values without ever seeing more than one of them; keys
+// starting with "a" stop reading after the first value to make sure the rest get skipped
+type testLocalStreamingWordCount struct {
+	testLocalWordCount
+	streamed int
+}
+
+func (t *testLocalStreamingWordCount) Reduce(key interface{}, values []interface{}, status StatusUpdateFunc) (interface{}, error) {
+	return nil, FatalError{fmt.Errorf("Reduce should not be called for a StreamingReducer")}
+}
+
+func (t *testLocalStreamingWordCount) ReduceStream(key interface{}, values ReduceValueIterator, status StatusUpdateFunc) (interface{}, error) {
+	count := 0
+	for {
+		if _, ok, err := values.Next(); err != nil {
+			return nil, err
+		} else if !ok {
+			break
+		}
+
+		count++
+		if strings.HasPrefix(key.(string), "a") {
+			break
+		}
+	}
+
+	t.mtx.Lock()
+	t.streamed++
+	t.mtx.Unlock()
+
+	return fmt.Sprintf("%s: %d", key, count), nil
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerStreamingReduce(c *ck.C) {
+	u := &testLocalStreamingWordCount{testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 2}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	_, _, err := LocalRunner{}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(expected), "\n"), "\n") {
+		if strings.HasPrefix(line, "a") {
+			line = line[:strings.LastIndex(line, ": ")] + ": 1"
+		}
+		expectedLines = append(expectedLines, line)
+	}
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(u.streamed, ck.Equals, len(expectedLines))
+}
+
+// testLocalEmitWordCount writes the count for each word along with a second line for every word
+// which appears more than once
+type testLocalEmitWordCount struct {
+	testLocalWordCount
+}
+
+func (t *testLocalEmitWordCount) ReduceEmit(key interface{}, values ReduceValueIterator, emit EmitFunc, status StatusUpdateFunc) error {
+	count := 0
+	for {
+		if _, ok, err := values.Next(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+
+		count++
+	}
+
+	if err := emit(fmt.Sprintf("%s: %d", key, count)); err != nil {
+		return err
+	} else if count > 1 {
+		return emit(fmt.Sprintf("%s: repeated", key))
+	}
+
+	return nil
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerEmitReduce(c *ck.C) {
+	u := &testLocalEmitWordCount{testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 2}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+
+	_, _, err := LocalRunner{}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(expected), "\n"), "\n") {
+		expectedLines = append(expectedLines, line)
+		if !strings.HasSuffix(line, ": 1") {
+			expectedLines = append(expectedLines, line[:strings.LastIndex(line, ": ")]+": repeated")
+		}
+	}
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerMapOnly(c *ck.C) {
+	u := &testMapOnly{testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 5}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.MapOnly = true
+
+	info, tasks, err := LocalRunner{}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+	c.Assert(tasks, ck.HasLen, 5)
+
+	lineCount := 0
+	for i := 1; i <= 5; i++ {
+		data, err := ioutil.ReadFile(fmt.Sprintf("testdata/pandp-%d", i))
+		c.Assert(err, ck.IsNil)
+		lineCount += strings.Count(string(data), "\n")
+	}
+
+	c.Assert(u.lines(), ck.HasLen, lineCount)
+	for name, lines := range u.results {
+		c.Check(len(lines) > 0, ck.Equals, true, ck.Commentf("%s is empty", name))
+	}
+
+	// every reader needs its own writer
+	u = &testMapOnly{testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 2}}}
+	job = mrt.localJob(u, u.testMemoryOutput)
+	job.MapOnly = true
+
+	info, _, err = LocalRunner{}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.NotNil)
+	c.Assert(info.Stage, ck.Equals, StageFailed)
+}
+
+type testLocalPersistentSpills struct {
+	testLocalWordCount
+}
+
+func (t *testLocalPersistentSpills) PersistSpills() bool {
+	return true
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerPersistentSpills(c *ck.C) {
+	u := &testLocalPersistentSpills{testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.MapMemoryBudget = 10000
+
+	info, _, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerSplitInputs(c *ck.C) {
+	u := &testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.SplitSize = 50000
+
+	info, tasks, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	mapTasks := 0
+	for _, task := range tasks {
+		if task.Type == TaskTypeMap {
+			mapTasks++
+		}
+	}
+	c.Assert(mapTasks, ck.Equals, 17)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+}
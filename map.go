@@ -27,16 +27,73 @@ import (
 
 	"github.com/pendo-io/appwrap"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 )
 
-func mapMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReducePipeline, jobKey *datastore.Key, r *http.Request, timeout time.Duration, log appwrap.Logging) int {
+// map tasks write a spill once they have this many bytes of mapped data in memory, unless the
+// job has its own MapMemoryBudget
+const defaultMapMemoryBudget = 4 * 1024 * 1024
+
+// roughly how much memory a MappedData uses beyond the bytes in its key and value
+const mappedDataOverhead = 64
+
+// how many items are mapped between checks of the runtime memory stats
+const memStatsCheckItems = 1000
+
+// mapSpillLimit decides when map tasks write a spill
+type mapSpillLimit struct {
+	budget     int  // the most bytes of mapped data to hold before spilling
+	memStats   bool // spill whenever the heap is bigger than budget, too
+	sinceCheck int
+}
+
+func newMapSpillLimit(job JobInfo) mapSpillLimit {
+	limit := mapSpillLimit{budget: job.MapMemoryBudget, memStats: job.UseMemoryStats}
+	if limit.budget <= 0 {
+		limit.budget = defaultMapMemoryBudget
+	}
+
+	return limit
+}
+
+// full returns true if it's time to spill the size bytes of mapped data which are being held.
+// The heap is checked every memStatsCheckItems calls, since reading the memory stats briefly
+// stops everything else.
+func (limit *mapSpillLimit) full(size int) bool {
+	if size > limit.budget {
+		return true
+	} else if !limit.memStats || size == 0 {
+		return false
+	}
+
+	limit.sinceCheck++
+	if limit.sinceCheck < memStatsCheckItems {
+		return false
+	}
+	limit.sinceCheck = 0
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc > uint64(limit.budget)
+}
+
+func mapMonitorTask(c context.Context, store JobStore, pipeline MapReducePipeline, jobId int64, r *http.Request, timeout time.Duration, log appwrap.Logging) int {
 	start := time.Now()
 
-	job, err := waitForStageCompletion(c, ds, pipeline, jobKey, StageMapping, StageReducing, timeout, log)
+	nextStage := StageReducing
+	if job, err := store.GetJob(jobId); err != nil {
+		log.Errorf("failed to load job: %s", err)
+		return 500
+	} else if job.MapOnly {
+		nextStage = StageDone
+	}
+
+	job, err := waitForStageCompletion(c, store, pipeline, jobId, StageMapping, nextStage, timeout, log)
 	if err != nil {
 		log.Criticalf("waitForStageCompletion() failed: %s", err)
 		return 200
+	} else if job.Stage == StageCancelled {
+		jobCancelled(c, store, pipeline, job, log)
+		return 200
 	} else if job.Stage == StageMapping {
 		log.Infof("wait timed out -- returning an error and letting us automatically restart")
 		return 500
@@ -44,42 +101,91 @@ func mapMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReduceP
 
 	log.Infof("map stage completed -- stage is now %s", job.Stage)
 
+	if job.Stage == StageDone {
+		// map only jobs are done as soon as the maps are
+		jobComplete(c, pipeline, job, log)
+		log.Infof("mapping complete after %s of monitoring ", time.Now().Sub(start))
+		return 200
+	}
+
 	// erm... we just did this in jobStageComplete. dumb to do it again
-	mapTasks, err := gatherTasks(ds, job)
+	mapTasks, err := gatherTasks(store, job)
 	if err != nil {
 		log.Errorf("failed loading tasks: %s", mapTasks)
-		jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("error loading tasks after map complete: %s", err.Error()), log)
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("error loading tasks after map complete: %s", err.Error()), log)
+		return 200
+	}
+
+	removeSpeculativeLosers(c, store, pipeline, mapTasks, log)
+
+	storageNames, saltedNames, err := mapOutputs(mapTasks, len(job.WriterNames), log)
+	if err != nil {
+		jobFailed(c, store, pipeline, jobId, err, log)
 		return 200
 	}
 
+	var status int
+	if saltedNames != nil {
+		status = startCombineStage(c, store, pipeline, job, saltedNames, log)
+	} else {
+		status = startReduceStage(c, store, pipeline, job, storageNames, log)
+	}
+
+	log.Infof("mapping complete after %s of monitoring ", time.Now().Sub(start))
+	return status
+}
+
+// mapOutputs sorts the intermediate files written by the map tasks by the shard they're for. The
+// files for the salted shards of jobs which salt hot keys are returned separately in saltedNames,
+// which is nil if there aren't any.
+func mapOutputs(tasks []JobTask, shardCount int, log appwrap.Logging) (storageNames [][]string, saltedNames [][]string, err error) {
 	// we have one set for each reducer task
-	storageNames := make([][]string, len(job.WriterNames))
+	storageNames = make([][]string, shardCount)
 
-	for i := range mapTasks {
-		var shardNames map[string]int
-		if err = json.Unmarshal([]byte(mapTasks[i].Result), &shardNames); err != nil {
-			log.Errorf(`unmarshal error for result from map %d result '%+v'`, job.FirstTaskId+int64(i), mapTasks[i].Result)
-			jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("cannot unmarshal map shard names: %s", err.Error()), log)
-			return 200
-		} else {
-			for name, shard := range shardNames {
+	for _, task := range tasks {
+		if task.Type != TaskTypeMap || task.Status != TaskStatusDone {
+			continue
+		}
+
+		result, err := parseMapResult(task.Result)
+		if err != nil {
+			log.Errorf(`unmarshal error for result from map %d result '%+v'`, task.Id, task.Result)
+			return nil, nil, fmt.Errorf("cannot unmarshal map shard names: %s", err.Error())
+		}
+
+		for name, shard := range result.Names {
+			if shard < shardCount {
 				storageNames[shard] = append(storageNames[shard], name)
+				continue
+			} else if saltedNames == nil {
+				saltedNames = make([][]string, shardCount)
 			}
+
+			saltedNames[shard-shardCount] = append(saltedNames[shard-shardCount], name)
 		}
 	}
 
-	firstId, _, err := datastore.AllocateIDs(c, TaskEntity, nil, len(job.WriterNames))
+	return storageNames, saltedNames, nil
+}
+
+// startReduceStage creates and posts a reduce task for each of the shards which have intermediate
+// files, and then starts the reduce monitor. It returns the http status for the monitor task which
+// called it.
+func startReduceStage(c context.Context, store JobStore, pipeline MapReducePipeline, job JobInfo, storageNames [][]string, log appwrap.Logging) int {
+	jobId := job.Id
+
+	firstId, err := store.AllocateTaskIds(len(job.WriterNames))
 	if err != nil {
-		jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("failed to allocate ids for reduce tasks: %s", err.Error()), log)
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to allocate ids for reduce tasks: %s", err.Error()), log)
 		return 200
 	}
-	taskKeys := makeTaskKeys(ds, firstId, len(job.WriterNames))
+	taskIds := makeTaskIds(firstId, len(job.WriterNames))
 	tasks := make([]JobTask, 0, len(job.WriterNames))
 
 	for shard := range job.WriterNames {
 		if shards := storageNames[shard]; len(shards) > 0 {
-			url := fmt.Sprintf("%s/reduce?taskKey=%s;shard=%d;writer=%s",
-				job.UrlPrefix, taskKeys[len(tasks)].Encode(), shard, url.QueryEscape(job.WriterNames[shard]))
+			url := fmt.Sprintf("%s/reduce?taskId=%d&shard=%d&writer=%s",
+				job.UrlPrefix, taskIds[len(tasks)], shard, url.QueryEscape(job.WriterNames[shard]))
 
 			firstId++
 
@@ -103,8 +209,8 @@ func mapMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReduceP
 	// so we'll just start a single task with no inputs
 	if len(tasks) == 0 {
 		log.Infof("no results from maps -- starting noop reduce task")
-		url := fmt.Sprintf("%s/reduce?taskKey=%s;shard=%d;writer=%s",
-			job.UrlPrefix, taskKeys[len(tasks)].Encode(), 0, url.QueryEscape(job.WriterNames[0]))
+		url := fmt.Sprintf("%s/reduce?taskId=%d&shard=%d&writer=%s",
+			job.UrlPrefix, taskIds[len(tasks)], 0, url.QueryEscape(job.WriterNames[0]))
 
 		tasks = append(tasks, JobTask{
 			Status:              TaskStatusPending,
@@ -115,10 +221,10 @@ func mapMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReduceP
 		})
 	}
 
-	taskKeys = taskKeys[0:len(tasks)]
+	taskIds = taskIds[0:len(tasks)]
 
-	if err := createTasks(ds, jobKey, taskKeys, tasks, StageReducing, log); err != nil {
-		jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("failed to create reduce tasks: %s", err.Error()), log)
+	if err := createTasks(store, jobId, taskIds, tasks, StageReducing, log); err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to create reduce tasks: %s", err.Error()), log)
 		return 200
 	}
 
@@ -126,25 +232,23 @@ func mapMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReduceP
 
 	for i := range tasks {
 		if err := pipeline.PostTask(c, tasks[i].Url, job.JsonParameters, log); err != nil {
-			jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("failed to post reduce task: %s", err.Error()), log)
+			jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to post reduce task: %s", err.Error()), log)
 			return 200
 		}
 	}
 
 	log.Infof("tasks queue up; starting reduce monitor")
 
-	if err := pipeline.PostStatus(c, fmt.Sprintf("%s/reduce-monitor?jobKey=%s", job.UrlPrefix, jobKey.Encode()), log); err != nil {
-		jobFailed(c, ds, pipeline, jobKey, fmt.Errorf("failed to start reduce monitor: %s", err.Error()), log)
-		return 200
+	if err := pipeline.PostStatus(c, fmt.Sprintf("%s/reduce-monitor?jobId=%d", job.UrlPrefix, jobId), log); err != nil {
+		jobFailed(c, store, pipeline, jobId, fmt.Errorf("failed to start reduce monitor: %s", err.Error()), log)
 	}
 
-	log.Infof("mapping complete after %s of monitoring ", time.Now().Sub(start))
 	return 200
 }
 
-func mapTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapReducePipeline, taskKey *datastore.Key, w http.ResponseWriter, r *http.Request, log appwrap.Logging) {
+func mapTask(c context.Context, store JobStore, baseUrl string, mr MapReducePipeline, taskId int64, w http.ResponseWriter, r *http.Request, log appwrap.Logging) {
 	var finalErr error
-	var shardNames map[string]int
+	var result interface{}
 	var task JobTask
 
 	start := time.Now()
@@ -155,7 +259,21 @@ func mapTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapRedu
 	mr.SetMapParameters(jsonParameters)
 	mr.SetShardParameters(jsonParameters)
 
-	if t, err, retry := startTask(c, ds, mr, taskKey, log); err != nil && retry {
+	if r.FormValue("speculative") != "" {
+		speculativeMapTask(c, store, baseUrl, mr, taskId, r, log)
+		return
+	}
+
+	if t, err, retry := startTask(c, store, mr, taskId, log); err == errJobCancelled {
+		log.Infof("job has been cancelled; not running task")
+		return
+	} else if err == errJobPaused {
+		log.Infof("job is paused; task deferred")
+		return
+	} else if err == errTaskAlreadyDone {
+		log.Infof("task has already been completed")
+		return
+	} else if err != nil && retry {
 		log.Criticalf("failed updating task to running: %s", err)
 		http.Error(w, err.Error(), 500) // this will run us again
 		return
@@ -167,32 +285,84 @@ func mapTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapRedu
 		task = t
 	}
 
+	c, stopWatching := watchForCancel(c, store, task.JobId, log)
+	defer stopWatching()
+	c = withJobId(c, task.JobId)
+
+	// clean up whatever earlier attempts at this task left behind
+	tracker := newIntermediateTracker(store, task, false)
+	c = withIntermediateTracker(c, tracker)
+	if err := tracker.removeExcept(c, mr, checkpointIntermediates(task, log), log); err != nil {
+		log.Errorf("failed to clean up after earlier attempts: %s", err)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			stack := make([]byte, 16384)
 			bytes := runtime.Stack(stack, false)
-			log.Criticalf("panic inside of map task %s: %s\n%s\n", taskKey.Encode(), r, stack[0:bytes])
+			log.Criticalf("panic inside of map task %d: %s\n%s\n", taskId, r, stack[0:bytes])
 
-			if err := retryTask(c, ds, mr, task.Job, taskKey, log); err != nil {
+			if err := tracker.flush(); err != nil {
+				log.Errorf("failed to save intermediate names: %s", err)
+			}
+
+			if err := retryTask(c, store, mr, task.JobId, taskId, log); err != nil {
 				panic(fmt.Errorf("failed to retry task after panic: %s", err))
 			}
 		}
 	}()
 
+	statusFunc := makeStatusUpdateFunc(c, store, mr, fmt.Sprintf("%s/mapstatus", baseUrl), taskId, log)
+	counters := NewCounters()
+	c = withProgressReporter(c, newProgressReporter(store, taskId, log))
+
 	if readerName := r.FormValue("reader"); readerName == "" {
 		finalErr = fmt.Errorf("reader parameter required")
+	} else if writerName := r.FormValue("writer"); writerName != "" {
+		// map only jobs name a writer instead of a shard count
+		if reader, err := mr.ReaderFromName(c, readerName); err != nil {
+			finalErr = fmt.Errorf("error making reader: %s", err)
+		} else if writer, err := mr.WriterFromName(c, writerName); err != nil {
+			finalErr = fmt.Errorf("error getting writer: %s", err.Error())
+		} else {
+			finalErr = mapOnlyFunc(c, mr, reader, writer, statusFunc, counters, log)
+			writer.Close(c)
+			result = writer.ToName()
+		}
 	} else if shardStr := r.FormValue("shards"); shardStr == "" {
 		finalErr = fmt.Errorf("shards parameter required")
 	} else if shardCount, err := strconv.ParseInt(shardStr, 10, 32); err != nil {
 		finalErr = fmt.Errorf("error parsing shard count: %s", err.Error())
+	} else if job, err := store.GetJob(task.JobId); err != nil {
+		finalErr = tryAgainError{fmt.Errorf("error loading job: %s", err)}
 	} else if reader, err := mr.ReaderFromName(c, readerName); err != nil {
 		finalErr = fmt.Errorf("error making reader: %s", err)
+	} else if checkpointer, err := newMapCheckpointer(store, job, task, reader); err != nil {
+		finalErr = tryAgainError{err}
+	} else if sharder, err := newKeySharder(mr, job); err != nil {
+		finalErr = err
+	} else if mapped, err := mapperFunc(c, mr, reader, newMapperOptions(job, int(shardCount), sharder, checkpointer, counters), statusFunc, log); err != nil {
+		finalErr = err
 	} else {
-		shardNames, finalErr = mapperFunc(c, mr, reader, int(shardCount),
-			makeStatusUpdateFunc(c, ds, mr, fmt.Sprintf("%s/mapstatus", baseUrl), taskKey.Encode(), log), log)
+		result = mapped
+
+		// the only intermediates left should be the task's results
+		if err := tracker.removeExcept(c, mr, mapped.Names, log); err != nil {
+			log.Errorf("failed to clean up intermediate files: %s", err)
+		}
+	}
+
+	if err := tracker.flush(); err != nil {
+		log.Errorf("failed to save intermediate names: %s", err)
 	}
 
-	if err := endTask(c, ds, mr, task.Job, taskKey, finalErr, shardNames, log); err != nil {
+	if err := endTask(c, store, mr, task.JobId, taskId, finalErr, result, counters, log); err == errTaskAlreadyDone {
+		log.Infof("speculative attempt finished first; removing our intermediate files")
+		if err := tracker.removeExcept(c, mr, nil, log); err != nil {
+			log.Errorf("failed to remove intermediate files: %s", err)
+		}
+		return
+	} else if err != nil {
 		log.Criticalf("Could not finish task: %s", err)
 		http.Error(w, err.Error(), 500)
 		return
@@ -201,21 +371,157 @@ func mapTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapRedu
 	log.Infof("mapper done after %s", time.Now().Sub(start))
 }
 
-func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReader, shardCount int,
-	statusFunc StatusUpdateFunc, log appwrap.Logging) (map[string]int, error) {
+// mapCheckpoint records how far a map task has gotten through its input; it's saved as json in
+// the task's Checkpoint
+type mapCheckpoint struct {
+	Position string           // from CheckpointableInputReader.Position()
+	Names    map[string]int   // the intermediate files written so far, and the shard for each
+	HotKeys  map[string]int   `json:",omitempty"` // the hot keys counted so far, as in mapResult
+	Counters map[string]int64 `json:",omitempty"` // the task's counters so far
+}
+
+// checkpointIntermediates returns the intermediate files referred to by a map task's checkpoint
+func checkpointIntermediates(task JobTask, log appwrap.Logging) map[string]int {
+	var checkpoint mapCheckpoint
+	if task.Checkpoint != "" {
+		if err := json.Unmarshal([]byte(task.Checkpoint), &checkpoint); err != nil {
+			log.Errorf("cannot unmarshal map checkpoint: %s", err)
+		}
+	}
+
+	return checkpoint.Names
+}
+
+// mapCheckpointer saves the progress of map tasks which use CheckpointableInputReaders
+type mapCheckpointer struct {
+	interval time.Duration
+	start    mapCheckpoint // where the task left off the last time it was run
+	save     func(checkpoint mapCheckpoint) error
+}
+
+// newMapCheckpointer returns the checkpointer for a map task, or nil if the task shouldn't be
+// checkpointed
+func newMapCheckpointer(store JobStore, job JobInfo, task JobTask, reader SingleInputReader) (*mapCheckpointer, error) {
+	if _, ok := reader.(CheckpointableInputReader); !ok || job.CheckpointInterval == 0 {
+		return nil, nil
+	}
+
+	checkpointer := &mapCheckpointer{interval: job.CheckpointInterval}
+	if task.Checkpoint != "" {
+		if err := json.Unmarshal([]byte(task.Checkpoint), &checkpointer.start); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal checkpoint: %s", err)
+		}
+	}
+
+	checkpointer.save = func(checkpoint mapCheckpoint) error {
+		checkpointJson, _ := json.Marshal(checkpoint)
+		_, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+			task.Checkpoint = string(checkpointJson)
+			task.UpdatedAt = time.Now()
+			return nil
+		})
+
+		return err
+	}
+
+	return checkpointer, nil
+}
+
+// mapperOptions are the settings mapperFunc uses which come from the job and the task
+type mapperOptions struct {
+	shardCount   int
+	sharder      keySharder       // picks the shard for each key
+	salt         bool             // write the items for hot keys to the salted shards (see mapResult)
+	combine      bool             // combine values with the pipeline's Combiner, if it has one
+	limit        mapSpillLimit    // says when too much is being held in memory
+	checkpointer *mapCheckpointer // nil if the task isn't checkpointed
+	counters     *Counters        // where the built in map counters are kept
+}
+
+// newMapperOptions returns the options for mapping one of job's inputs
+func newMapperOptions(job JobInfo, shardCount int, sharder keySharder, checkpointer *mapCheckpointer, counters *Counters) mapperOptions {
+	return mapperOptions{
+		shardCount:   shardCount,
+		sharder:      sharder,
+		salt:         job.SaltHotKeys,
+		combine:      !job.SeparateReduceItems,
+		limit:        newMapSpillLimit(job),
+		checkpointer: checkpointer,
+		counters:     counters,
+	}
+}
+
+// mapperFunc maps everything from reader into intermediate files for opts.shardCount shards,
+// and returns the names of the files along with the hot keys it found. A spill is written
+// whenever opts.limit says too much is being held in memory. If opts.checkpointer is not nil,
+// the spills are merged into intermediate files every checkpointer.interval (or so) and the
+// reader's position is saved along with their names; the task then resumes from there if it
+// gets run again. opts.counters is also passed to CounterMappers.
+func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReader, opts mapperOptions, statusFunc StatusUpdateFunc, log appwrap.Logging) (mapResult, error) {
+	shardCount, sharder, salt, limit := opts.shardCount, opts.sharder, opts.salt, opts.limit
+	checkpointer, counters := opts.checkpointer, opts.counters
+
+	// hiding the Combiner keeps the spills from being combined
+	handler := KeyValueHandler(mr)
+	if !opts.combine {
+		handler = withoutCombiner{mr}
+	}
 
-	dataSets := make([]mappedDataList, shardCount)
+	hot := newHotKeyCounter(mr, shardCount, salt)
+	dataSets := make([]mappedDataList, hot.dataSetCount())
 	spills := make([]spillStruct, 0)
 	for i := range dataSets {
 		dataSets[i] = mappedDataList{data: make([]MappedData, 0), compare: mr}
 	}
 
+	// persisted spills need to be cleaned up however we finish
+	defer func() {
+		removeSpills(c, mr, spills, log)
+	}()
+
+	checkpoint := mapCheckpoint{Names: make(map[string]int)}
+	lastCheckpoint := time.Now()
+	if checkpointer != nil {
+		for name, shard := range checkpointer.start.Names {
+			checkpoint.Names[name] = shard
+		}
+
+		if err := hot.load(checkpointer.start.HotKeys); err != nil {
+			return mapResult{}, tryAgainError{fmt.Errorf("loading checkpoint: %s", err)}
+		}
+		counters.add(checkpointer.start.Counters)
+
+		if checkpointer.start.Position != "" {
+			log.Infof("resuming from checkpoint at %s with %d intermediate files", checkpointer.start.Position, len(checkpoint.Names))
+			if err := reader.(CheckpointableInputReader).Seek(checkpointer.start.Position); err != nil {
+				return mapResult{}, tryAgainError{fmt.Errorf("seeking to checkpoint: %s", err)}
+			}
+		}
+	}
+
+	counterMapper, countingMap := mr.(CounterMapper)
+	records := counters.Get(CounterMapInputRecords) // includes what was read before the checkpoint
+
 	var err error
 	var item interface{}
 	size := 0
 	count := 0
 	for item, err = reader.Next(); item != nil && err == nil; item, err = reader.Next() {
-		itemList, err := mr.Map(item, statusFunc)
+		if jobIsCancelled(c) {
+			return mapResult{}, errJobCancelled
+		}
+
+		counters.Increment(CounterMapInputRecords, 1)
+		records++
+		reportProgress(c, readProgress(reader), records)
+
+		var itemList []MappedData
+		var err error
+		if countingMap {
+			itemList, err = counterMapper.MapCounters(item, statusFunc, counters)
+		} else {
+			itemList, err = mr.Map(item, statusFunc)
+		}
 
 		if err != nil {
 			if _, ok := err.(FatalError); ok {
@@ -224,27 +530,68 @@ func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReade
 				err = tryAgainError{err}
 			}
 
-			return nil, err
+			return mapResult{}, err
 		}
 
 		for _, mappedItem := range itemList {
-			shard := mr.Shard(mappedItem.Key, shardCount)
+			shard := sharder.Shard(mappedItem.Key, shardCount)
 			dataSets[shard].data = append(dataSets[shard].data, mappedItem)
 
 			val, _ := mr.ValueDump(mappedItem.Value)
-			size += len(val)
+			size += len(mr.KeyDump(mappedItem.Key)) + len(val) + mappedDataOverhead
 			count++
 		}
-
-		if size > 4*1024*1024 {
-			if spill, err := writeSpill(c, mr, dataSets); err != nil {
-				return nil, tryAgainError{err}
+		counters.Increment(CounterMapOutputRecords, int64(len(itemList)))
+
+		if limit.full(size) {
+			hot.spill(dataSets)
+			if err := combineDataSets(handler, dataSets); err != nil {
+				if _, ok := err.(FatalError); ok {
+					err = err.(FatalError).Err
+				} else {
+					err = tryAgainError{err}
+				}
+
+				return mapResult{}, err
+			} else if spill, err := writeMapSpill(c, mr, dataSets); err != nil {
+				return mapResult{}, tryAgainError{err}
 			} else {
 				spills = append(spills, spill)
 			}
 
+			counters.Increment(CounterSpills, 1)
+			counters.Increment(CounterSpilledBytes, dumpedSize(mr, dataSets))
 			log.Infof("wrote spill of %d items", count)
 
+			if checkpointer != nil && time.Now().Sub(lastCheckpoint) >= checkpointer.interval {
+				if position, err := reader.(CheckpointableInputReader).Position(); err != nil {
+					return mapResult{}, tryAgainError{fmt.Errorf("getting reader position: %s", err)}
+				} else if names, err := mergeSpills(c, mr, handler, spills, log); err != nil {
+					return mapResult{}, tryAgainError{fmt.Errorf("merging spills for checkpoint: %s", err)}
+				} else {
+					for shard, name := range names {
+						checkpoint.Names[name] = shard
+					}
+					checkpoint.Position = position
+					checkpoint.HotKeys = hot.report()
+					checkpoint.Counters = counters.Values()
+
+					if err := checkpointer.save(checkpoint); err != nil {
+						return mapResult{}, tryAgainError{fmt.Errorf("saving checkpoint: %s", err)}
+					}
+
+					log.Infof("saved checkpoint at %s", position)
+				}
+
+				removeSpills(c, mr, spills, log)
+				spills = spills[0:0]
+				lastCheckpoint = time.Now()
+			}
+
+			if err := flushIntermediates(c); err != nil {
+				return mapResult{}, tryAgainError{err}
+			}
+
 			size = 0
 			count = 0
 			for shard := range dataSets {
@@ -262,7 +609,7 @@ func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReade
 			err = tryAgainError{err}
 		}
 
-		return nil, err
+		return mapResult{}, err
 	}
 
 	itemList, err := mr.MapComplete(statusFunc)
@@ -273,24 +620,40 @@ func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReade
 			err = tryAgainError{err}
 		}
 
-		return nil, err
+		return mapResult{}, err
 	}
 
 	for _, item := range itemList {
-		shard := mr.Shard(item.Key, shardCount)
+		shard := sharder.Shard(item.Key, shardCount)
 		dataSets[shard].data = append(dataSets[shard].data, item)
+
+		val, _ := mr.ValueDump(item.Value)
+		size += len(mr.KeyDump(item.Key)) + len(val) + mappedDataOverhead
 	}
+	counters.Increment(CounterMapOutputRecords, int64(len(itemList)))
+
+	hot.spill(dataSets)
+	if err := combineDataSets(handler, dataSets); err != nil {
+		if _, ok := err.(FatalError); ok {
+			err = err.(FatalError).Err
+		} else {
+			err = tryAgainError{err}
+		}
 
-	if spill, err := writeSpill(c, mr, dataSets); err != nil {
-		return nil, tryAgainError{err}
+		return mapResult{}, err
+	} else if spill, err := writeMapSpill(c, mr, dataSets); err != nil {
+		return mapResult{}, tryAgainError{err}
 	} else {
 		spills = append(spills, spill)
 	}
 
+	counters.Increment(CounterSpills, 1)
+	counters.Increment(CounterSpilledBytes, dumpedSize(mr, dataSets))
+
 	const maxMergeSpillsRetries = 5
-	finalNames, finalErr := make(map[string]int), error(nil)
+	finalNames, finalErr := checkpoint.Names, error(nil)
 	for try := 0; try < maxMergeSpillsRetries; try++ {
-		if names, err := mergeSpills(c, mr, mr, spills, log); err != nil {
+		if names, err := mergeSpills(c, mr, handler, spills, log); err != nil {
 			log.Warningf("spill merge failed try %d/%d: %s", try+1, maxMergeSpillsRetries, err)
 			finalErr = err
 		} else {
@@ -303,10 +666,108 @@ func mapperFunc(c context.Context, mr MapReducePipeline, reader SingleInputReade
 	}
 
 	if finalErr != nil {
-		return nil, tryAgainError{finalErr}
+		return mapResult{}, tryAgainError{finalErr}
+	}
+
+	if salt && len(hot.counts) == 0 {
+		// nothing was salted, so there's no need to combine the salted shards
+		for name, shard := range finalNames {
+			if shard < shardCount {
+				continue
+			} else if err := mr.RemoveIntermediate(c, name); err != nil {
+				log.Errorf("failed to remove intermediate file: %s", err.Error())
+			} else {
+				untrackIntermediate(c, name)
+			}
+
+			delete(finalNames, name)
+		}
 	}
 
 	log.Infof("finalNames: %#v", finalNames)
 
-	return finalNames, nil
+	return mapResult{Names: finalNames, HotKeys: hot.report()}, nil
+}
+
+// mapOnlyFunc is used instead of mapperFunc for map only jobs; the Value of every item returned by
+// the mapper is written to writer
+func mapOnlyFunc(c context.Context, mr MapReducePipeline, reader SingleInputReader, writer SingleOutputWriter,
+	statusFunc StatusUpdateFunc, counters *Counters, log appwrap.Logging) error {
+
+	counterMapper, countingMap := mr.(CounterMapper)
+
+	var err error
+	var item interface{}
+	var records int64
+	count := 0
+	for item, err = reader.Next(); item != nil && err == nil; item, err = reader.Next() {
+		if jobIsCancelled(c) {
+			return errJobCancelled
+		}
+
+		counters.Increment(CounterMapInputRecords, 1)
+		records++
+		reportProgress(c, readProgress(reader), records)
+
+		var itemList []MappedData
+		var err error
+		if countingMap {
+			itemList, err = counterMapper.MapCounters(item, statusFunc, counters)
+		} else {
+			itemList, err = mr.Map(item, statusFunc)
+		}
+
+		if err != nil {
+			if _, ok := err.(FatalError); ok {
+				err = err.(FatalError).Err
+			} else {
+				err = tryAgainError{err}
+			}
+
+			return err
+		}
+
+		for _, mappedItem := range itemList {
+			if err := writer.Write(mappedItem.Value); err != nil {
+				return tryAgainError{err}
+			}
+			count++
+		}
+		counters.Increment(CounterMapOutputRecords, int64(len(itemList)))
+	}
+
+	reader.Close()
+
+	if err != nil {
+		if _, ok := err.(FatalError); ok {
+			err = err.(FatalError).Err
+		} else {
+			err = tryAgainError{err}
+		}
+
+		return err
+	}
+
+	itemList, err := mr.MapComplete(statusFunc)
+	if err != nil {
+		if _, ok := err.(FatalError); ok {
+			err = err.(FatalError).Err
+		} else {
+			err = tryAgainError{err}
+		}
+
+		return err
+	}
+
+	for _, item := range itemList {
+		if err := writer.Write(item.Value); err != nil {
+			return tryAgainError{err}
+		}
+		count++
+	}
+	counters.Increment(CounterMapOutputRecords, int64(len(itemList)))
+
+	log.Infof("wrote %d items", count)
+
+	return nil
 }
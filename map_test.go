@@ -0,0 +1,325 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testMapOnly upper cases every line, and records the tasks it posts instead of running them
+type testMapOnly struct {
+	testLocalWordCount
+	posted []string
+}
+
+func (t *testMapOnly) Map(item interface{}, status StatusUpdateFunc) ([]MappedData, error) {
+	if t.mapParam != "job parameter" {
+		return nil, FatalError{fmt.Errorf("parameter not sent to map")}
+	}
+
+	return []MappedData{{Key: "", Value: strings.ToUpper(item.(string))}}, nil
+}
+
+func (t *testMapOnly) Reduce(key interface{}, values []interface{}, status StatusUpdateFunc) (interface{}, error) {
+	return nil, FatalError{fmt.Errorf("Reduce should not be called for map only jobs")}
+}
+
+func (t *testMapOnly) PostTask(c context.Context, url string, jsonParameters string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (t *testMapOnly) PostStatus(c context.Context, url string, log appwrap.Logging) error {
+	t.posted = append(t.posted, url)
+	return nil
+}
+
+func (mrt *MapreduceTests) TestMapOnly(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := &testMapOnly{testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 5}}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.MapOnly = true
+	job.OnCompleteUrl = "/done"
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	// 5 map tasks and the monitor
+	c.Assert(u.posted, ck.HasLen, 6)
+	posted := u.posted
+	u.posted = nil
+
+	for _, taskUrl := range posted {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+	c.Assert(u.posted, ck.DeepEquals, []string{fmt.Sprintf("/done?status=done&id=%d", jobId)})
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks, ck.HasLen, 5)
+	for i, task := range tasks {
+		c.Check(task.Type, ck.Equals, TaskTypeMap)
+		c.Check(task.Status, ck.Equals, TaskStatusDone)
+		c.Check(task.Result, ck.Equals, fmt.Sprintf(`"output-%d"`, i))
+	}
+
+	c.Assert(len(u.results), ck.Equals, 5)
+	for _, line := range u.results["output-0"] {
+		c.Check(line, ck.Equals, strings.ToUpper(line))
+	}
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
+
+func (mrt *MapreduceTests) TestFileLineInputReaderSeek(c *ck.C) {
+	reader, err := FileLineInputReader{}.ReaderFromName(nil, "testdata/pandp-1")
+	c.Assert(err, ck.IsNil)
+	defer reader.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := reader.Next()
+		c.Assert(err, ck.IsNil)
+	}
+
+	position, err := reader.(CheckpointableInputReader).Position()
+	c.Assert(err, ck.IsNil)
+	expected, err := reader.Next()
+	c.Assert(err, ck.IsNil)
+
+	resumed, err := FileLineInputReader{}.ReaderFromName(nil, "testdata/pandp-1")
+	c.Assert(err, ck.IsNil)
+	defer resumed.Close()
+
+	c.Assert(resumed.(CheckpointableInputReader).Seek(position), ck.IsNil)
+	line, err := resumed.Next()
+	c.Assert(err, ck.IsNil)
+	c.Assert(line, ck.Equals, expected)
+}
+
+func (mrt *MapreduceTests) TestFileLineInputReaderSplit(c *ck.C) {
+	readAll := func(name string) []string {
+		reader, err := FileLineInputReader{}.ReaderFromName(nil, name)
+		c.Assert(err, ck.IsNil)
+		defer reader.Close()
+
+		lines := []string{}
+		for {
+			line, err := reader.Next()
+			c.Assert(err, ck.IsNil)
+			if line == nil {
+				return lines
+			}
+			lines = append(lines, line.(string))
+		}
+	}
+
+	whole := readAll("testdata/pandp-1")
+
+	pieces, err := FileLineInputReader{}.SplitReaderName(nil, "testdata/pandp-1", 20000)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(pieces), ck.Equals, 8)
+
+	lines := []string{}
+	next := int64(0)
+	for _, piece := range pieces {
+		path, start, end, isRange := parseFileRange(piece)
+		c.Assert(isRange, ck.Equals, true)
+		c.Assert(path, ck.Equals, "testdata/pandp-1")
+		c.Assert(start, ck.Equals, next)
+		next = end
+
+		lines = append(lines, readAll(piece)...)
+	}
+	c.Assert(next, ck.Equals, int64(147074))
+	c.Assert(lines, ck.DeepEquals, whole)
+
+	// pieces can be split again, and small inputs aren't split at all
+	again, err := FileLineInputReader{}.SplitReaderName(nil, pieces[0], 5000)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(again) > 1, ck.Equals, true)
+	_, _, end, _ := parseFileRange(again[len(again)-1])
+	_, _, pieceEnd, _ := parseFileRange(pieces[0])
+	c.Assert(end, ck.Equals, pieceEnd)
+
+	small, err := FileLineInputReader{}.SplitReaderName(nil, "testdata/pandp-5", 1000000)
+	c.Assert(err, ck.IsNil)
+	c.Assert(small, ck.DeepEquals, []string{"testdata/pandp-5"})
+
+	// paths which look like ranges aren't
+	for _, name := range []string{"user@example.com/file", "logs/app.log@100-200", "logs/app.log\x00100-200x"} {
+		_, _, _, isRange := parseFileRange(name)
+		c.Check(isRange, ck.Equals, false, ck.Commentf("name %q", name))
+	}
+}
+
+func (mrt *MapreduceTests) TestFileLineInputReaderCRLF(c *ck.C) {
+	path := filepath.Join(c.MkDir(), "crlf")
+	lines := []string{}
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\r", i))
+	}
+	c.Assert(ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644), ck.IsNil)
+
+	pieces, err := FileLineInputReader{}.SplitReaderName(nil, path, 1000)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(pieces) > 1, ck.Equals, true)
+
+	read := []string{}
+	for _, piece := range pieces {
+		reader, err := FileLineInputReader{}.ReaderFromName(nil, piece)
+		c.Assert(err, ck.IsNil)
+
+		for line, err := reader.Next(); line != nil; line, err = reader.Next() {
+			c.Assert(err, ck.IsNil)
+			read = append(read, line.(string))
+		}
+		reader.Close()
+	}
+	c.Assert(read, ck.DeepEquals, lines)
+
+	// positions are the byte offsets of the lines, including the \r of the lines before them
+	reader, err := FileLineInputReader{}.ReaderFromName(nil, path)
+	c.Assert(err, ck.IsNil)
+	defer reader.Close()
+
+	offset := 0
+	for _, line := range lines[:500] {
+		_, err := reader.Next()
+		c.Assert(err, ck.IsNil)
+		offset += len(line) + 1
+	}
+
+	position, err := reader.(CheckpointableInputReader).Position()
+	c.Assert(err, ck.IsNil)
+	c.Assert(position, ck.Equals, fmt.Sprintf("%d", offset))
+
+	resumed, err := FileLineInputReader{}.ReaderFromName(nil, path)
+	c.Assert(err, ck.IsNil)
+	defer resumed.Close()
+	c.Assert(resumed.(CheckpointableInputReader).Seek(position), ck.IsNil)
+	line, err := resumed.Next()
+	c.Assert(err, ck.IsNil)
+	c.Assert(line, ck.Equals, lines[500])
+}
+
+func (mrt *MapreduceTests) TestMapCheckpoint(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.Inputs = FileLineInputReader{[]string{"testdata/pandp-1"}}
+	job.CheckpointInterval = time.Nanosecond
+	job.MapMemoryBudget = 10000
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(u.posted, ck.HasLen, 2)
+	mapUrl := u.posted[0]
+
+	serve(mapUrl)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks, ck.HasLen, 1)
+	c.Assert(tasks[0].Status, ck.Equals, TaskStatusDone)
+
+	var checkpoint mapCheckpoint
+	c.Assert(json.Unmarshal([]byte(tasks[0].Checkpoint), &checkpoint), ck.IsNil)
+	c.Assert(checkpoint.Position, ck.Not(ck.Equals), "")
+	c.Assert(len(checkpoint.Names) > 0, ck.Equals, true)
+
+	result, err := parseMapResult(tasks[0].Result)
+	c.Assert(err, ck.IsNil)
+	for name, shard := range checkpoint.Names {
+		c.Check(result.Names[name], ck.Equals, shard)
+	}
+
+	// run it again as if it failed after reading the whole file; nothing new should be mapped
+	info, err := os.Stat("testdata/pandp-1")
+	c.Assert(err, ck.IsNil)
+	checkpointJson, _ := json.Marshal(mapCheckpoint{
+		Position: fmt.Sprintf("%d", info.Size()),
+		Names:    map[string]int{"earlier": 1},
+	})
+	_, err = store.UpdateTask(tasks[0].Id, func(task *JobTask) error {
+		task.Status = TaskStatusPending
+		task.Checkpoint = string(checkpointJson)
+		return nil
+	})
+	c.Assert(err, ck.IsNil)
+	u.memoryIntermediateStorage = &memoryIntermediateStorage{}
+
+	serve(mapUrl)
+
+	task, err := store.GetTask(tasks[0].Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+
+	result, err = parseMapResult(task.Result)
+	c.Assert(err, ck.IsNil)
+	c.Assert(result.Names["earlier"], ck.Equals, 1)
+	for name, items := range u.memoryIntermediateStorage.items {
+		c.Check(items, ck.HasLen, 0, ck.Commentf("intermediate %s", name))
+	}
+}
+
+func (mrt *MapreduceTests) TestMapSpillLimit(c *ck.C) {
+	limit := newMapSpillLimit(JobInfo{})
+	c.Assert(limit.budget, ck.Equals, 4*1024*1024)
+
+	limit = newMapSpillLimit(JobInfo{MapMemoryBudget: 100})
+	c.Assert(limit.full(0), ck.Equals, false)
+	c.Assert(limit.full(100), ck.Equals, false)
+	c.Assert(limit.full(101), ck.Equals, true)
+
+	// the heap is always bigger than a byte, but it's only checked every so often
+	limit = newMapSpillLimit(JobInfo{MapMemoryBudget: 1, UseMemoryStats: true})
+	for i := 1; i < memStatsCheckItems; i++ {
+		c.Assert(limit.full(1), ck.Equals, false)
+	}
+	c.Assert(limit.full(1), ck.Equals, true)
+	c.Assert(limit.full(1), ck.Equals, false)
+}
@@ -22,6 +22,8 @@ import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -65,6 +67,45 @@ type Reducer interface {
 	ReduceComplete(statusUpdate StatusUpdateFunc) ([]interface{}, error)
 }
 
+// ReduceValueIterator returns the values for a single key, in the order they come out of the
+// shuffle. The values are read from intermediate storage as they are needed rather than loaded
+// up front.
+type ReduceValueIterator interface {
+	// Returns the next value, a bool saying if it's valid, and an error if one occurred
+	Next() (interface{}, bool, error)
+}
+
+// StreamingReducer may optionally be implemented by a MapReducePipeline whose reduce function
+// doesn't need all of the values for a key at once; if it is, ReduceStream is called instead of
+// Reducer.Reduce (which is still required, but is never called). The method can't be named
+// Reduce since pipelines include the Reducer interface. Values which aren't read from the
+// iterator are skipped.
+type StreamingReducer interface {
+	ReduceStream(key interface{}, values ReduceValueIterator, statusUpdate StatusUpdateFunc) (result interface{}, err error)
+}
+
+// EmitFunc writes a single result to the output writer for the reduce task. Once it returns an
+// error every later call returns the same error and the task will be retried.
+type EmitFunc func(result interface{}) error
+
+// EmitReducer may optionally be implemented by a MapReducePipeline which needs to write any number
+// of results for each key. If it is, ReduceEmit is used instead of Reducer.Reduce or
+// StreamingReducer.ReduceStream; each result passed to emit is written right away.
+type EmitReducer interface {
+	ReduceEmit(key interface{}, values ReduceValueIterator, emit EmitFunc, statusUpdate StatusUpdateFunc) error
+}
+
+// Combiner may optionally be implemented by a MapReducePipeline to collapse all of the values
+// for a key into a single partial aggregate before they are written to intermediate storage.
+// It is called by the map task on each sorted shard before it is spilled, and again while
+// the spills are merged, so Combine may see values it previously returned. Only use this
+// for associative reductions; the Reducer will be passed combined values instead of the
+// values returned by Map. Combine is never called for jobs with SeparateReduceItems set, since
+// their reducers expect each item on its own.
+type Combiner interface {
+	Combine(key interface{}, values []interface{}) (interface{}, error)
+}
+
 // TaskStatusChange allows the map reduce framework to notify tasks when their status has changed to RUNNING or DONE. Handy for
 // callbacks. Always called after SetMapParameters() and SetReduceParameters()
 type TaskStatusChange interface {
@@ -126,17 +167,78 @@ type MapReduceJob struct {
 
 	// SeparateReduceItems means that instead of collapsing all rows with the same key into
 	// one call to the reduce function, each row is passed individually (though wrapped in
-	// an array of length one to keep the reduce function signature the same)
+	// an array of length one to keep the reduce function signature the same). The pipeline's
+	// Combiner, if it has one, isn't used.
 	SeparateReduceItems bool
 
 	// JobParameters is passed to map and reduce job. They are assumed to be json encoded, though
 	// absolutely no effort is made to enforce that.
 	JobParameters string
+
+	// MapOnly skips the shuffle and reduce stages. Each map task writes the Value of every item
+	// returned by Map (and MapComplete) straight to an output writer; the task for the Nth reader
+	// uses the Nth writer, so there must be at least as many writers as readers. The Reducer
+	// and Combiner are never called, and the job is done as soon as all of the maps are.
+	MapOnly bool
+
+	// CheckpointInterval is how often map tasks whose readers are CheckpointableInputReaders save
+	// their progress, so a retried task picks up where it left off instead of starting over. Since
+	// a resumed task only sees the items after its checkpoint, this should only be used with
+	// mappers which don't carry state from one item to the next (including for MapComplete).
+	// Zero (the default) disables checkpoints.
+	CheckpointInterval time.Duration
+
+	// MapMemoryBudget is roughly how many bytes of mapped data a map task holds in memory before
+	// writing it out as a spill. The dumped size of each item's key and value, plus a bit for the
+	// item itself, is counted. Zero means 4MB.
+	MapMemoryBudget int
+
+	// UseMemoryStats makes map tasks spill whenever the heap is larger than MapMemoryBudget as
+	// well. The heap includes everything else the process is doing, so this works best when
+	// each instance only runs one map task at a time.
+	UseMemoryStats bool
+
+	// SpeculativeExecution lets the map monitor start a second attempt at map tasks which have
+	// been running far longer than the typical map task; whichever attempt finishes first is used
+	// and the other's intermediate files are removed. Both attempts run the whole mapper, so it
+	// must not have side effects beyond what it returns.
+	//
+	// Only map tasks are speculated. Reduce tasks (and the map tasks of MapOnly jobs) are never
+	// duplicated, since both attempts would write to the same output and a reduce removes its
+	// intermediate inputs when it finishes, which would pull them out from under the other attempt.
+	SpeculativeExecution bool
+
+	// SplitSize is roughly how many bytes of input each map task reads when Inputs is a
+	// SplittableInputReader; each input is split into pieces of this size and each piece gets its
+	// own map task. Map only jobs need an output writer for every piece. Zero disables splitting.
+	SplitSize int64
+
+	// TotalOrder shards the mapped keys by range instead of by KeyHandler.Shard(), so every key
+	// written by the Nth output writer sorts before every key written by the (N+1)th, and the
+	// outputs can be concatenated into one sorted result. The ranges are picked when the job
+	// starts by mapping the first SampleSize items (1000 if zero) of each input and dividing
+	// the sampled keys evenly, so how evenly the outputs end up sized depends on how
+	// representative those items are. Map only jobs ignore this.
+	TotalOrder bool
+	SampleSize int
+
+	// SaltHotKeys spreads the items for keys which a map task finds to be hot (each map task's
+	// Result reports the hot keys it found) over all of the reducers instead of sending them all
+	// to one. A combine stage between the map and reduce stages then merges the values for each
+	// of those keys into one using the pipeline's Combiner, so the Reducer only sees a few
+	// combined values for them. The pipeline must implement Combiner, and the job can't set
+	// SeparateReduceItems. Map only jobs ignore this.
+	SaltHotKeys bool
 }
 
+// Run starts a job which keeps its state in the appengine datastore, returning the id of the job
 func Run(c context.Context, ds appwrap.Datastore, job MapReduceJob) (int64, error) {
-	log := appwrap.NewAppengineLogging(c)
+	return RunWithStore(c, NewDatastoreJobStore(c, ds), job, appwrap.NewAppengineLogging(c))
+}
 
+// RunWithStore starts a job which keeps its state in store, logging to log; the MapReduceHandler
+// for the job must use the same JobStore.
+func RunWithStore(c context.Context, store JobStore, job MapReduceJob, log appwrap.Logging) (int64, error) {
 	readerNames, err := job.Inputs.ReaderNames()
 	if err != nil {
 		return 0, fmt.Errorf("forming reader names: %s", err)
@@ -144,66 +246,146 @@ func Run(c context.Context, ds appwrap.Datastore, job MapReduceJob) (int64, erro
 		return 0, fmt.Errorf("no input readers")
 	}
 
+	jobId, writerNames, err := newJob(c, store, job, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := startJob(c, store, job, jobId, readerNames, writerNames, log); err != nil {
+		return 0, err
+	}
+
+	return jobId, nil
+}
+
+// newJobInfo returns the JobInfo for a job which hasn't been created yet
+func newJobInfo(job MapReduceJob, writerNames []string) JobInfo {
+	return JobInfo{
+		UrlPrefix:            job.UrlPrefix,
+		RetryCount:           job.RetryCount,
+		SeparateReduceItems:  job.SeparateReduceItems,
+		OnCompleteUrl:        job.OnCompleteUrl,
+		WriterNames:          writerNames,
+		JsonParameters:       job.JobParameters,
+		MapOnly:              job.MapOnly,
+		CheckpointInterval:   job.CheckpointInterval,
+		MapMemoryBudget:      job.MapMemoryBudget,
+		UseMemoryStats:       job.UseMemoryStats,
+		SpeculativeExecution: job.SpeculativeExecution,
+		TotalOrder:           job.TotalOrder && !job.MapOnly,
+		SaltHotKeys:          job.SaltHotKeys && !job.MapOnly,
+	}
+}
+
+// newJob creates the JobInfo for job, returning the job id and the names of its output writers
+func newJob(c context.Context, store JobStore, job MapReduceJob, chainId int64) (int64, []string, error) {
 	writerNames, err := job.Outputs.WriterNames(c)
 	if err != nil {
-		return 0, fmt.Errorf("forming writer names: %s", err)
+		return 0, nil, fmt.Errorf("forming writer names: %s", err)
 	} else if len(writerNames) == 0 {
-		return 0, fmt.Errorf("no output writers")
+		return 0, nil, fmt.Errorf("no output writers")
+	} else if err := checkSaltHotKeys(job); err != nil {
+		return 0, nil, err
+	}
+
+	info := newJobInfo(job, writerNames)
+	info.ChainId = chainId
+
+	jobId, err := createJob(store, info)
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating job: %s", err)
 	}
 
-	reducerCount := len(writerNames)
+	return jobId, writerNames, nil
+}
 
-	jobKey, err := createJob(ds, job.UrlPrefix, writerNames, job.OnCompleteUrl, job.SeparateReduceItems, job.JobParameters, job.RetryCount)
+// startJob creates and posts the map tasks for a job created by newJob, along with the map monitor
+func startJob(c context.Context, store JobStore, job MapReduceJob, jobId int64, readerNames []string, writerNames []string, log appwrap.Logging) error {
+	readerNames, err := splitReaderNames(c, job.Inputs, readerNames, job.SplitSize)
 	if err != nil {
-		return 0, fmt.Errorf("creating job: %s", err)
+		if _, err := markJobFailed(c, store, jobId, log); err != nil {
+			log.Errorf("failed to log job %d as failed: %s", jobId, err)
+		}
+		return err
 	}
 
-	firstId, _, err := datastore.AllocateIDs(c, TaskEntity, nil, len(readerNames))
+	if job.MapOnly && len(writerNames) < len(readerNames) {
+		if _, err := markJobFailed(c, store, jobId, log); err != nil {
+			log.Errorf("failed to log job %d as failed: %s", jobId, err)
+		}
+		return fmt.Errorf("map only jobs need an output writer for each input reader (%d readers, %d writers)", len(readerNames), len(writerNames))
+	}
+
+	if job.TotalOrder && !job.MapOnly {
+		boundaries, err := sampleRangeBoundaries(c, job, readerNames, len(writerNames), log)
+		if err == nil {
+			_, err = store.UpdateJob(jobId, func(info *JobInfo) error {
+				info.RangeBoundaries = boundaries
+				return nil
+			})
+		}
+
+		if err != nil {
+			if _, err := markJobFailed(c, store, jobId, log); err != nil {
+				log.Errorf("failed to log job %d as failed: %s", jobId, err)
+			}
+			return fmt.Errorf("sampling range boundaries: %s", err)
+		}
+	}
+
+	firstId, err := store.AllocateTaskIds(len(readerNames))
 	if err != nil {
-		return 0, fmt.Errorf("allocating task ids: %s", err)
+		return fmt.Errorf("allocating task ids: %s", err)
 	}
-	taskKeys := makeTaskKeys(ds, firstId, len(readerNames))
+	taskIds := makeTaskIds(firstId, len(readerNames))
 	tasks := make([]JobTask, len(readerNames))
 
 	for i, readerName := range readerNames {
-		url := fmt.Sprintf("%s/map?taskKey=%s;reader=%s;shards=%d",
-			job.UrlPrefix, taskKeys[i].Encode(), readerName,
-			reducerCount)
+		taskUrl := fmt.Sprintf("%s/map?taskId=%d&reader=%s&shards=%d",
+			job.UrlPrefix, taskIds[i], url.QueryEscape(readerName),
+			len(writerNames))
+		if job.MapOnly {
+			taskUrl = fmt.Sprintf("%s/map?taskId=%d&reader=%s&writer=%s",
+				job.UrlPrefix, taskIds[i], url.QueryEscape(readerName),
+				url.QueryEscape(writerNames[i]))
+		}
 
 		tasks[i] = JobTask{
 			Status: TaskStatusPending,
-			Url:    url,
+			Url:    taskUrl,
 			Type:   TaskTypeMap,
 		}
 	}
 
-	if err := createTasks(ds, jobKey, taskKeys, tasks, StageMapping, log); err != nil {
-		if _, innerErr := markJobFailed(c, ds, jobKey, log); err != nil {
-			log.Errorf("failed to log job %d as failed: %s", jobKey.IntID(), innerErr)
+	if err := createTasks(store, jobId, taskIds, tasks, StageMapping, log); err != nil {
+		if _, innerErr := markJobFailed(c, store, jobId, log); err != nil {
+			log.Errorf("failed to log job %d as failed: %s", jobId, innerErr)
 		}
-		return 0, fmt.Errorf("creating tasks: %s", err)
+		return fmt.Errorf("creating tasks: %s", err)
 	}
 
 	for i := range tasks {
 		if err := job.PostTask(c, tasks[i].Url, job.JobParameters, log); err != nil {
-			if _, innerErr := markJobFailed(c, ds, jobKey, log); err != nil {
-				log.Errorf("failed to log job %d as failed: %s", jobKey.IntID(), innerErr)
+			if _, innerErr := markJobFailed(c, store, jobId, log); err != nil {
+				log.Errorf("failed to log job %d as failed: %s", jobId, innerErr)
 			}
-			return 0, fmt.Errorf("posting task: %s", err)
+			return fmt.Errorf("posting task: %s", err)
 		}
 	}
 
-	if err := job.PostStatus(c, fmt.Sprintf("%s/map-monitor?jobKey=%s", job.UrlPrefix, jobKey.Encode()), log); err != nil {
+	if err := job.PostStatus(c, fmt.Sprintf("%s/map-monitor?jobId=%d", job.UrlPrefix, jobId), log); err != nil {
 		log.Criticalf("failed to start map monitor task: %s", err)
 	}
 
-	return jobKey.IntID(), nil
+	return nil
 }
 
 type urlHandler struct {
 	pipeline   MapReducePipeline
 	baseUrl    string
 	getContext func(r *http.Request) context.Context
+	getStore   func(c context.Context) JobStore
+	getLogger  func(c context.Context) appwrap.Logging
 }
 
 // MapReduceHandler returns an http.Handler which is responsible for all of the
@@ -212,68 +394,92 @@ type urlHandler struct {
 func MapReduceHandler(baseUrl string, pipeline MapReducePipeline,
 	getContext func(r *http.Request) context.Context) http.Handler {
 
-	return urlHandler{pipeline, baseUrl, getContext}
+	return MapReduceStoreHandler(baseUrl, pipeline, getContext, func(c context.Context) JobStore {
+		return NewDatastoreJobStore(c, appwrap.NewAppengineDatastore(c))
+	}, appwrap.NewAppengineLogging)
+}
+
+// MapReduceStoreHandler is like MapReduceHandler, but is used for jobs started by RunWithStore. The
+// getStore and getLogger functions return the JobStore and logger to use for each request; neither
+// needs to involve appengine.
+func MapReduceStoreHandler(baseUrl string, pipeline MapReducePipeline, getContext func(r *http.Request) context.Context,
+	getStore func(c context.Context) JobStore, getLogger func(c context.Context) appwrap.Logging) http.Handler {
+
+	return urlHandler{pipeline, baseUrl, getContext, getStore, getLogger}
+}
+
+// requestId returns the id from the named form parameter. Tasks queued before jobs were kept in
+// JobStores passed datastore keys (in a parameter named by legacyName) so we still accept those.
+func requestId(r *http.Request, name string, legacyName string) (int64, error) {
+	if idStr := r.FormValue(name); idStr != "" {
+		return strconv.ParseInt(idStr, 10, 64)
+	} else if keyStr := r.FormValue(legacyName); keyStr != "" {
+		if key, err := datastore.DecodeKey(keyStr); err != nil {
+			return 0, err
+		} else {
+			return key.IntID(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s parameter required", name)
 }
 
 func (h urlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := h.getContext(r)
-	ds := appwrap.NewAppengineDatastore(c)
-	log := appwrap.NewAppengineLogging(c)
+	store := h.getStore(c)
+	log := h.getLogger(c)
 
 	monitorTimeout := time.Minute * 30
 	if appengine.IsDevAppServer() {
 		monitorTimeout = time.Second * 10
 	}
 
-	if strings.HasSuffix(r.URL.Path, "/map-monitor") || strings.HasSuffix(r.URL.Path, "/reduce-monitor") {
-		if jobKeyStr := r.FormValue("jobKey"); jobKeyStr == "" {
-			http.Error(w, "jobKey parameter required", http.StatusBadRequest)
-		} else if jobKey, err := datastore.DecodeKey(jobKeyStr); err != nil {
-			http.Error(w, fmt.Sprintf("invalid jobKey: %s", err.Error()),
+	if strings.HasSuffix(r.URL.Path, "/map-monitor") || strings.HasSuffix(r.URL.Path, "/combine-monitor") ||
+		strings.HasSuffix(r.URL.Path, "/reduce-monitor") {
+
+		if jobId, err := requestId(r, "jobId", "jobKey"); err != nil {
+			http.Error(w, fmt.Sprintf("invalid jobId: %s", err.Error()),
 				http.StatusBadRequest)
 		} else if strings.HasSuffix(r.URL.Path, "/map-monitor") {
-			w.WriteHeader(mapMonitorTask(c, ds, h.pipeline, jobKey, r, monitorTimeout, log))
+			w.WriteHeader(mapMonitorTask(c, store, h.pipeline, jobId, r, monitorTimeout, log))
+		} else if strings.HasSuffix(r.URL.Path, "/combine-monitor") {
+			w.WriteHeader(combineMonitorTask(c, store, h.pipeline, jobId, r, monitorTimeout, log))
 		} else {
-			w.WriteHeader(reduceMonitorTask(c, ds, h.pipeline, jobKey, r, monitorTimeout, log))
+			w.WriteHeader(reduceMonitorTask(c, store, h.pipeline, jobId, r, monitorTimeout, log))
 		}
 
 		return
 	}
 
-	var taskKey *datastore.Key
-	var err error
-
-	if taskKeyStr := r.FormValue("taskKey"); taskKeyStr == "" {
-		http.Error(w, "taskKey parameter required", http.StatusBadRequest)
-		return
-	} else if taskKey, err = datastore.DecodeKey(taskKeyStr); err != nil {
-		http.Error(w, fmt.Sprintf("invalid taskKey: %s", err.Error()),
+	taskId, err := requestId(r, "taskId", "taskKey")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid taskId: %s", err.Error()),
 			http.StatusBadRequest)
 		return
 	}
 
-	log = appwrap.PrefixLogger{Logging: log, Prefix: fmt.Sprintf("%s: ", taskKey)}
+	log = appwrap.PrefixLogger{Logging: log, Prefix: fmt.Sprintf("task %d: ", taskId)}
 
 	if strings.HasSuffix(r.URL.Path, "/reduce") {
-		reduceTask(c, ds, h.baseUrl, h.pipeline, taskKey, w, r, log)
+		reduceTask(c, store, h.baseUrl, h.pipeline, taskId, w, r, log)
 	} else if strings.HasSuffix(r.URL.Path, "/map") {
-		mapTask(c, ds, h.baseUrl, h.pipeline, taskKey, w, r, log)
+		mapTask(c, store, h.baseUrl, h.pipeline, taskId, w, r, log)
+	} else if strings.HasSuffix(r.URL.Path, "/combine") {
+		combineTask(c, store, h.baseUrl, h.pipeline, taskId, w, r, log)
 	} else if strings.HasSuffix(r.URL.Path, "/mapstatus") ||
 		strings.HasSuffix(r.URL.Path, "/reducestatus") {
 
-		updateTask(ds, taskKey, "", 0, r.FormValue("msg"), nil)
+		updateTask(store, taskId, "", 0, r.FormValue("msg"), nil)
 	} else {
 		http.Error(w, "unknown request url", http.StatusNotFound)
 		return
 	}
 }
 
-func makeStatusUpdateFunc(c context.Context, ds appwrap.Datastore, pipeline MapReducePipeline, urlStr string, taskKey string, log appwrap.Logging) StatusUpdateFunc {
+func makeStatusUpdateFunc(c context.Context, store JobStore, pipeline MapReducePipeline, urlStr string, taskId int64, log appwrap.Logging) StatusUpdateFunc {
 	return func(format string, paramList ...interface{}) {
 		msg := fmt.Sprintf(format, paramList...)
-		if key, err := datastore.DecodeKey(taskKey); err != nil {
-			log.Errorf("failed to decode task key for status: %s", err)
-		} else if _, err := updateTask(ds, key, "", 0, msg, nil); err != nil {
+		if _, err := updateTask(store, taskId, "", 0, msg, nil); err != nil {
 			log.Errorf("failed to update task status: %s", err)
 		}
 	}
@@ -32,7 +32,7 @@ type testUniqueWordCount struct {
 	fileLineOutputWriter
 	StringKeyHandler
 	Int64ValueHandler
-	memoryIntermediateStorage
+	*memoryIntermediateStorage
 	SimpleTasks
 	IgnoreTaskStatusChange
 
@@ -41,6 +41,10 @@ type testUniqueWordCount struct {
 	reduceParam string
 }
 
+func newTestUniqueWordCount() testUniqueWordCount {
+	return testUniqueWordCount{memoryIntermediateStorage: &memoryIntermediateStorage{}}
+}
+
 type SimpleTasks struct {
 	handler http.Handler
 	done    chan string
@@ -0,0 +1,139 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// how many items are read from each input reader when sampling keys for TotalOrder jobs if
+// the job doesn't set SampleSize
+var defaultSampleSize = 1000
+
+// keySharder picks the shard for each mapped key; KeyHandlers are keySharders
+type keySharder interface {
+	Shard(key interface{}, shardCount int) int
+}
+
+// rangeSharder puts keys into shards by comparing them to a sorted list of boundaries. Shard
+// i gets the keys which are at least boundaries[i-1] and less than boundaries[i], so every key
+// in a shard sorts before every key in the next one.
+type rangeSharder struct {
+	compare    KeyHandler
+	boundaries []interface{}
+}
+
+func (r rangeSharder) Shard(key interface{}, shardCount int) int {
+	shard := sort.Search(len(r.boundaries), func(i int) bool {
+		return r.compare.Less(key, r.boundaries[i])
+	})
+
+	if shard >= shardCount {
+		shard = shardCount - 1
+	}
+
+	return shard
+}
+
+// newKeySharder returns the keySharder map tasks for job should use; that's the KeyHandler's
+// own Shard() unless the job is TotalOrder
+func newKeySharder(handler KeyHandler, job JobInfo) (keySharder, error) {
+	if !job.TotalOrder {
+		return handler, nil
+	}
+
+	boundaries := make([]interface{}, len(job.RangeBoundaries))
+	for i, encoded := range job.RangeBoundaries {
+		if dumped, err := base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("decoding range boundary %d: %s", i, err)
+		} else if boundaries[i], err = handler.KeyLoad(dumped); err != nil {
+			return nil, fmt.Errorf("loading range boundary %d: %s", i, err)
+		}
+	}
+
+	return rangeSharder{compare: handler, boundaries: boundaries}, nil
+}
+
+type sampledKeys struct {
+	keys    []interface{}
+	compare KeyHandler
+}
+
+func (s sampledKeys) Len() int           { return len(s.keys) }
+func (s sampledKeys) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s sampledKeys) Less(i, j int) bool { return s.compare.Less(s.keys[i], s.keys[j]) }
+
+// sampleRangeBoundaries maps the first few items from each of the readers and returns the
+// shardCount-1 keys which divide the sampled keys most evenly, dumped and base64 encoded for
+// JobInfo.RangeBoundaries. Nothing is returned if nothing was sampled, which puts every key
+// into the first shard.
+func sampleRangeBoundaries(c context.Context, job MapReduceJob, readerNames []string, shardCount int, log appwrap.Logging) ([]string, error) {
+	sampleSize := job.SampleSize
+	if sampleSize == 0 {
+		sampleSize = defaultSampleSize
+	}
+
+	job.SetMapParameters(job.JobParameters)
+	status := func(format string, paramList ...interface{}) {}
+
+	sample := sampledKeys{compare: job.MapReducePipeline}
+	for _, readerName := range readerNames {
+		reader, err := job.Inputs.ReaderFromName(c, readerName)
+		if err != nil {
+			return nil, fmt.Errorf("error making reader %s: %s", readerName, err)
+		}
+
+		for i := 0; i < sampleSize; i++ {
+			item, err := reader.Next()
+			if err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("error reading %s: %s", readerName, err)
+			} else if item == nil {
+				break
+			}
+
+			itemList, err := job.Map(item, status)
+			if err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("error mapping sample from %s: %s", readerName, err)
+			}
+
+			for _, mapped := range itemList {
+				sample.keys = append(sample.keys, mapped.Key)
+			}
+		}
+
+		reader.Close()
+	}
+
+	log.Infof("sampled %d keys from %d readers", len(sample.keys), len(readerNames))
+	if len(sample.keys) == 0 {
+		return nil, nil
+	}
+
+	sort.Sort(sample)
+	boundaries := make([]string, shardCount-1)
+	for i := range boundaries {
+		key := sample.keys[(i+1)*len(sample.keys)/shardCount]
+		boundaries[i] = base64.StdEncoding.EncodeToString(job.KeyDump(key))
+	}
+
+	return boundaries, nil
+}
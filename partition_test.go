@@ -0,0 +1,110 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) TestRangeSharder(c *ck.C) {
+	sharder, err := newKeySharder(StringKeyHandler{}, JobInfo{})
+	c.Assert(err, ck.IsNil)
+	c.Assert(sharder, ck.Equals, StringKeyHandler{})
+
+	encode := func(key string) string {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+
+	sharder, err = newKeySharder(StringKeyHandler{}, JobInfo{TotalOrder: true, RangeBoundaries: []string{encode("g"), encode("p")}})
+	c.Assert(err, ck.IsNil)
+	c.Check(sharder.Shard("", 3), ck.Equals, 0)
+	c.Check(sharder.Shard("apple", 3), ck.Equals, 0)
+	c.Check(sharder.Shard("g", 3), ck.Equals, 1)
+	c.Check(sharder.Shard("orange", 3), ck.Equals, 1)
+	c.Check(sharder.Shard("pear", 3), ck.Equals, 2)
+	c.Check(sharder.Shard("zucchini", 3), ck.Equals, 2)
+	c.Check(sharder.Shard("zucchini", 2), ck.Equals, 1)
+
+	// nothing was sampled
+	sharder, err = newKeySharder(StringKeyHandler{}, JobInfo{TotalOrder: true})
+	c.Assert(err, ck.IsNil)
+	c.Check(sharder.Shard("zucchini", 3), ck.Equals, 0)
+
+	_, err = newKeySharder(Int64KeyHandler{}, JobInfo{TotalOrder: true, RangeBoundaries: []string{encode("ten")}})
+	c.Assert(err, ck.NotNil)
+}
+
+func (mrt *MapreduceTests) TestLocalRunnerTotalOrder(c *ck.C) {
+	u := &testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.TotalOrder = true
+	job.SampleSize = 200
+
+	info, _, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+	c.Assert(info.RangeBoundaries, ck.HasLen, 2)
+
+	// the outputs, one after the other, are in order
+	lines := []string{}
+	keys := []string{}
+	for i := 0; i < 3; i++ {
+		output := u.results[fmt.Sprintf("output-%d", i)]
+		c.Assert(len(output) > 0, ck.Equals, true)
+		for _, line := range output {
+			lines = append(lines, line)
+			keys = append(keys, line[:strings.LastIndex(line, ": ")])
+		}
+	}
+	c.Assert(sort.StringsAreSorted(keys), ck.Equals, true)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	sort.Strings(lines)
+	c.Assert(lines, ck.DeepEquals, expectedLines)
+}
+
+func (mrt *MapreduceTests) TestRunTotalOrder(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	u.testMemoryOutput.count = 4
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.TotalOrder = true
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.TotalOrder, ck.Equals, true)
+	c.Assert(info.RangeBoundaries, ck.HasLen, 3)
+
+	boundaries := []string{}
+	for _, encoded := range info.RangeBoundaries {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		c.Assert(err, ck.IsNil)
+		boundaries = append(boundaries, string(key))
+	}
+	c.Assert(sort.StringsAreSorted(boundaries), ck.Equals, true)
+}
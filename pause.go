@@ -0,0 +1,138 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// errJobPaused is returned by startTask when the task has been deferred because its job is paused
+var errJobPaused = fmt.Errorf("job paused")
+
+// how long tasks for paused jobs wait before they check the job again. The delay grows with how
+// long the task has been deferred, up to maxPausedTaskDelay, so a long pause doesn't keep the
+// task queue busy.
+var pausedTaskDelay = 30 * time.Second
+var maxPausedTaskDelay = 10 * time.Minute
+
+// PauseJob pauses a job which keeps its state in the appengine datastore
+func PauseJob(ds appwrap.Datastore, jobId int64) error {
+	return PauseJobWithStore(datastoreJobStore{ds: ds}, jobId)
+}
+
+// PauseJobWithStore stops new tasks for a job from running until ResumeJobWithStore is called.
+// Tasks which are already running finish normally, and the results of finished tasks are kept.
+// Tasks which start while the job is paused are put back in the task queue with a delay (or
+// failed so the queue retries them, if the TaskInterface can't delay tasks), and the job's
+// monitor waits for as long as the job stays paused.
+func PauseJobWithStore(store JobStore, jobId int64) error {
+	_, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+		if job.Stage == StageDone || job.Stage == StageFailed || job.Stage == StageCancelled {
+			return fmt.Errorf("job %d is already %s", jobId, job.Stage)
+		} else if job.Paused {
+			return fmt.Errorf("job %d is already paused", jobId)
+		}
+
+		job.Paused = true
+		job.UpdatedAt = time.Now()
+		return nil
+	})
+
+	return err
+}
+
+// ResumeJob resumes a paused job which keeps its state in the appengine datastore
+func ResumeJob(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobId int64) error {
+	return ResumeJobWithStore(c, NewDatastoreJobStore(c, ds), taskIntf, jobId, appwrap.NewAppengineLogging(c))
+}
+
+// ResumeJobWithStore lets the tasks for a paused job run again. Tasks which were deferred while
+// the job was paused are posted again through taskIntf (which must post to the job's
+// MapReduceHandler), since their delayed copies may have been dropped or may not run for a
+// while. Any copies which are still queued find the task already running or done and exit.
+func ResumeJobWithStore(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, log appwrap.Logging) error {
+	job, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+		if !job.Paused {
+			return fmt.Errorf("job %d is not paused", jobId)
+		}
+
+		job.Paused = false
+		job.UpdatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tasks, err := store.JobTasks(jobId)
+	if err != nil {
+		return fmt.Errorf("loading tasks for job %d: %s", jobId, err)
+	}
+
+	for _, task := range tasks {
+		if task.Status != TaskStatusPending || !task.Deferred {
+			continue
+		}
+
+		if err := taskIntf.PostTask(c, task.Url, job.JsonParameters, log); err != nil {
+			return fmt.Errorf("posting task %d: %s", task.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// deferTask marks a task for a paused job as deferred, unless an earlier attempt already did. If
+// taskIntf is a DelayedTaskInterface the task is posted again to run after a delay and errJobPaused
+// is returned, which drops the current attempt. Otherwise an error is returned so the task queue
+// runs this attempt again later. Either way ResumeJobWithStore posts the task again once the job
+// is resumed.
+func deferTask(c context.Context, store JobStore, taskIntf TaskInterface, job JobInfo, task JobTask, log appwrap.Logging) error {
+	delay := pausedTaskDelay
+	if task.Deferred {
+		// wait about as long again as the task has already been waiting
+		if waited := time.Since(task.UpdatedAt); waited > delay {
+			delay = waited
+		}
+		if delay > maxPausedTaskDelay {
+			delay = maxPausedTaskDelay
+		}
+	} else if _, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+		if task.Status == TaskStatusDone || task.Status == TaskStatusFailed || task.Status == TaskStatusCancelled {
+			return nil
+		}
+
+		task.Status = TaskStatusPending
+		task.Deferred = true
+		task.Info = "job paused"
+		task.UpdatedAt = time.Now()
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to defer task for paused job: %s", err)
+	}
+
+	delayed, ok := taskIntf.(DelayedTaskInterface)
+	if !ok {
+		return fmt.Errorf("job %d is paused; task will be retried", job.Id)
+	} else if err := delayed.PostTaskLater(c, task.Url, job.JsonParameters, delay, log); err != nil {
+		return fmt.Errorf("failed to defer task for paused job: %s", err)
+	}
+
+	return errJobPaused
+}
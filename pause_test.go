@@ -0,0 +1,178 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+// testPausePipeline records the tasks it posts (including delayed ones) instead of running them
+type testPausePipeline struct {
+	*testCancelPipeline
+	delayed []string
+}
+
+func (t *testPausePipeline) PostTaskLater(c context.Context, url string, jsonParameters string, delay time.Duration, log appwrap.Logging) error {
+	t.delayed = append(t.delayed, url)
+	return nil
+}
+
+func (mrt *MapreduceTests) TestPauseJob(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := &testPausePipeline{testCancelPipeline: newTestCancelPipeline()}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) int {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	mapUrls := []string{}
+	for _, taskUrl := range u.posted {
+		if !strings.Contains(taskUrl, "/map-monitor") {
+			mapUrls = append(mapUrls, taskUrl)
+		}
+	}
+	c.Assert(mapUrls, ck.HasLen, 5)
+	u.posted = nil
+
+	c.Assert(serve(mapUrls[0]), ck.Equals, 200)
+
+	c.Assert(PauseJobWithStore(store, jobId), ck.IsNil)
+	c.Assert(PauseJobWithStore(store, jobId), ck.ErrorMatches, ".*already paused")
+
+	// tasks started while the job is paused are deferred
+	c.Assert(serve(mapUrls[1]), ck.Equals, 200)
+	c.Assert(u.delayed, ck.DeepEquals, []string{mapUrls[1]})
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks[0].Status, ck.Equals, TaskStatusDone)
+	c.Assert(tasks[1].Status, ck.Equals, TaskStatusPending)
+	c.Assert(tasks[1].Deferred, ck.Equals, true)
+	c.Assert(tasks[1].Retries, ck.Equals, 0)
+
+	// the delayed copy is deferred again without the task being written again
+	c.Assert(serve(mapUrls[1]), ck.Equals, 200)
+	c.Assert(u.delayed, ck.DeepEquals, []string{mapUrls[1], mapUrls[1]})
+	task, err := store.GetTask(tasks[1].Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.UpdatedAt.Equal(tasks[1].UpdatedAt), ck.Equals, true)
+
+	// resuming posts the deferred task again, so the job finishes even though its delayed
+	// copies are dropped
+	c.Assert(ResumeJobWithStore(appwrap.StubContext(), store, u, jobId, mrt.nullLog), ck.IsNil)
+	c.Assert(ResumeJobWithStore(appwrap.StubContext(), store, u, jobId, mrt.nullLog), ck.ErrorMatches, ".*not paused")
+	c.Assert(u.posted, ck.DeepEquals, []string{mapUrls[1]})
+
+	for _, taskUrl := range append(u.posted, mapUrls[2:]...) {
+		c.Assert(serve(taskUrl), ck.Equals, 200)
+	}
+
+	tasks, err = store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	for _, task := range tasks {
+		c.Check(task.Status, ck.Equals, TaskStatusDone)
+		c.Check(task.Deferred, ck.Equals, false)
+	}
+}
+
+func (mrt *MapreduceTests) TestPauseJobWithoutDelayedTasks(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) int {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	mapUrl := u.posted[0]
+	u.posted = nil
+
+	// the task queue is asked to retry the task rather than the handler waiting around
+	c.Assert(PauseJobWithStore(store, jobId), ck.IsNil)
+	c.Assert(serve(mapUrl), ck.Equals, 500)
+	c.Assert(u.posted, ck.HasLen, 0)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(tasks[0].Status, ck.Equals, TaskStatusPending)
+	c.Assert(tasks[0].Deferred, ck.Equals, true)
+	c.Assert(tasks[0].Retries, ck.Equals, 0)
+
+	c.Assert(ResumeJobWithStore(appwrap.StubContext(), store, u, jobId, mrt.nullLog), ck.IsNil)
+	c.Assert(u.posted, ck.DeepEquals, []string{mapUrl})
+	c.Assert(serve(mapUrl), ck.Equals, 200)
+
+	task, err := store.GetTask(tasks[0].Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Status, ck.Equals, TaskStatusDone)
+	c.Assert(task.Deferred, ck.Equals, false)
+}
+
+func (mrt *MapreduceTests) TestPausedMonitorWaits(c *ck.C) {
+	store := NewMemoryJobStore()
+	ctx := appwrap.StubContext()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}, OnCompleteUrl: "complete", RetryCount: 5})
+	c.Assert(err, ck.IsNil)
+
+	count := 0
+	checkCompletion := func(store JobStore, jobId int64, taskIds []int64, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
+		if count == 20 {
+			return true, JobInfo{Stage: StageReducing}, nil
+		}
+
+		count++
+		return false, JobInfo{}, nil
+	}
+
+	// without the pause the wait times out
+	job, err := doWaitForStageCompletion(ctx, store, &taskInterfaceMock{}, jobId, StageMapping, StageReducing, time.Millisecond,
+		checkCompletion, 5*time.Millisecond, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.Stage, ck.Equals, StageFormation)
+	c.Assert(count < 20, ck.Equals, true)
+
+	count = 0
+	c.Assert(PauseJobWithStore(store, jobId), ck.IsNil)
+	job, err = doWaitForStageCompletion(ctx, store, &taskInterfaceMock{}, jobId, StageMapping, StageReducing, time.Millisecond,
+		checkCompletion, 5*time.Millisecond, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.Stage, ck.Equals, StageReducing)
+}
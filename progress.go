@@ -0,0 +1,192 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// ProgressReader may optionally be implemented by a SingleInputReader or an
+// IntermediateStorageIterator which knows how much of its input it has read. The units don't
+// matter (bytes are typical) as long as consumed and total use the same ones. Map and reduce
+// tasks use this to report how far along they are.
+type ProgressReader interface {
+	Progress() (consumed, total int64)
+}
+
+// tasks save their progress at most this often
+var progressInterval = 10 * time.Second
+
+type progressContextKey struct{}
+
+// progressReporter saves the progress of a running task, throttled to progressInterval
+type progressReporter struct {
+	interval time.Duration
+	last     time.Time
+	save     func(fraction float64, records int64) error
+	log      appwrap.Logging
+}
+
+func newProgressReporter(store JobStore, taskId int64, log appwrap.Logging) *progressReporter {
+	return &progressReporter{
+		interval: progressInterval,
+		last:     time.Now(),
+		log:      log,
+		save: func(fraction float64, records int64) error {
+			_, err := store.UpdateTask(taskId, func(task *JobTask) error {
+				if task.Status != TaskStatusRunning {
+					// another attempt finished the task
+					return nil
+				}
+
+				task.Progress = fraction
+				task.ProgressRecords = records
+				task.UpdatedAt = time.Now()
+				return nil
+			})
+
+			return err
+		},
+	}
+}
+
+// withProgressReporter returns a context which the map and reduce functions report their progress
+// through
+func withProgressReporter(c context.Context, reporter *progressReporter) context.Context {
+	return context.WithValue(c, progressContextKey{}, reporter)
+}
+
+// reportProgress records how far the task running in c is through its input, and how many
+// records it has read; it's saved if the last save was long enough ago. Tasks which aren't
+// reporting progress ignore this.
+func reportProgress(c context.Context, fraction float64, records int64) {
+	reporter, ok := c.Value(progressContextKey{}).(*progressReporter)
+	if !ok || time.Now().Sub(reporter.last) < reporter.interval {
+		return
+	}
+
+	reporter.last = time.Now()
+	if err := reporter.save(fraction, records); err != nil {
+		// progress is only informational, so the task carries on
+		reporter.log.Errorf("failed to save task progress: %s", err)
+	}
+}
+
+// readProgress returns the fraction of the readers' input which has been read; readers which
+// aren't ProgressReaders are ignored, and zero is returned if none of them are
+func readProgress(readers ...interface{}) float64 {
+	var consumed, total int64
+	for _, reader := range readers {
+		if pr, ok := reader.(ProgressReader); ok {
+			c, t := pr.Progress()
+			consumed += c
+			total += t
+		}
+	}
+
+	if total <= 0 {
+		return 0
+	} else if consumed >= total {
+		return 1
+	}
+
+	return float64(consumed) / float64(total)
+}
+
+// stageProgress works out how much of a stage is done from its tasks, along with when it should
+// finish if it keeps going at the same rate. Tasks which are done count as all the way through;
+// the others count as far as they've reported. The eta is zero if nothing has been done yet.
+func stageProgress(tasks []JobTask, stageStart time.Time, now time.Time) (fraction float64, eta time.Time) {
+	if len(tasks) == 0 {
+		return 0, time.Time{}
+	}
+
+	for _, task := range tasks {
+		if task.Status == TaskStatusDone {
+			fraction += 1
+		} else {
+			fraction += task.Progress
+		}
+	}
+	fraction /= float64(len(tasks))
+
+	if fraction <= 0 || stageStart.IsZero() {
+		return fraction, time.Time{}
+	}
+
+	elapsed := now.Sub(stageStart)
+	return fraction, now.Add(time.Duration(float64(elapsed) * (1 - fraction) / fraction))
+}
+
+// updateStageProgress saves the progress of the job's current stage into the job
+func updateStageProgress(store JobStore, job JobInfo, log appwrap.Logging) {
+	tasks, err := gatherTasks(store, job)
+	if err != nil {
+		log.Errorf("failed to load tasks for stage progress: %s", err)
+		return
+	}
+
+	fraction, eta := stageProgress(tasks, job.StageStartTime, time.Now())
+	if _, err := store.UpdateJob(job.Id, func(j *JobInfo) error {
+		if j.Stage != job.Stage {
+			// the stage finished while we were looking at it
+			return nil
+		}
+
+		j.StageProgress = fraction
+		j.StageEta = eta
+		return nil
+	}); err != nil {
+		log.Errorf("failed to save stage progress: %s", err)
+	}
+}
+
+// describeStageProgress returns the job's progress through its current stage for the console, or
+// "" if it isn't running tasks
+func describeStageProgress(job JobInfo, now time.Time) string {
+	switch job.Stage {
+	case StageMapping, StageCombining, StageReducing:
+	default:
+		return ""
+	}
+
+	progress := percent(job.StageProgress)
+	if !job.StageEta.IsZero() && job.StageEta.After(now) {
+		progress += fmt.Sprintf(" (about %s left)", job.StageEta.Sub(now)/time.Second*time.Second)
+	}
+
+	return progress
+}
+
+func percent(fraction float64) string {
+	return fmt.Sprintf("%.0f%%", fraction*100)
+}
+
+// countingReadCloser counts the bytes read through it
+type countingReadCloser struct {
+	io.ReadCloser
+	count int64
+}
+
+func (cr *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"os"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) TestFileLineInputReaderProgress(c *ck.C) {
+	info, err := os.Stat("testdata/pandp-1")
+	c.Assert(err, ck.IsNil)
+
+	readHalf := func(name string) (SingleInputReader, float64) {
+		reader, err := FileLineInputReader{}.ReaderFromName(nil, name)
+		c.Assert(err, ck.IsNil)
+		c.Assert(readProgress(reader), ck.Equals, 0.0)
+
+		for readProgress(reader) < 0.5 {
+			line, err := reader.Next()
+			c.Assert(err, ck.IsNil)
+			c.Assert(line, ck.NotNil)
+		}
+
+		return reader, readProgress(reader)
+	}
+
+	reader, half := readHalf("testdata/pandp-1")
+	defer reader.Close()
+	consumed, total := reader.(ProgressReader).Progress()
+	c.Assert(total, ck.Equals, info.Size())
+	c.Assert(half < 0.51, ck.Equals, true)
+
+	for line, err := reader.Next(); line != nil; line, err = reader.Next() {
+		c.Assert(err, ck.IsNil)
+	}
+	c.Assert(readProgress(reader), ck.Equals, 1.0)
+
+	// pieces of files are measured against the size of the piece
+	piece, half := readHalf(fileRangeName("testdata/pandp-1", 1000, 11000))
+	defer piece.Close()
+	consumed, total = piece.(ProgressReader).Progress()
+	c.Assert(total, ck.Equals, int64(10000))
+	c.Assert(consumed >= 5000 && consumed < 5100, ck.Equals, true)
+	c.Assert(half < 0.51, ck.Equals, true)
+
+	// readers which can't say contribute nothing
+	c.Assert(readProgress(SingleLineReader{}, &arrayIterator{data: make([]MappedData, 4), nextIndex: 1}), ck.Equals, 0.25)
+	c.Assert(readProgress(SingleLineReader{}), ck.Equals, 0.0)
+}
+
+func (mrt *MapreduceTests) TestReportProgress(c *ck.C) {
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}})
+	c.Assert(err, ck.IsNil)
+	taskId, err := store.AllocateTaskIds(1)
+	c.Assert(err, ck.IsNil)
+	c.Assert(createTasks(store, jobId, []int64{taskId}, []JobTask{{Status: TaskStatusRunning, Type: TaskTypeMap}}, StageMapping, mrt.nullLog), ck.IsNil)
+
+	checkTask := func(progress float64, records int64) {
+		task, err := store.GetTask(taskId)
+		c.Assert(err, ck.IsNil)
+		c.Assert(task.Progress, ck.Equals, progress)
+		c.Assert(task.ProgressRecords, ck.Equals, records)
+	}
+
+	// nothing happens without a reporter
+	reportProgress(appwrap.StubContext(), 0.5, 10)
+	checkTask(0, 0)
+
+	reporter := newProgressReporter(store, taskId, mrt.nullLog)
+	ctx := withProgressReporter(appwrap.StubContext(), reporter)
+
+	// too soon after the task started
+	reportProgress(ctx, 0.25, 10)
+	checkTask(0, 0)
+
+	reporter.interval = 0
+	reportProgress(ctx, 0.5, 20)
+	checkTask(0.5, 20)
+
+	reporter.interval = time.Hour
+	reportProgress(ctx, 0.75, 30)
+	checkTask(0.5, 20)
+
+	// finishing the task stops progress reports from a slower attempt
+	_, won, err := completeTask(store, taskId, false, "done", nil)
+	c.Assert(err, ck.IsNil)
+	c.Assert(won, ck.Equals, true)
+	reporter.interval = 0
+	reportProgress(ctx, 0.75, 30)
+	checkTask(1, 20)
+}
+
+func (mrt *MapreduceTests) TestStageProgress(c *ck.C) {
+	start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start.Add(10 * time.Minute)
+
+	fraction, eta := stageProgress(nil, start, now)
+	c.Assert(fraction, ck.Equals, 0.0)
+	c.Assert(eta.IsZero(), ck.Equals, true)
+
+	fraction, eta = stageProgress([]JobTask{{Status: TaskStatusRunning}, {Status: TaskStatusPending}}, start, now)
+	c.Assert(fraction, ck.Equals, 0.0)
+	c.Assert(eta.IsZero(), ck.Equals, true)
+
+	tasks := []JobTask{
+		{Status: TaskStatusDone, Progress: 1},
+		{Status: TaskStatusRunning, Progress: 0.5},
+		{Status: TaskStatusRunning, Progress: 0.5},
+		{Status: TaskStatusPending},
+	}
+	fraction, eta = stageProgress(tasks, start, now)
+	c.Assert(fraction, ck.Equals, 0.5)
+	c.Assert(eta, ck.Equals, now.Add(10*time.Minute))
+
+	job := JobInfo{Stage: StageMapping, StageProgress: fraction, StageEta: eta}
+	c.Assert(describeStageProgress(job, now), ck.Equals, "50% (about 10m0s left)")
+	job.StageEta = time.Time{}
+	c.Assert(describeStageProgress(job, now), ck.Equals, "50%")
+	job.Stage = StageDone
+	c.Assert(describeStageProgress(job, now), ck.Equals, "")
+
+	// the monitor saves the progress into the job
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}})
+	c.Assert(err, ck.IsNil)
+	firstId, err := store.AllocateTaskIds(len(tasks))
+	c.Assert(err, ck.IsNil)
+	c.Assert(createTasks(store, jobId, makeTaskIds(firstId, len(tasks)), tasks, StageMapping, mrt.nullLog), ck.IsNil)
+
+	job, err = store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.StageStartTime.IsZero(), ck.Equals, false)
+	updateStageProgress(store, job, mrt.nullLog)
+
+	job, err = store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(job.StageProgress, ck.Equals, 0.5)
+	c.Assert(job.StageEta.After(job.StageStartTime), ck.Equals, true)
+}
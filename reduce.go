@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"github.com/pendo-io/appwrap"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -30,13 +29,16 @@ import (
 	"time"
 )
 
-func reduceMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapReducePipeline, jobKey *datastore.Key, r *http.Request, timeout time.Duration, log appwrap.Logging) int {
+func reduceMonitorTask(c context.Context, store JobStore, pipeline MapReducePipeline, jobId int64, r *http.Request, timeout time.Duration, log appwrap.Logging) int {
 	start := time.Now()
 
-	job, err := waitForStageCompletion(c, ds, pipeline, jobKey, StageReducing, StageDone, timeout, log)
+	job, err := waitForStageCompletion(c, store, pipeline, jobId, StageReducing, StageDone, timeout, log)
 	if err != nil {
 		log.Criticalf("waitForStageCompletion() failed: %S", err)
 		return 200
+	} else if job.Stage == StageCancelled {
+		jobCancelled(c, store, pipeline, job, log)
+		return 200
 	} else if job.Stage == StageReducing {
 		log.Infof("wait timed out -- returning an error and letting us automatically restart")
 
@@ -44,18 +46,25 @@ func reduceMonitorTask(c context.Context, ds appwrap.Datastore, pipeline MapRedu
 	}
 
 	log.Infof("reduce complete status: %s", job.Stage)
-	if job.OnCompleteUrl != "" {
-		successUrl := fmt.Sprintf("%s?status=%s;id=%d", job.OnCompleteUrl, TaskStatusDone, jobKey.IntID())
-		log.Infof("posting complete status to url %s", successUrl)
-		pipeline.PostStatus(c, successUrl, log)
-	}
+	jobComplete(c, pipeline, job, log)
 
 	log.Infof("reduction complete after %s of monitoring ", time.Now().Sub(start))
 
 	return 200
 }
 
-func reduceTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapReducePipeline, taskKey *datastore.Key, w http.ResponseWriter, r *http.Request, log appwrap.Logging) {
+// jobComplete posts to the OnCompleteUrl for a job which finished successfully
+func jobComplete(c context.Context, taskIntf TaskInterface, job JobInfo, log appwrap.Logging) {
+	if job.OnCompleteUrl != "" {
+		successUrl := fmt.Sprintf("%s?status=%s&id=%d", job.OnCompleteUrl, TaskStatusDone, job.Id)
+		log.Infof("posting complete status to url %s", successUrl)
+		taskIntf.PostStatus(c, successUrl, log)
+	}
+
+	removeJobIntermediates(c, taskIntf, job.Id, log)
+}
+
+func reduceTask(c context.Context, store JobStore, baseUrl string, mr MapReducePipeline, taskId int64, w http.ResponseWriter, r *http.Request, log appwrap.Logging) {
 	var writer SingleOutputWriter
 	var task JobTask
 	var err error
@@ -67,7 +76,16 @@ func reduceTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapR
 	// the task status callback is invoked
 	mr.SetReduceParameters(r.FormValue("json"))
 
-	if task, err, retry = startTask(c, ds, mr, taskKey, log); err != nil && retry {
+	if task, err, retry = startTask(c, store, mr, taskId, log); err == errJobCancelled {
+		log.Infof("job has been cancelled; not running task")
+		return
+	} else if err == errJobPaused {
+		log.Infof("job is paused; task deferred")
+		return
+	} else if err == errTaskAlreadyDone {
+		log.Infof("task has already been completed")
+		return
+	} else if err != nil && retry {
 		log.Criticalf("failed updating task to running: %s", err)
 		http.Error(w, err.Error(), 500) // this will run us again
 		return
@@ -77,19 +95,25 @@ func reduceTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapR
 		return
 	}
 
+	c, stopWatching := watchForCancel(c, store, task.JobId, log)
+	defer stopWatching()
+	c = withJobId(c, task.JobId)
+
 	defer func() {
 		if r := recover(); r != nil {
 			stack := make([]byte, 16384)
 			bytes := runtime.Stack(stack, false)
-			log.Criticalf("panic inside of reduce task %s: %s\n%s\n", taskKey.Encode(), r, stack[0:bytes])
+			log.Criticalf("panic inside of reduce task %d: %s\n%s\n", taskId, r, stack[0:bytes])
 
-			if err := retryTask(c, ds, mr, task.Job, taskKey, log); err != nil {
+			if err := retryTask(c, store, mr, task.JobId, taskId, log); err != nil {
 				panic(fmt.Errorf("failed to retry task after panic: %s", err))
 			}
 		}
 	}()
 
 	var finalErr error
+	counters := NewCounters()
+	c = withProgressReporter(c, newProgressReporter(store, taskId, log))
 	if writerName := r.FormValue("writer"); writerName == "" {
 		finalErr = fmt.Errorf("writer parameter required")
 	} else if writer, err = mr.WriterFromName(c, writerName); err != nil {
@@ -102,13 +126,13 @@ func reduceTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapR
 		var shards []string
 		json.Unmarshal(shardJson, &shards)
 
-		finalErr = ReduceFunc(c, mr, writer, shards, task.SeparateReduceItems,
-			makeStatusUpdateFunc(c, ds, mr, fmt.Sprintf("%s/reducestatus", baseUrl), taskKey.Encode(), log), log)
+		finalErr = reduceFunc(c, mr, writer, shards, task.SeparateReduceItems,
+			makeStatusUpdateFunc(c, store, mr, fmt.Sprintf("%s/reducestatus", baseUrl), taskId, log), counters, log)
 	}
 
 	writer.Close(c)
 
-	if err := endTask(c, ds, mr, task.Job, taskKey, finalErr, writer.ToName(), log); err != nil {
+	if err := endTask(c, store, mr, task.JobId, taskId, finalErr, writer.ToName(), counters, log); err != nil {
 		log.Criticalf("Could not finish task: %s", err)
 		http.Error(w, err.Error(), 500)
 		return
@@ -120,6 +144,14 @@ func reduceTask(c context.Context, ds appwrap.Datastore, baseUrl string, mr MapR
 func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWriter, shardNames []string,
 	separateReduceItems bool, statusFunc StatusUpdateFunc, log appwrap.Logging) error {
 
+	return reduceFunc(c, mr, writer, shardNames, separateReduceItems, statusFunc, nil, log)
+}
+
+// reduceFunc is ReduceFunc, keeping the built in reduce counters in counters (which is also
+// passed to CounterReducers, CounterStreamingReducers and CounterEmitReducers)
+func reduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWriter, shardNames []string,
+	separateReduceItems bool, statusFunc StatusUpdateFunc, counters *Counters, log appwrap.Logging) error {
+
 	merger := newMerger(mr)
 
 	toClose := make([]io.Closer, 0, len(shardNames))
@@ -150,6 +182,7 @@ func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWrit
 
 	wg.Wait()
 
+	sources := make([]interface{}, len(results))
 	for i, result := range results {
 		if result.err != nil {
 			return tryAgainError{fmt.Errorf("cannot open intermediate file %s: %s", shardNames[i], result.err)}
@@ -157,12 +190,28 @@ func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWrit
 
 		merger.addSource(result.iterator)
 		toClose = append(toClose, result.iterator)
+		sources[i] = result.iterator
 	}
 
-	values := make([]interface{}, 1)
-	var key interface{}
+	streamer, streaming := mr.(StreamingReducer)
+	emitter, emitting := mr.(EmitReducer)
+	counterReducer, countingReduce := mr.(CounterReducer)
+	counterStreamer, countingStream := mr.(CounterStreamingReducer)
+	counterEmitter, countingEmit := mr.(CounterEmitReducer)
+
+	var emitErr error
+	emit := func(result interface{}) error {
+		if emitErr == nil {
+			if emitErr = writer.Write(result); emitErr == nil {
+				counters.Increment(CounterReduceOutputRecords, 1)
+			}
+		}
+
+		return emitErr
+	}
 
-	if first, err := merger.next(); err != nil {
+	first, err := merger.next()
+	if err != nil {
 		return err
 	} else if first == nil {
 		log.Infof("No results to process from map")
@@ -174,51 +223,66 @@ func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWrit
 		}
 
 		return nil
-	} else {
-		key = first.Key
-		values[0] = first.Value
 	}
 
-	for !merger.empty() {
-		item, err := merger.next()
-		if err != nil {
-			return tryAgainError{err}
+	var keys int64
+	for first != nil {
+		if jobIsCancelled(c) {
+			// the monitor removes the intermediate files
+			return errJobCancelled
 		}
 
-		if !separateReduceItems && mr.Equal(key, item.Key) {
-			values = append(values, item.Value)
-			continue
+		keys++
+		reportProgress(c, readProgress(sources...), keys)
+
+		values := &reduceValueIterator{
+			merger:   merger,
+			compare:  mr,
+			key:      first.Key,
+			first:    first,
+			separate: separateReduceItems,
+		}
+
+		counters.Increment(CounterReduceInputKeys, 1)
+
+		var result interface{}
+		var err error
+		if emitting && countingEmit {
+			err = counterEmitter.ReduceEmitCounters(first.Key, values, emit, statusFunc, counters)
+		} else if emitting {
+			err = emitter.ReduceEmit(first.Key, values, emit, statusFunc)
+		} else if streaming && countingStream {
+			result, err = counterStreamer.ReduceStreamCounters(first.Key, values, statusFunc, counters)
+		} else if streaming {
+			result, err = streamer.ReduceStream(first.Key, values, statusFunc)
+		} else if valueList, listErr := values.all(); listErr != nil {
+			return tryAgainError{listErr}
+		} else if countingReduce {
+			result, err = counterReducer.ReduceCounters(first.Key, valueList, statusFunc, counters)
+		} else {
+			result, err = mr.Reduce(first.Key, valueList, statusFunc)
 		}
 
-		if result, err := mr.Reduce(key, values, statusFunc); err != nil {
+		if emitErr != nil {
+			return tryAgainError{emitErr}
+		} else if err != nil {
 			if _, ok := err.(FatalError); ok {
 				err = err.(FatalError).Err
 			} else {
 				err = tryAgainError{err}
 			}
 			return err
+		} else if err := values.skip(); err != nil {
+			// we need to get past whatever the reducer didn't read to find the next key
+			return tryAgainError{err}
 		} else if result != nil {
 			if err := writer.Write(result); err != nil {
-				return err
+				return tryAgainError{err}
 			}
+			counters.Increment(CounterReduceOutputRecords, 1)
 		}
 
-		key = item.Key
-		values = values[0:1]
-		values[0] = item.Value
-	}
-
-	if result, err := mr.Reduce(key, values, statusFunc); err != nil {
-		if _, ok := err.(FatalError); ok {
-			err = err.(FatalError).Err
-		} else {
-			err = tryAgainError{err}
-		}
-		return err
-	} else if result != nil {
-		if err := writer.Write(result); err != nil {
-			return tryAgainError{err}
-		}
+		first = values.nextKey
 	}
 
 	if results, err := mr.ReduceComplete(statusFunc); err != nil {
@@ -229,6 +293,7 @@ func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWrit
 				return tryAgainError{err}
 			}
 		}
+		counters.Increment(CounterReduceOutputRecords, int64(len(results)))
 	}
 
 	for _, shardName := range shardNames {
@@ -239,3 +304,67 @@ func ReduceFunc(c context.Context, mr MapReducePipeline, writer SingleOutputWrit
 
 	return nil
 }
+
+// reduceValueIterator returns values from the merger until the key changes; the first item with
+// the new key is saved in nextKey
+type reduceValueIterator struct {
+	merger   *mappedDataMerger
+	compare  KeyHandler
+	key      interface{}
+	first    *MappedData
+	separate bool
+	done     bool
+	err      error
+	nextKey  *MappedData
+}
+
+func (vi *reduceValueIterator) Next() (interface{}, bool, error) {
+	if vi.first != nil {
+		value := vi.first.Value
+		vi.first = nil
+		return value, true, nil
+	} else if vi.done {
+		return nil, false, vi.err
+	} else if vi.separate {
+		// each item gets its own call to reduce, so there is only ever one value
+		vi.done = true
+		vi.nextKey, vi.err = vi.merger.next()
+		return nil, false, vi.err
+	}
+
+	item, err := vi.merger.next()
+	if err != nil {
+		vi.done = true
+		vi.err = err
+		return nil, false, err
+	} else if item == nil || !vi.compare.Equal(vi.key, item.Key) {
+		vi.done = true
+		vi.nextKey = item
+		return nil, false, nil
+	}
+
+	return item.Value, true, nil
+}
+
+// all returns all of the values which haven't been read yet
+func (vi *reduceValueIterator) all() ([]interface{}, error) {
+	values := make([]interface{}, 0, 1)
+	for {
+		if value, ok, err := vi.Next(); err != nil {
+			return nil, err
+		} else if !ok {
+			return values, nil
+		} else {
+			values = append(values, value)
+		}
+	}
+}
+
+// skip discards the values which haven't been read yet
+func (vi *reduceValueIterator) skip() error {
+	for {
+		if _, ok, err := vi.Next(); err != nil || !ok {
+			return err
+		}
+	}
+}
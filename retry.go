@@ -0,0 +1,179 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// RetryJob restarts a failed or cancelled job which keeps its state in the appengine datastore
+func RetryJob(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobId int64) error {
+	return RetryJobWithStore(c, NewDatastoreJobStore(c, ds), taskIntf, jobId, appwrap.NewAppengineLogging(c))
+}
+
+// RetryJobWithStore restarts a job which failed or was cancelled. The intermediate files are
+// removed when a job stops, so the job starts over from the map stage: its map tasks are reset
+// and posted through taskIntf (which must post to the job's MapReduceHandler) along with a new
+// map monitor, and the combine and reduce tasks from the earlier attempt are removed. The
+// counters and timings are reset, but the range boundaries of TotalOrder jobs are kept. Jobs
+// started by RunChain, or before map task ids were recorded in MapTaskIds, can't be retried
+// this way. The job is moved to StageFormation before any of its tasks are touched, which keeps
+// two retries of the same job from running at once.
+func RetryJobWithStore(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, log appwrap.Logging) error {
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		return err
+	} else if job.Stage != StageFailed && job.Stage != StageCancelled {
+		return fmt.Errorf("job %d is %s; only failed or cancelled jobs can be retried", jobId, job.Stage)
+	} else if job.ChainId != 0 {
+		return fmt.Errorf("job %d is part of chain %d and can't be retried on its own", jobId, job.ChainId)
+	} else if len(job.MapTaskIds) == 0 {
+		return fmt.Errorf("job %d has no record of its map tasks", jobId)
+	}
+
+	// the monitor expects each stage's task ids to be consecutive, which they are since they're
+	// allocated together
+	mapTaskIds := job.MapTaskIds
+	for i := range mapTaskIds {
+		if mapTaskIds[i] != mapTaskIds[0]+int64(i) {
+			return fmt.Errorf("job %d has map task ids which aren't consecutive", jobId)
+		}
+	}
+
+	mapTasks, err := store.GetTasks(mapTaskIds)
+	if err != nil {
+		return fmt.Errorf("loading map tasks: %s", err)
+	}
+
+	tasks, err := store.JobTasks(jobId)
+	if err != nil {
+		return fmt.Errorf("loading tasks: %s", err)
+	}
+
+	isMapTask := make(map[int64]bool, len(mapTaskIds))
+	for _, id := range mapTaskIds {
+		isMapTask[id] = true
+	}
+
+	staleIds := []int64{}
+	for _, task := range tasks {
+		if !isMapTask[task.Id] {
+			staleIds = append(staleIds, task.Id)
+		}
+	}
+
+	// claim the job before touching its tasks, so a second retry (or anything else which changed
+	// the job since it was loaded) can't reset them out from under the first
+	stage := job.Stage
+	if _, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+		if job.Stage != StageFailed && job.Stage != StageCancelled {
+			// someone else retried it first
+			return fmt.Errorf("job %d is already %s", jobId, job.Stage)
+		}
+
+		job.Stage = StageFormation
+		job.UpdatedAt = time.Now()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := resetForRetry(store, mapTasks, staleIds, now); err != nil {
+		// put the job back so it can be retried again
+		if _, stageErr := store.UpdateJob(jobId, func(job *JobInfo) error {
+			job.Stage = stage
+			job.UpdatedAt = time.Now()
+			return nil
+		}); stageErr != nil {
+			log.Errorf("failed to return job %d to %s: %s", jobId, stage, stageErr)
+		}
+
+		return err
+	}
+
+	job, err = store.UpdateJob(jobId, func(job *JobInfo) error {
+		if job.Stage != StageFormation {
+			return fmt.Errorf("job %d became %s while it was being retried", jobId, job.Stage)
+		}
+
+		job.Stage = StageMapping
+		job.Paused = false
+		job.FirstTaskId = mapTaskIds[0]
+		job.TaskCount = len(mapTaskIds)
+		job.Counters = ""
+		job.StartTime = now
+		job.StageStartTime = now
+		job.StageProgress = 0
+		job.StageEta = time.Time{}
+		job.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("retrying job %d with %d map tasks", jobId, len(mapTasks))
+
+	for _, task := range mapTasks {
+		if err := taskIntf.PostTask(c, task.Url, job.JsonParameters, log); err != nil {
+			return fmt.Errorf("posting task %d: %s", task.Id, err)
+		}
+	}
+
+	if err := taskIntf.PostStatus(c, fmt.Sprintf("%s/map-monitor?jobId=%d", job.UrlPrefix, jobId), log); err != nil {
+		return fmt.Errorf("starting map monitor: %s", err)
+	}
+
+	return nil
+}
+
+// resetForRetry puts a job's map tasks back the way they were before they first ran, and removes
+// the job's other tasks (the combine and reduce tasks are created again once the maps are done)
+func resetForRetry(store JobStore, mapTasks []JobTask, staleIds []int64, now time.Time) error {
+	for _, task := range mapTasks {
+		if _, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+			task.Status = TaskStatusPending
+			task.Retries = 0
+			task.Info = ""
+			task.Result = ""
+			task.Checkpoint = ""
+			task.Deferred = false
+			task.Speculated = false
+			task.SpeculativeWon = false
+			task.Counters = ""
+			task.Progress = 0
+			task.ProgressRecords = 0
+			task.StartTime = now
+			task.UpdatedAt = now
+			// Intermediates are left alone; the task removes whatever is left of them when it starts
+			return nil
+		}); err != nil {
+			return fmt.Errorf("resetting task %d: %s", task.Id, err)
+		}
+	}
+
+	if len(staleIds) > 0 {
+		if err := store.RemoveTasks(staleIds); err != nil {
+			return fmt.Errorf("removing combine and reduce tasks: %s", err)
+		}
+	}
+
+	return nil
+}
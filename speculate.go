@@ -0,0 +1,235 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// how often the map monitor looks for slow tasks when SpeculativeExecution is set
+var speculationCheckInterval = 30 * time.Second
+
+// a map task is duplicated once it has been running this many times longer than the median map
+// task took, and at least speculationMinRuntime
+var speculationSlowdown = 3.0
+var speculationMinRuntime = time.Minute
+
+// speculation waits until at least this fraction of the map tasks are done, so the median means
+// something
+var speculationMinDone = 0.5
+
+// speculate starts a second attempt for each map task which is running far longer than the
+// median of the map tasks which are done. Each task is only duplicated once. Reduce tasks are
+// left alone (see MapReduceJob.SpeculativeExecution).
+func speculate(c context.Context, store JobStore, taskIntf TaskInterface, job JobInfo, log appwrap.Logging) {
+	tasks, err := gatherTasks(store, job)
+	if err != nil {
+		log.Errorf("failed to load tasks for speculative execution: %s", err)
+		return
+	}
+
+	threshold, ok := speculationThreshold(tasks, TaskTypeMap)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for _, task := range tasks {
+		if task.Type != TaskTypeMap || task.Status != TaskStatusRunning || task.Speculated || now.Sub(task.StartTime) < threshold {
+			continue
+		}
+
+		started := false
+		if _, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+			if started = task.Status == TaskStatusRunning && !task.Speculated; started {
+				task.Speculated = true
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("failed to mark task %d speculated: %s", task.Id, err)
+		} else if !started {
+			continue
+		} else if err := taskIntf.PostTask(c, task.Url+"&speculative=1", job.JsonParameters, log); err != nil {
+			log.Errorf("failed to start speculative attempt for task %d: %s", task.Id, err)
+		} else {
+			log.Infof("task %d has been running for %s; started a speculative attempt", task.Id, now.Sub(task.StartTime))
+		}
+	}
+}
+
+// speculationThreshold returns how long tasks of the given type can run before they're
+// duplicated; ok is false if not enough of them are done yet
+func speculationThreshold(tasks []JobTask, taskType TaskType) (threshold time.Duration, ok bool) {
+	durations := []time.Duration{}
+	total := 0
+	for _, task := range tasks {
+		if task.Type != taskType {
+			continue
+		}
+
+		total++
+		if task.Status == TaskStatusDone {
+			durations = append(durations, task.UpdatedAt.Sub(task.StartTime))
+		}
+	}
+
+	if len(durations) == 0 || float64(len(durations)) < speculationMinDone*float64(total) {
+		return 0, false
+	}
+
+	sort.Sort(durationList(durations))
+	threshold = time.Duration(float64(durations[len(durations)/2]) * speculationSlowdown)
+	if threshold < speculationMinRuntime {
+		threshold = speculationMinRuntime
+	}
+
+	return threshold, true
+}
+
+type durationList []time.Duration
+
+func (a durationList) Len() int           { return len(a) }
+func (a durationList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a durationList) Less(i, j int) bool { return a[i] < a[j] }
+
+// speculativeMapTask runs a second attempt at a map task which is still running. It doesn't change
+// the task's status unless it finishes first, and it gives up quietly if it fails, leaving the
+// task to its original attempt.
+func speculativeMapTask(c context.Context, store JobStore, baseUrl string, mr MapReducePipeline, taskId int64, r *http.Request, log appwrap.Logging) {
+	start := time.Now()
+
+	task, err := store.GetTask(taskId)
+	if err != nil {
+		log.Errorf("failed to load task for speculative attempt: %s", err)
+		return
+	}
+
+	job, err := store.GetJob(task.JobId)
+	if err != nil {
+		log.Errorf("failed to load job for speculative attempt: %s", err)
+		return
+	} else if job.Stage != StageMapping || job.Paused || task.Status != TaskStatusRunning {
+		log.Infof("task is %s and job is %s; skipping speculative attempt", task.Status, job.Stage)
+		return
+	}
+
+	c, stopWatching := watchForCancel(c, store, task.JobId, log)
+	defer stopWatching()
+	c = withJobId(c, task.JobId)
+
+	tracker := newIntermediateTracker(store, task, true)
+	c = withIntermediateTracker(c, tracker)
+	giveUp := func(err error) {
+		log.Infof("speculative attempt failed: %s", err)
+		if err := tracker.removeExcept(c, mr, nil, log); err != nil {
+			log.Errorf("failed to remove intermediate files: %s", err)
+		}
+	}
+
+	// anything left over is from an earlier delivery of this attempt
+	if err := tracker.removeExcept(c, mr, nil, log); err != nil {
+		log.Errorf("failed to remove intermediate files: %s", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 16384)
+			bytes := runtime.Stack(stack, false)
+			log.Criticalf("panic inside of speculative map task %d: %s\n%s\n", taskId, r, stack[0:bytes])
+			giveUp(fmt.Errorf("panic: %s", r))
+		}
+	}()
+
+	statusFunc := makeStatusUpdateFunc(c, store, mr, fmt.Sprintf("%s/mapstatus", baseUrl), taskId, log)
+
+	shardCount, err := strconv.ParseInt(r.FormValue("shards"), 10, 32)
+	if err != nil {
+		giveUp(fmt.Errorf("error parsing shard count: %s", err))
+		return
+	}
+
+	sharder, err := newKeySharder(mr, job)
+	if err != nil {
+		giveUp(err)
+		return
+	}
+
+	reader, err := mr.ReaderFromName(c, r.FormValue("reader"))
+	if err != nil {
+		giveUp(fmt.Errorf("error making reader: %s", err))
+		return
+	}
+
+	// checkpoints belong to the original attempt, so this one starts at the beginning
+	counters := NewCounters()
+	mapped, err := mapperFunc(c, mr, reader, newMapperOptions(job, int(shardCount), sharder, nil, counters), statusFunc, log)
+	if err != nil {
+		giveUp(err)
+		return
+	} else if err := tracker.removeExcept(c, mr, mapped.Names, log); err != nil {
+		giveUp(err)
+		return
+	}
+
+	if task, won, err := completeTask(store, taskId, true, mapped, counters); err != nil {
+		giveUp(fmt.Errorf("could not update task: %s", err))
+	} else if !won {
+		giveUp(fmt.Errorf("original attempt finished first"))
+	} else {
+		log.Infof("speculative attempt finished first after %s", time.Now().Sub(start))
+		mr.Status(task.JobId, task)
+	}
+}
+
+// removeSpeculativeLosers removes the intermediate files written by the attempts which didn't
+// finish first for map tasks which were duplicated. Attempts which are still running remove their
+// own files when they finish.
+func removeSpeculativeLosers(c context.Context, store JobStore, intStorage IntermediateStorage, tasks []JobTask, log appwrap.Logging) {
+	for _, task := range tasks {
+		if !task.Speculated {
+			continue
+		}
+
+		losers := task.SpeculativeIntermediates
+		if task.SpeculativeWon {
+			losers = task.Intermediates
+		}
+
+		for _, name := range losers {
+			if err := intStorage.RemoveIntermediate(c, name); err != nil {
+				log.Errorf("failed to remove intermediate file %s: %s", name, err)
+			}
+		}
+
+		if _, err := store.UpdateTask(task.Id, func(task *JobTask) error {
+			if task.SpeculativeWon {
+				task.Intermediates = nil
+			} else {
+				task.SpeculativeIntermediates = nil
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("failed to update task %d: %s", task.Id, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) TestSpeculationThreshold(c *ck.C) {
+	now := time.Now()
+	task := func(status TaskStatus, taskType TaskType, duration time.Duration) JobTask {
+		return JobTask{Status: status, Type: taskType, StartTime: now.Add(-duration), UpdatedAt: now}
+	}
+
+	tasks := []JobTask{
+		task(TaskStatusDone, TaskTypeMap, 10*time.Minute),
+		task(TaskStatusDone, TaskTypeMap, 20*time.Minute),
+		task(TaskStatusRunning, TaskTypeMap, 0),
+		task(TaskStatusRunning, TaskTypeMap, 0),
+		task(TaskStatusDone, TaskTypeReduce, time.Second),
+	}
+
+	// only two of the four maps are done
+	threshold, ok := speculationThreshold(tasks, TaskTypeMap)
+	c.Assert(ok, ck.Equals, true)
+	c.Assert(threshold, ck.Equals, 60*time.Minute)
+
+	tasks[3] = task(TaskStatusDone, TaskTypeMap, 5*time.Minute)
+	threshold, ok = speculationThreshold(tasks, TaskTypeMap)
+	c.Assert(ok, ck.Equals, true)
+	c.Assert(threshold, ck.Equals, 30*time.Minute)
+
+	// fast tasks don't make the threshold silly
+	threshold, ok = speculationThreshold(tasks, TaskTypeReduce)
+	c.Assert(ok, ck.Equals, true)
+	c.Assert(threshold, ck.Equals, speculationMinRuntime)
+
+	tasks[0].Status = TaskStatusRunning
+	tasks[1].Status = TaskStatusRunning
+	_, ok = speculationThreshold(tasks, TaskTypeMap)
+	c.Assert(ok, ck.Equals, false)
+}
+
+func (mrt *MapreduceTests) TestSpeculativeMapTask(c *ck.C) {
+	store := NewMemoryJobStore()
+	u := newTestCancelPipeline()
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.SpeculativeExecution = true
+	handler := MapReduceStoreHandler("/mr/test", u, mrt.ContextFn, func(context.Context) JobStore { return store }, mrt.LoggerFn)
+
+	serve := func(taskUrl string) {
+		body := strings.NewReader(url.Values{"json": []string{job.JobParameters}}.Encode())
+		req, _ := http.NewRequest("POST", taskUrl, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, ck.Equals, 200)
+	}
+
+	jobId, err := RunWithStore(appwrap.StubContext(), store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	mapUrls := []string{}
+	monitorUrl := ""
+	for _, taskUrl := range u.posted {
+		if strings.Contains(taskUrl, "/map-monitor") {
+			monitorUrl = taskUrl
+		} else {
+			mapUrls = append(mapUrls, taskUrl)
+		}
+	}
+	u.posted = nil
+
+	for _, taskUrl := range mapUrls[:4] {
+		serve(taskUrl)
+	}
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.SpeculativeExecution, ck.Equals, true)
+
+	tasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	straggler := tasks[4]
+
+	// the last map has been running for an hour, and has written a file so far
+	w, err := u.CreateIntermediate(appwrap.StubContext(), u)
+	c.Assert(err, ck.IsNil)
+	w.Close(appwrap.StubContext())
+	_, err = store.UpdateTask(straggler.Id, func(task *JobTask) error {
+		task.Status = TaskStatusRunning
+		task.StartTime = time.Now().Add(-time.Hour)
+		task.Intermediates = []string{w.ToName()}
+		return nil
+	})
+	c.Assert(err, ck.IsNil)
+
+	speculate(appwrap.StubContext(), store, u, info, mrt.nullLog)
+	c.Assert(u.posted, ck.DeepEquals, []string{mapUrls[4] + "&speculative=1"})
+
+	// it's only duplicated once
+	speculate(appwrap.StubContext(), store, u, info, mrt.nullLog)
+	c.Assert(u.posted, ck.HasLen, 1)
+	u.posted = nil
+
+	serve(mapUrls[4] + "&speculative=1")
+
+	straggler, err = store.GetTask(straggler.Id)
+	c.Assert(err, ck.IsNil)
+	c.Assert(straggler.Status, ck.Equals, TaskStatusDone)
+	c.Assert(straggler.SpeculativeWon, ck.Equals, true)
+
+	result, err := parseMapResult(straggler.Result)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(result.Names) > 0, ck.Equals, true)
+	for name := range result.Names {
+		_, exists := u.memoryIntermediateStorage.items[name]
+		c.Check(exists, ck.Equals, true)
+	}
+
+	// the original attempt is retried, but has nothing left to do
+	serve(mapUrls[4])
+	c.Assert(u.posted, ck.HasLen, 0)
+
+	// finishing the map stage removes what the original attempt wrote
+	serve(monitorUrl)
+	_, exists := u.memoryIntermediateStorage.items[w.ToName()]
+	c.Assert(exists, ck.Equals, false)
+
+	reduceUrls := []string{}
+	for _, taskUrl := range u.posted {
+		if strings.Contains(taskUrl, "/reduce-monitor") {
+			monitorUrl = taskUrl
+		} else {
+			reduceUrls = append(reduceUrls, taskUrl)
+		}
+	}
+	c.Assert(reduceUrls, ck.HasLen, 3)
+
+	for _, taskUrl := range reduceUrls {
+		serve(taskUrl)
+	}
+	serve(monitorUrl)
+
+	info, err = store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	expectedLines := strings.Split(strings.TrimRight(string(expected), "\n"), "\n")
+	sort.Strings(expectedLines)
+	c.Assert(u.lines(), ck.DeepEquals, expectedLines)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
+
+func (mrt *MapreduceTests) TestCompleteTaskOnce(c *ck.C) {
+	store := NewMemoryJobStore()
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "/mr/test", WriterNames: []string{"output"}, RetryCount: 5})
+	c.Assert(err, ck.IsNil)
+	taskId, err := store.AllocateTaskIds(1)
+	c.Assert(err, ck.IsNil)
+	c.Assert(createTasks(store, jobId, []int64{taskId}, []JobTask{{Status: TaskStatusRunning, Type: TaskTypeMap}}, StageMapping, mrt.nullLog), ck.IsNil)
+
+	task, won, err := completeTask(store, taskId, true, map[string]int{"first": 0}, nil)
+	c.Assert(err, ck.IsNil)
+	c.Assert(won, ck.Equals, true)
+	c.Assert(task.SpeculativeWon, ck.Equals, true)
+
+	_, won, err = completeTask(store, taskId, false, map[string]int{"second": 0}, nil)
+	c.Assert(err, ck.IsNil)
+	c.Assert(won, ck.Equals, false)
+
+	task, err = store.GetTask(taskId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(task.Result, ck.Equals, `{"first":0}`)
+	c.Assert(task.SpeculativeWon, ck.Equals, true)
+}
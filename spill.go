@@ -17,7 +17,6 @@ package mapreduce
 import (
 	"bytes"
 	"compress/gzip"
-	"encoding/binary"
 	"fmt"
 	"github.com/pendo-io/appwrap"
 	"golang.org/x/net/context"
@@ -28,6 +27,24 @@ import (
 type spillStruct struct {
 	contents      []byte
 	linesPerShard []int
+	names         []string // the intermediate file for each shard if the spill was persisted
+}
+
+// SpillPersister is implemented by pipelines whose map tasks should write their spills to
+// intermediate storage instead of holding them in memory until the task is done. That costs
+// an extra intermediate file for every shard of every spill, but keeps the memory map tasks
+// need independent of the size of their output.
+type SpillPersister interface {
+	PersistSpills() bool
+}
+
+// writeMapSpill writes a spill for a map task, persisting it if the pipeline asks for that
+func writeMapSpill(c context.Context, mr MapReducePipeline, dataSets []mappedDataList) (spillStruct, error) {
+	if persister, ok := mr.(SpillPersister); ok && persister.PersistSpills() {
+		return writePersistentSpill(c, mr, mr, dataSets)
+	}
+
+	return writeSpill(c, mr, dataSets)
 }
 
 func writeSpill(c context.Context, handler KeyValueHandler, dataSets []mappedDataList) (spillStruct, error) {
@@ -42,35 +59,145 @@ func writeSpill(c context.Context, handler KeyValueHandler, dataSets []mappedDat
 		sort.Sort(dataSet)
 
 		for _, item := range dataSet.data {
-			key := handler.KeyDump(item.Key)
-			value, err := handler.ValueDump(item.Value)
-			if err != nil {
-				return spillStruct{}, fmt.Errorf("error dumping item value: %s", err)
+			// since these writes are going into a byte buffer the only thing which can fail
+			// is dumping the value
+			if err := writeRecord(writer, handler, item); err != nil {
+				return spillStruct{}, err
 			}
+		}
 
-			// since these writes are going into a byte buffer they can't really fail
+		spill.linesPerShard[i] = len(dataSets[i].data)
+	}
 
-			if key == nil {
-				binary.Write(writer, binary.LittleEndian, int32(-1))
-				key = []byte{}
-			} else {
-				binary.Write(writer, binary.LittleEndian, int32(len(key)))
+	writer.Close()
+	spill.contents = buf.Bytes()
+
+	return spill, nil
+}
+
+// writePersistentSpill is like writeSpill, but writes each shard of the spill to its own
+// intermediate file; removeSpills cleans them up
+func writePersistentSpill(c context.Context, intStorage IntermediateStorage, handler KeyValueHandler, dataSets []mappedDataList) (spillStruct, error) {
+	spill := spillStruct{
+		linesPerShard: make([]int, len(dataSets)),
+		names:         make([]string, 0, len(dataSets)),
+	}
+
+	for i, dataSet := range dataSets {
+		sort.Sort(dataSet)
+
+		w, err := intStorage.CreateIntermediate(c, handler)
+		if err != nil {
+			removeSpills(c, intStorage, []spillStruct{spill}, appwrap.NullLogger{})
+			return spillStruct{}, fmt.Errorf("failed to create spill file: %s", err)
+		}
+		trackIntermediate(c, w.ToName())
+
+		for _, item := range dataSet.data {
+			if err := w.WriteMappedData(item); err != nil {
+				w.Close(c)
+				removeSpills(c, intStorage, []spillStruct{spill}, appwrap.NullLogger{})
+				return spillStruct{}, fmt.Errorf("error writing spill: %s", err)
 			}
+		}
 
-			binary.Write(writer, binary.LittleEndian, int32(len(value)))
-			writer.Write(key)
-			writer.Write(value)
+		if err := w.Close(c); err != nil {
+			removeSpills(c, intStorage, []spillStruct{spill}, appwrap.NullLogger{})
+			return spillStruct{}, fmt.Errorf("failed to close spill file: %s", err)
 		}
 
+		spill.names = append(spill.names, w.ToName())
 		spill.linesPerShard[i] = len(dataSets[i].data)
 	}
 
-	writer.Close()
-	spill.contents = buf.Bytes()
-
 	return spill, nil
 }
 
+// dumpedSize returns the total size of the dumped keys and values in dataSets
+func dumpedSize(handler KeyValueHandler, dataSets []mappedDataList) int64 {
+	size := int64(0)
+	for _, dataSet := range dataSets {
+		for _, item := range dataSet.data {
+			// values which can't be dumped have already failed the spill
+			value, _ := handler.ValueDump(item.Value)
+			size += int64(len(handler.KeyDump(item.Key)) + len(value))
+		}
+	}
+
+	return size
+}
+
+// removeSpills removes the intermediate files for any persisted spills
+func removeSpills(c context.Context, intStorage IntermediateStorage, spills []spillStruct, log appwrap.Logging) {
+	for _, spill := range spills {
+		for _, name := range spill.names {
+			if err := intStorage.RemoveIntermediate(c, name); err != nil {
+				log.Errorf("failed to remove spill file: %s", err.Error())
+			} else {
+				untrackIntermediate(c, name)
+			}
+		}
+	}
+}
+
+// withoutCombiner hides a KeyValueHandler's Combiner (if it has one) so nothing gets combined
+type withoutCombiner struct {
+	KeyValueHandler
+}
+
+// combineDataSets sorts each of the data sets and collapses the values for equal keys using
+// the handler's Combiner. It does nothing if the handler doesn't implement Combiner.
+func combineDataSets(handler KeyValueHandler, dataSets []mappedDataList) error {
+	combiner, ok := handler.(Combiner)
+	if !ok {
+		return nil
+	}
+
+	for i := range dataSets {
+		sort.Sort(dataSets[i])
+
+		if data, err := combineMappedData(combiner, handler, dataSets[i].data); err != nil {
+			return err
+		} else {
+			dataSets[i].data = data
+		}
+	}
+
+	return nil
+}
+
+// combineMappedData combines runs of equal keys in a sorted list, reusing the list's storage
+func combineMappedData(combiner Combiner, compare KeyHandler, data []MappedData) ([]MappedData, error) {
+	combined := data[0:0]
+	values := make([]interface{}, 0)
+
+	for first := 0; first < len(data); {
+		last := first + 1
+		for last < len(data) && compare.Equal(data[first].Key, data[last].Key) {
+			last++
+		}
+
+		if last-first == 1 {
+			combined = append(combined, data[first])
+		} else {
+			values = values[0:0]
+			for i := first; i < last; i++ {
+				values = append(values, data[i].Value)
+			}
+
+			if value, err := combiner.Combine(data[first].Key, values); err != nil {
+				return nil, err
+			} else {
+				combined = append(combined, MappedData{Key: data[first].Key, Value: value})
+			}
+		}
+
+		first = last
+	}
+
+	return combined, nil
+}
+
 type spillIterator struct {
 	r             io.ReadCloser
 	lineCount     int
@@ -86,32 +213,9 @@ func (si *spillIterator) Next() (MappedData, bool, error) {
 
 	si.lineCount++
 
-	var keyLen, valueLen int32
-
-	if err := binary.Read(si.r, binary.LittleEndian, &keyLen); err != nil {
-		return MappedData{}, false, fmt.Errorf("error reading spill key length: %s", err)
-	} else if err := binary.Read(si.r, binary.LittleEndian, &valueLen); err != nil {
-		return MappedData{}, false, fmt.Errorf("error reading spill value length: %s", err)
-	}
-
-	keyBytes := []byte{}
-	if keyLen > 0 {
-		keyBytes = make([]byte, keyLen)
-	}
-	valueBytes := make([]byte, valueLen)
-
-	var m MappedData
-
-	if _, err := io.ReadFull(si.r, keyBytes); err != nil {
-		return MappedData{}, false, fmt.Errorf("error reading spill key: %s", err)
-	} else if _, err := io.ReadFull(si.r, valueBytes); err != nil {
-		return MappedData{}, false, fmt.Errorf("error reading spill value: %s", err)
-	} else if m.Value, err = si.handler.ValueLoad(valueBytes); err != nil {
-		return MappedData{}, false, fmt.Errorf("error loading spill value: %s", err)
-	} else if keyLen == -1 {
-		m.Key = m.Value
-	} else if m.Key, err = si.handler.KeyLoad(keyBytes); err != nil {
-		return MappedData{}, false, fmt.Errorf("error loading spill key: %s", err)
+	m, err := readRecord(si.r, si.handler)
+	if err != nil {
+		return MappedData{}, false, fmt.Errorf("error reading spill: %s", err)
 	}
 
 	return m, true, nil
@@ -150,44 +254,79 @@ func newSpillIterator(contents []byte, linesPerShard []int, handler KeyValueHand
 }
 
 type spillMerger struct {
+	c          context.Context
+	spills     []spillStruct
 	spillIters []spillIterator
 	nextShard  int
 	shardCount int
 	handler    KeyValueHandler
+	intStorage IntermediateStorage
+
+	// iterators for the current shard of persisted spills
+	shardIters []IntermediateStorageIterator
 }
 
-func spillSetMerger(c context.Context, spills []spillStruct, handler KeyValueHandler) (*spillMerger, error) {
+func spillSetMerger(c context.Context, intStorage IntermediateStorage, spills []spillStruct, handler KeyValueHandler) (*spillMerger, error) {
 	if len(spills) == 0 {
 		return nil, nil
 	}
 
 	merger := &spillMerger{
+		c:          c,
+		spills:     spills,
 		spillIters: make([]spillIterator, len(spills)),
 		shardCount: len(spills[0].linesPerShard),
 		handler:    handler,
+		intStorage: intStorage,
 	}
 
 	for spill := range spills {
-		merger.spillIters[spill] = newSpillIterator(spills[spill].contents, spills[spill].linesPerShard, handler)
+		if spills[spill].names == nil {
+			merger.spillIters[spill] = newSpillIterator(spills[spill].contents, spills[spill].linesPerShard, handler)
+		}
 	}
 
 	return merger, nil
 }
 
+// closeShard closes the iterators for the current shard of the persisted spills
+func (merger *spillMerger) closeShard() {
+	for _, iter := range merger.shardIters {
+		iter.Close()
+	}
+
+	merger.shardIters = merger.shardIters[0:0]
+}
+
 func (merger *spillMerger) nextMerger() (int, *mappedDataMerger, error) {
 	if merger.nextShard >= merger.shardCount {
 		panic(fmt.Sprintf("asking for too many shards from spill (%d)", merger.shardCount))
 	} else if merger.nextShard > 0 {
 		for i := range merger.spillIters {
-			if err := merger.spillIters[i].NextShard(); err != nil {
+			if merger.spills[i].names != nil {
+				continue
+			} else if err := merger.spillIters[i].NextShard(); err != nil {
 				panic(fmt.Sprintf("NextShard() failed in nextMerger(): %s", err))
 			}
 		}
 	}
 
+	merger.closeShard()
+
 	mm := newMerger(merger.handler)
 	for i := range merger.spillIters {
-		if err := mm.addSource(&merger.spillIters[i]); err != nil {
+		var iter IntermediateStorageIterator = &merger.spillIters[i]
+		if names := merger.spills[i].names; names != nil {
+			// persisted spills are streamed back from intermediate storage
+			var err error
+			if iter, err = merger.intStorage.Iterator(merger.c, names[merger.nextShard], merger.handler); err != nil {
+				return -1, nil, fmt.Errorf("error opening spill file: %s", err)
+			}
+
+			merger.shardIters = append(merger.shardIters, iter)
+		}
+
+		if err := mm.addSource(iter); err != nil {
 			return -1, nil, fmt.Errorf("error adding iterator to merger: %s", err)
 		}
 	}
@@ -202,10 +341,11 @@ func mergeSpills(c context.Context, intStorage IntermediateStorage, handler KeyV
 		return []string{}, nil
 	}
 
-	spillMerger, err := spillSetMerger(c, spills, handler)
+	spillMerger, err := spillSetMerger(c, intStorage, spills, handler)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create spill merger: %s", err)
 	}
+	defer spillMerger.closeShard()
 
 	numShards := len(spills[0].linesPerShard)
 
@@ -221,13 +361,20 @@ func mergeSpills(c context.Context, intStorage IntermediateStorage, handler KeyV
 		shardCount := shardCount
 
 		log.Infof("merging shard %d/%d", shardCount, numShards)
-		if shard, merger, err := spillMerger.nextMerger(); err != nil {
+		shard, merger, err := spillMerger.nextMerger()
+		if err != nil {
 			return nil, fmt.Errorf("failed to create merger for shard %d: %s", shardCount, err)
 		} else if shard != shardCount {
 			panic("lost track of shard count for spill merge!!!")
-		} else if w, err := intStorage.CreateIntermediate(c, handler); err != nil {
+		}
+
+		w, err := intStorage.CreateIntermediate(c, handler)
+		if err != nil {
 			return nil, fmt.Errorf("failed to create intermediate file: %s", err)
-		} else if err := mergeIntermediate(w, handler, merger); err != nil {
+		}
+		trackIntermediate(c, w.ToName())
+
+		if err := mergeSpillShard(w, handler, merger); err != nil {
 			return nil, fmt.Errorf("failed to merge shard %d: %s", shardCount, err)
 		} else {
 			go func() {
@@ -260,3 +407,13 @@ func mergeSpills(c context.Context, intStorage IntermediateStorage, handler KeyV
 
 	return names, nil
 }
+
+// mergeSpillShard writes a merged shard to intermediate storage, combining the values for each
+// key first if the handler implements Combiner
+func mergeSpillShard(w SingleIntermediateStorageWriter, handler KeyValueHandler, merger *mappedDataMerger) error {
+	if combiner, ok := handler.(Combiner); ok {
+		return combineIntermediate(w, handler, combiner, merger)
+	}
+
+	return mergeIntermediate(w, handler, merger)
+}
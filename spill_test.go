@@ -16,6 +16,11 @@ package mapreduce
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
 	ck "gopkg.in/check.v1"
 )
 
@@ -82,3 +87,153 @@ func (mrt *MapreduceTests) TestSpill(c *ck.C) {
 	c.Assert(len(memStorage.items), ck.Equals, 5)
 
 }
+
+type testSumCombiner struct {
+	Int64KeyHandler
+	Int64ValueHandler
+}
+
+func (s testSumCombiner) Combine(key interface{}, values []interface{}) (interface{}, error) {
+	sum := 0
+	for _, value := range values {
+		sum += value.(int)
+	}
+
+	return sum, nil
+}
+
+func (mrt *MapreduceTests) TestSpillCombine(c *ck.C) {
+	memStorage := &memoryIntermediateStorage{}
+	handler := testSumCombiner{}
+
+	// each of 3 spills has 2 shards, and every key from 0..99 is mapped 4 times per spill with a value of 1
+	spills := make([]spillStruct, 3)
+	for pass := range spills {
+		dataSets := make([]mappedDataList, 2)
+		for shard := range dataSets {
+			dataSets[shard] = mappedDataList{data: make([]MappedData, 0), compare: handler}
+		}
+
+		for i := 0; i < 400; i++ {
+			key := int64(i % 100)
+			dataSets[key%2].data = append(dataSets[key%2].data, MappedData{Key: key, Value: 1})
+		}
+
+		err := combineDataSets(handler, dataSets)
+		c.Assert(err, ck.IsNil)
+
+		spill, err := writeSpill(nil, handler, dataSets)
+		c.Assert(err, ck.IsNil)
+		c.Assert(spill.linesPerShard, ck.DeepEquals, []int{50, 50})
+
+		spills[pass] = spill
+	}
+
+	names, err := mergeSpills(nil, memStorage, handler, spills, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(names), ck.Equals, 2)
+
+	for shard := range names {
+		iter, err := memStorage.Iterator(nil, names[shard], handler)
+		c.Assert(err, ck.IsNil)
+
+		for i := 0; i < 50; i++ {
+			item, exists, err := iter.Next()
+			c.Assert(err, ck.IsNil)
+			c.Assert(exists, ck.Equals, true)
+			c.Assert(item.Key, ck.Equals, int64(i*2+shard))
+			c.Assert(item.Value, ck.Equals, 12)
+		}
+
+		_, exists, err := iter.Next()
+		c.Assert(err, ck.IsNil)
+		c.Assert(exists, ck.Equals, false)
+	}
+}
+
+func (mrt *MapreduceTests) TestSeparateReduceItemsSkipsCombiner(c *ck.C) {
+	u := &testSaltedWordCount{newTestCancelPipeline()}
+	job := mrt.localJob(u, u.testMemoryOutput)
+	job.SeparateReduceItems = true
+
+	info, _, err := LocalRunner{Workers: 3}.Run(appwrap.StubContext(), job)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageDone)
+
+	// every word reaches the reducer on its own instead of being summed first
+	expected, err := ioutil.ReadFile("testdata/pandp-results")
+	c.Assert(err, ck.IsNil)
+	words := 0
+	for _, result := range strings.Split(strings.TrimRight(string(expected), "\n"), "\n") {
+		count, err := strconv.Atoi(result[strings.LastIndex(result, " ")+1:])
+		c.Assert(err, ck.IsNil)
+		words += count
+	}
+
+	lines := u.lines()
+	c.Assert(lines, ck.HasLen, words)
+	for _, line := range lines {
+		c.Assert(strings.HasSuffix(line, ": 1"), ck.Equals, true)
+	}
+}
+
+func (mrt *MapreduceTests) TestPersistentSpill(c *ck.C) {
+	memStorage := &memoryIntermediateStorage{}
+	handler := struct {
+		Int64KeyHandler
+		StringValueHandler
+	}{}
+
+	// like TestSpill, but with some of the spills written to intermediate storage
+	spills := make([]spillStruct, 4)
+	for pass := range spills {
+		dataSets := make([]mappedDataList, 3)
+		for shard := range dataSets {
+			dataSets[shard] = mappedDataList{data: make([]MappedData, 0), compare: handler}
+		}
+
+		for i := 300*(pass+1) - 1; i >= 300*pass; i-- {
+			dataSets[i%3].data = append(dataSets[i%3].data, MappedData{Key: int64(i), Value: fmt.Sprintf("%d", i)})
+		}
+
+		var spill spillStruct
+		var err error
+		if pass%2 == 0 {
+			spill, err = writePersistentSpill(nil, memStorage, handler, dataSets)
+			c.Assert(err, ck.IsNil)
+			c.Assert(spill.names, ck.HasLen, 3)
+			c.Assert(spill.contents, ck.IsNil)
+		} else {
+			spill, err = writeSpill(nil, handler, dataSets)
+			c.Assert(err, ck.IsNil)
+		}
+		c.Assert(spill.linesPerShard, ck.DeepEquals, []int{100, 100, 100})
+
+		spills[pass] = spill
+	}
+
+	c.Assert(len(memStorage.items), ck.Equals, 6)
+
+	names, err := mergeSpills(nil, memStorage, handler, spills, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+	c.Assert(len(names), ck.Equals, 3)
+
+	removeSpills(nil, memStorage, spills, mrt.nullLog)
+	c.Assert(len(memStorage.items), ck.Equals, 3)
+
+	for shard := range names {
+		iter, err := memStorage.Iterator(nil, names[shard], handler)
+		c.Assert(err, ck.IsNil)
+
+		for i := 0; i < 400; i++ {
+			item, exists, err := iter.Next()
+			c.Assert(err, ck.IsNil)
+			c.Assert(exists, ck.Equals, true)
+			c.Assert(item.Key, ck.Equals, int64(i*3+shard))
+		}
+
+		_, exists, err := iter.Next()
+		c.Assert(err, ck.IsNil)
+		c.Assert(exists, ck.Equals, false)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// ErrTaskQueueShutdown is returned when tasks are posted to a PoolTaskQueue which is shutting down
+var ErrTaskQueueShutdown = fmt.Errorf("task queue has been shut down")
+
+// PoolTaskQueue implements TaskInterface without appengine. Tasks are run inside of the current
+// process by a pool of goroutines, which pass them to Handler (normally the http.Handler returned
+// by MapReduceStoreHandler, with a JobStore and logger which don't need appengine either). Urls
+// which include a scheme and host are POSTed over http instead, which lets OnCompleteUrl point at
+// another service.
+//
+// Like appengine task queues, any response other than a 2xx means the task is run again after
+// a delay. Task and status posts use separate pools so long running monitor tasks can't prevent
+// map and reduce tasks from running (and vice versa).
+type PoolTaskQueue struct {
+	// Handler runs tasks with relative urls. It is normally set after the queue is created
+	// (since the handler needs the pipeline, which includes the TaskInterface), but must be set
+	// before any tasks are posted.
+	Handler http.Handler
+
+	// Client is used for tasks with absolute urls; if it's nil http.DefaultClient is used
+	Client *http.Client
+
+	// MaxRetries is the most times a task is retried before it is dropped; zero means
+	// tasks are retried forever, just like appengine does by default
+	MaxRetries int
+
+	// MinRetryDelay is how long to wait before running a task again the first time it fails. The
+	// delay doubles with every failure until it reaches MaxRetryDelay. These default to one second
+	// and five minutes.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+
+	tasks  *poolQueue
+	status *poolQueue
+
+	mtx          sync.Mutex
+	idle         *sync.Cond
+	pending      int
+	shuttingDown bool
+	stop         chan struct{}
+}
+
+// poolQueue limits how many of the items posted to a queue run at the same time
+type poolQueue struct {
+	name    string
+	workers chan struct{}
+}
+
+type poolTask struct {
+	queue    *poolQueue
+	url      string
+	values   url.Values
+	attempts int
+	log      appwrap.Logging
+}
+
+// NewPoolTaskQueue returns a PoolTaskQueue which runs up to taskWorkers map and reduce tasks and
+// statusWorkers monitor and status tasks at once. If either count is zero the number of CPUs
+// is used.
+func NewPoolTaskQueue(taskWorkers, statusWorkers int) *PoolTaskQueue {
+	if taskWorkers <= 0 {
+		taskWorkers = runtime.NumCPU()
+	}
+
+	if statusWorkers <= 0 {
+		statusWorkers = runtime.NumCPU()
+	}
+
+	q := &PoolTaskQueue{
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: 5 * time.Minute,
+		tasks:         &poolQueue{name: "task", workers: make(chan struct{}, taskWorkers)},
+		status:        &poolQueue{name: "status", workers: make(chan struct{}, statusWorkers)},
+		stop:          make(chan struct{}),
+	}
+	q.idle = sync.NewCond(&q.mtx)
+
+	return q
+}
+
+func (q *PoolTaskQueue) PostTask(c context.Context, taskUrl string, jsonParameters string, log appwrap.Logging) error {
+	return q.post(q.tasks, taskUrl, url.Values{"json": []string{jsonParameters}}, 0, log)
+}
+
+func (q *PoolTaskQueue) PostTaskLater(c context.Context, taskUrl string, jsonParameters string, delay time.Duration, log appwrap.Logging) error {
+	return q.post(q.tasks, taskUrl, url.Values{"json": []string{jsonParameters}}, delay, log)
+}
+
+func (q *PoolTaskQueue) PostStatus(c context.Context, taskUrl string, log appwrap.Logging) error {
+	return q.post(q.status, taskUrl, url.Values{}, 0, log)
+}
+
+func (q *PoolTaskQueue) post(queue *poolQueue, taskUrl string, values url.Values, delay time.Duration, log appwrap.Logging) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.shuttingDown {
+		return ErrTaskQueueShutdown
+	}
+
+	q.pending++
+	task := &poolTask{queue: queue, url: taskUrl, values: values, log: log}
+	if delay > 0 {
+		go q.runAfter(task, delay)
+	} else {
+		go q.run(task)
+	}
+
+	return nil
+}
+
+// finished is called once a task succeeds or is given up on
+func (q *PoolTaskQueue) finished() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.pending--
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+// run waits for a worker slot, runs the task and schedules a retry if it failed. The task
+// stays pending until it succeeds or is given up on.
+func (q *PoolTaskQueue) run(task *poolTask) {
+	select {
+	case task.queue.workers <- struct{}{}:
+	case <-q.stop:
+		task.log.Errorf("dropping %s task %s; queue stopped", task.queue.name, task.url)
+		q.finished()
+		return
+	}
+
+	task.attempts++
+	err := q.execute(task)
+	<-task.queue.workers
+
+	if err == nil {
+		q.finished()
+		return
+	} else if q.MaxRetries > 0 && task.attempts > q.MaxRetries {
+		task.log.Criticalf("giving up on %s task %s after %d attempts: %s", task.queue.name, task.url, task.attempts, err)
+		q.finished()
+		return
+	}
+
+	delay := q.retryDelay(task.attempts)
+	task.log.Warningf("%s task %s failed (retrying in %s): %s", task.queue.name, task.url, delay, err)
+
+	go q.runAfter(task, delay)
+}
+
+// runAfter runs the task once delay has passed, unless the queue is stopped first
+func (q *PoolTaskQueue) runAfter(task *poolTask, delay time.Duration) {
+	select {
+	case <-time.After(delay):
+		q.run(task)
+	case <-q.stop:
+		task.log.Errorf("dropping %s task %s; queue stopped", task.queue.name, task.url)
+		q.finished()
+	}
+}
+
+func (q *PoolTaskQueue) retryDelay(attempts int) time.Duration {
+	delay := q.MinRetryDelay
+	for i := 1; i < attempts && delay < q.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > q.MaxRetryDelay {
+		delay = q.MaxRetryDelay
+	}
+
+	return delay
+}
+
+// execute runs the task once, returning an error if it needs to be run again
+func (q *PoolTaskQueue) execute(task *poolTask) (finalErr error) {
+	body := task.values.Encode()
+
+	if u, err := url.Parse(task.url); err != nil {
+		return err
+	} else if u.IsAbs() {
+		client := q.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+
+		resp, err := client.Post(task.url, "application/x-www-form-urlencoded", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("bad response code %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", task.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// the handler is allowed to panic; that's no different than a non-2xx response from appengine's
+	// point of view
+	defer func() {
+		if r := recover(); r != nil {
+			finalErr = fmt.Errorf("panic: %s", r)
+		}
+	}()
+
+	w := &poolResponseWriter{header: make(http.Header), code: http.StatusOK}
+	q.Handler.ServeHTTP(w, req)
+	if w.code < 200 || w.code > 299 {
+		return fmt.Errorf("bad response code %d", w.code)
+	}
+
+	return nil
+}
+
+// Shutdown waits for every task which has been posted (including the tasks those tasks post, and
+// any retries) to finish and then stops the queue from accepting new tasks. If c is done before
+// that happens the queue is stopped right away; tasks which haven't started yet are dropped and
+// c's error is returned. Tasks which are already running are not interrupted.
+func (q *PoolTaskQueue) Shutdown(c context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.mtx.Lock()
+		// once the queue is stopped nobody is waiting for this anymore
+		for q.pending > 0 && !q.stopped() {
+			q.idle.Wait()
+		}
+		q.shuttingDown = true
+		q.mtx.Unlock()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-c.Done():
+		q.mtx.Lock()
+		q.shuttingDown = true
+		if !q.stopped() {
+			close(q.stop)
+		}
+		// wake up the goroutine waiting for the queue to go idle so it exits
+		q.idle.Broadcast()
+		q.mtx.Unlock()
+
+		return c.Err()
+	}
+}
+
+// stopped reports whether Shutdown has stopped the queue
+func (q *PoolTaskQueue) stopped() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// poolResponseWriter keeps track of the status code for requests run by PoolTaskQueue; the body
+// is thrown away just like it is for appengine tasks
+type poolResponseWriter struct {
+	header http.Header
+	code   int
+	wrote  bool
+}
+
+func (w *poolResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *poolResponseWriter) Write(data []byte) (int, error) {
+	w.wrote = true
+	return len(data), nil
+}
+
+func (w *poolResponseWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.code = code
+		w.wrote = true
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapreduce
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	ck "gopkg.in/check.v1"
+)
+
+func (mrt *MapreduceTests) TestPoolTaskQueueRetries(c *ck.C) {
+	ctx := context.Background()
+	q := NewPoolTaskQueue(2, 1)
+	q.MinRetryDelay = time.Millisecond
+
+	var mtx sync.Mutex
+	calls := map[string]int{}
+	params := []string{}
+	q.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		calls[r.URL.Path]++
+		if r.URL.Path == "/flaky" && calls[r.URL.Path] < 3 {
+			http.Error(w, "try again", 500)
+		} else if r.URL.Path == "/panic" && calls[r.URL.Path] < 2 {
+			panic("oops")
+		} else if r.URL.Path == "/work" {
+			params = append(params, r.FormValue("json"), r.FormValue("a"), r.FormValue("b"))
+		}
+	})
+
+	c.Assert(q.PostTask(ctx, "/work?a=1&b=x%3By", "param", mrt.nullLog), ck.IsNil)
+	c.Assert(q.PostTask(ctx, "/flaky", "", mrt.nullLog), ck.IsNil)
+	c.Assert(q.PostStatus(ctx, "/panic", mrt.nullLog), ck.IsNil)
+	c.Assert(q.Shutdown(ctx), ck.IsNil)
+
+	c.Assert(calls, ck.DeepEquals, map[string]int{"/work": 1, "/flaky": 3, "/panic": 2})
+	c.Assert(params, ck.DeepEquals, []string{"param", "1", "x;y"})
+
+	c.Assert(q.PostTask(ctx, "/work", "", mrt.nullLog), ck.Equals, ErrTaskQueueShutdown)
+
+	// retry limits are honored
+	q = NewPoolTaskQueue(1, 1)
+	q.MinRetryDelay = time.Millisecond
+	q.MaxRetries = 2
+	count := 0
+	q.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		http.Error(w, "never works", 503)
+	})
+
+	c.Assert(q.PostTask(ctx, "/fail", "", mrt.nullLog), ck.IsNil)
+	c.Assert(q.Shutdown(ctx), ck.IsNil)
+	c.Assert(count, ck.Equals, 3)
+}
+
+func (mrt *MapreduceTests) TestPoolTaskQueueConcurrency(c *ck.C) {
+	ctx := context.Background()
+	q := NewPoolTaskQueue(2, 1)
+
+	var mtx sync.Mutex
+	running, maxRunning, total := 0, 0, 0
+	q.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		running++
+		total++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mtx.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		// tasks which post more tasks are waited for by Shutdown
+		if r.URL.Path == "/parent" {
+			q.PostTask(ctx, "/child", "", mrt.nullLog)
+		}
+
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Assert(q.PostTask(ctx, "/parent", "", mrt.nullLog), ck.IsNil)
+	}
+
+	c.Assert(q.Shutdown(ctx), ck.IsNil)
+	c.Assert(total, ck.Equals, 20)
+	c.Assert(maxRunning, ck.Equals, 2)
+}
+
+func (mrt *MapreduceTests) TestPoolTaskQueueAbsoluteUrl(c *ck.C) {
+	ctx := context.Background()
+
+	var mtx sync.Mutex
+	statuses := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		statuses = append(statuses, r.FormValue("status"))
+	}))
+	defer server.Close()
+
+	q := NewPoolTaskQueue(1, 1)
+	q.Handler = http.NotFoundHandler()
+	c.Assert(q.PostStatus(ctx, server.URL+"/done?status=done", mrt.nullLog), ck.IsNil)
+	c.Assert(q.Shutdown(ctx), ck.IsNil)
+	c.Assert(statuses, ck.DeepEquals, []string{"done"})
+
+	// a queue which never drains stops when the shutdown context expires
+	q = NewPoolTaskQueue(1, 1)
+	q.MinRetryDelay = time.Hour
+	q.Handler = http.NotFoundHandler()
+	c.Assert(q.PostTask(ctx, "/missing", "", mrt.nullLog), ck.IsNil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(q.Shutdown(timeoutCtx), ck.Equals, context.DeadlineExceeded)
+	c.Assert(q.PostTask(ctx, "/missing", "", mrt.nullLog), ck.Equals, ErrTaskQueueShutdown)
+}
+
+func (mrt *MapreduceTests) TestPoolTaskQueueDelay(c *ck.C) {
+	ctx := context.Background()
+	q := NewPoolTaskQueue(1, 1)
+
+	var mtx sync.Mutex
+	var ran time.Time
+	q.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		ran = time.Now()
+	})
+
+	start := time.Now()
+	c.Assert(q.PostTaskLater(ctx, "/later", "", 20*time.Millisecond, mrt.nullLog), ck.IsNil)
+	c.Assert(q.Shutdown(ctx), ck.IsNil)
+	c.Assert(ran.Sub(start) >= 20*time.Millisecond, ck.Equals, true)
+}
+
+// TestPoolTaskQueueJobFails runs a job whose map task fails through a real handler; the pool runs
+// the monitor which fails the job and posts the error
+func (mrt *MapreduceTests) TestPoolTaskQueueJobFails(c *ck.C) {
+	ctx := context.Background()
+	store := NewMemoryJobStore()
+	q := NewPoolTaskQueue(2, 2)
+	u := &testPoolPipeline{
+		testLocalWordCount: testLocalWordCount{testUniqueWordCount: newTestUniqueWordCount(), testMemoryOutput: &testMemoryOutput{count: 3}},
+		PoolTaskQueue:      q,
+	}
+	pipe := testFailingMapPipeline{u}
+
+	var mtx sync.Mutex
+	statuses := []string{}
+	mux := http.NewServeMux()
+	mux.Handle("/mr/test/", MapReduceStoreHandler("/mr/test", pipe, func(r *http.Request) context.Context { return ctx },
+		func(context.Context) JobStore { return store }, func(context.Context) appwrap.Logging { return appwrap.NullLogger{} }))
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		statuses = append(statuses, r.URL.String())
+	})
+	q.Handler = mux
+
+	job := mrt.localJob(pipe, u.testMemoryOutput)
+	job.OnCompleteUrl = "/done"
+	jobId, err := RunWithStore(ctx, store, job, mrt.nullLog)
+	c.Assert(err, ck.IsNil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	c.Assert(q.Shutdown(timeoutCtx), ck.IsNil)
+
+	info, err := store.GetJob(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(info.Stage, ck.Equals, StageFailed)
+	c.Assert(statuses, ck.HasLen, 1)
+	c.Assert(strings.HasPrefix(statuses[0], "/done?status=error&"), ck.Equals, true)
+	c.Assert(strings.HasSuffix(statuses[0], fmt.Sprintf("&id=%d", jobId)), ck.Equals, true)
+	c.Assert(len(u.memoryIntermediateStorage.items), ck.Equals, 0)
+}
@@ -29,10 +29,11 @@ import (
 type TaskStatus string
 
 const (
-	TaskStatusPending = TaskStatus("pending")
-	TaskStatusRunning = TaskStatus("running")
-	TaskStatusDone    = TaskStatus("done")
-	TaskStatusFailed  = TaskStatus("failed")
+	TaskStatusPending   = TaskStatus("pending")
+	TaskStatusRunning   = TaskStatus("running")
+	TaskStatusDone      = TaskStatus("done")
+	TaskStatusFailed    = TaskStatus("failed")
+	TaskStatusCancelled = TaskStatus("cancelled")
 )
 
 type JobStage string
@@ -40,9 +41,12 @@ type JobStage string
 const (
 	StageFormation = JobStage("forming")
 	StageMapping   = JobStage("map")
+	StageCombining = JobStage("combine") // only for jobs which salt hot keys
 	StageReducing  = JobStage("reduce")
 	StageDone      = JobStage("done")
 	StageFailed    = JobStage("failed")
+	StageCancelled = JobStage("cancelled")
+	StageRunning   = JobStage("running") // only used for chains
 )
 
 // JobTask is the entity stored in the datastore defining a single MapReduce task. They
@@ -61,23 +65,59 @@ type JobTask struct {
 	ReadFrom []byte `datastore:",noindex"`
 	Url      string `datastore:",noindex"`
 	Result   string `datastore:",noindex"`
+	Deferred bool   `datastore:",noindex"` // set while the task is waiting for its paused job to resume
+	// json encoded mapCheckpoint for map tasks which have saved their progress
+	Checkpoint string `datastore:",noindex"`
+	// intermediate files created by a map task which haven't been removed yet
+	Intermediates []string `datastore:",noindex"`
+	// a second attempt has been started for a slow map task; it keeps track of its intermediate
+	// files in SpeculativeIntermediates, and SpeculativeWon is set if it finished first
+	Speculated               bool     `datastore:",noindex"`
+	SpeculativeIntermediates []string `datastore:",noindex"`
+	SpeculativeWon           bool     `datastore:",noindex"`
+	// json encoded counters kept by the attempt which finished the task (see DecodeCounters)
+	Counters string `datastore:",noindex"`
+	// saved periodically while the task runs. Progress is the fraction of its input which has been
+	// read (which stays zero unless its readers are ProgressReaders), and ProgressRecords is how
+	// many items (for map tasks) or keys (for reduce tasks) have been read.
+	Progress        float64 `datastore:",noindex"`
+	ProgressRecords int64   `datastore:",noindex"`
+
+	// filled in by the JobStore; the datastore keeps these as the Job key
+	Id    int64 `datastore:"-"`
+	JobId int64 `datastore:"-"`
 }
 
 // JobInfo is the entity stored in the datastore defining the MapReduce Job
 type JobInfo struct {
-	UrlPrefix           string
-	Stage               JobStage
-	UpdatedAt           time.Time
-	StartTime           time.Time
-	TaskCount           int      `datastore:"TasksRunning,noindex"`
-	FirstTaskId         int64    `datastore:",noindex"`
-	RetryCount          int      `datastore:",noindex"`
-	SeparateReduceItems bool     `datastore:",noindex"`
-	OnCompleteUrl       string   `datastore:",noindex"`
-	WriterNames         []string `datastore:",noindex"`
-	JsonParameters      string   `datastore:",noindex"`
-
-	// filled in by getJob
+	UrlPrefix            string
+	Stage                JobStage
+	UpdatedAt            time.Time
+	StartTime            time.Time
+	TaskCount            int           `datastore:"TasksRunning,noindex"`
+	FirstTaskId          int64         `datastore:",noindex"`
+	RetryCount           int           `datastore:",noindex"`
+	SeparateReduceItems  bool          `datastore:",noindex"`
+	OnCompleteUrl        string        `datastore:",noindex"`
+	WriterNames          []string      `datastore:",noindex"`
+	JsonParameters       string        `datastore:",noindex"`
+	ChainId              int64         `datastore:",noindex"` // zero unless the job was started by RunChain
+	MapOnly              bool          `datastore:",noindex"`
+	Paused               bool          `datastore:",noindex"`
+	CheckpointInterval   time.Duration `datastore:",noindex"`
+	MapMemoryBudget      int           `datastore:",noindex"`
+	UseMemoryStats       bool          `datastore:",noindex"`
+	SpeculativeExecution bool          `datastore:",noindex"` // only map tasks are speculated
+	TotalOrder           bool          `datastore:",noindex"`
+	RangeBoundaries      []string      `datastore:",noindex"` // base64 of the dumped keys
+	SaltHotKeys          bool          `datastore:",noindex"`
+	Counters             string        `datastore:",noindex"` // json encoded totals for the completed stages
+	StageStartTime       time.Time     `datastore:",noindex"` // when the current stage's tasks were created
+	StageProgress        float64       `datastore:",noindex"` // fraction of the current stage which is done
+	StageEta             time.Time     `datastore:",noindex"` // when the current stage should finish; zero if unknown
+	MapTaskIds           []int64       `datastore:",noindex"` // the map tasks, which RetryJob starts over
+
+	// filled in by the JobStore
 	Id int64 `datastore:"-"`
 }
 
@@ -88,12 +128,20 @@ type TaskInterface interface {
 	PostStatus(c context.Context, fullUrl string, log appwrap.Logging) error
 }
 
+// DelayedTaskInterface is implemented by TaskInterfaces which can hold a task back for a while
+// before running it. Tasks for paused jobs are posted this way; if the TaskInterface doesn't
+// support it the task fails with a retryable error instead, and the queue runs it again later.
+type DelayedTaskInterface interface {
+	PostTaskLater(c context.Context, fullUrl string, jsonParameters string, delay time.Duration, log appwrap.Logging) error
+}
+
 type TaskType string
 
 // TaskTypes defines the type of task, map or reduce
 const (
-	TaskTypeMap    = TaskType("map")
-	TaskTypeReduce = TaskType("reduce")
+	TaskTypeMap     = TaskType("map")
+	TaskTypeCombine = TaskType("combine")
+	TaskTypeReduce  = TaskType("reduce")
 )
 
 // Datastore entity kinds for jobs and tasks
@@ -103,90 +151,55 @@ const TaskEntity = "MapReduceTask"
 // this is returned when multiple monitors conflict; only the conflicting monitor complains
 var errMonitorJobConflict = fmt.Errorf("monitor job conflict detected")
 
-func createJob(ds appwrap.Datastore, urlPrefix string, writerNames []string, onCompleteUrl string, separateReduceItems bool, jsonParameters string, retryCount int) (*datastore.Key, error) {
-	if retryCount == 0 {
+// createJob stores a new job in the forming stage
+func createJob(store JobStore, job JobInfo) (int64, error) {
+	if job.RetryCount == 0 {
 		// default
-		retryCount = 3
+		job.RetryCount = 3
 	}
 
-	key := ds.NewKey(JobEntity, "", 0, nil)
-	job := JobInfo{
-		UrlPrefix:           urlPrefix,
-		Stage:               StageFormation,
-		UpdatedAt:           time.Now(),
-		StartTime:           time.Now(),
-		OnCompleteUrl:       onCompleteUrl,
-		SeparateReduceItems: separateReduceItems,
-		WriterNames:         writerNames,
-		RetryCount:          retryCount,
-		JsonParameters:      jsonParameters,
-	}
+	job.Stage = StageFormation
+	job.UpdatedAt = time.Now()
+	job.StartTime = time.Now()
 
-	return ds.Put(key, &job)
+	return store.CreateJob(job)
 }
 
-func createTasks(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*datastore.Key, tasks []JobTask, newStage JobStage, log appwrap.Logging) error {
+func createTasks(store JobStore, jobId int64, taskIds []int64, tasks []JobTask, newStage JobStage, log appwrap.Logging) error {
 	now := time.Now()
-	firstId := taskKeys[0].IntID()
+	firstId := taskIds[0]
 	for i := range tasks {
 		tasks[i].StartTime = now
-		tasks[i].Job = jobKey
+		tasks[i].JobId = jobId
 
-		if taskKeys[i].IntID() < firstId {
-			firstId = taskKeys[i].IntID()
+		if taskIds[i] < firstId {
+			firstId = taskIds[i]
 		}
 	}
 
-	putSize := 64
-
 	log.Infof("creating %d %s tasks", len(tasks), tasks[0].Type)
 
-	i := 0
-	for i < len(tasks) {
-		if err := backoff.Retry(func() error {
-			last := i + putSize
-			if last > len(tasks) {
-				last = len(tasks)
-			}
-
-			if _, err := ds.PutMulti(taskKeys[i:last], tasks[i:last]); err != nil {
-				if putSize > 5 {
-					putSize /= 2
-				}
-
-				log.Infof("shrinkning putSize to %d because of %s", putSize, err)
-
-				return err
-			} else {
-				log.Infof("created tasks for %d:%d", i, last)
-			}
-
-			i = last
-
-			return nil
-		}, mrBackOff()); err != nil {
-			log.Errorf("hit backoff error %s", err)
-			return err
-		}
+	if err := store.PutTasks(taskIds, tasks); err != nil {
+		log.Errorf("failed to create tasks: %s", err)
+		return err
 	}
 
-	log.Infof("%d tasks created; first is %s", i, taskKeys[0])
-
-	return runInTransaction(ds,
-		func(ds appwrap.Datastore) error {
-			var job JobInfo
+	log.Infof("%d tasks created; first is %d", len(tasks), firstId)
 
-			if err := ds.Get(jobKey, &job); err != nil {
-				return err
-			}
-
-			job.TaskCount = len(tasks)
-			job.FirstTaskId = firstId
-			job.Stage = newStage
+	_, err := store.UpdateJob(jobId, func(job *JobInfo) error {
+		job.TaskCount = len(tasks)
+		job.FirstTaskId = firstId
+		if newStage == StageMapping {
+			job.MapTaskIds = taskIds
+		}
+		job.Stage = newStage
+		job.StageStartTime = now
+		job.StageProgress = 0
+		job.StageEta = time.Time{}
+		return nil
+	})
 
-			_, err := ds.Put(jobKey, &job)
-			return err
-		})
+	return err
 }
 
 func mrBackOff() backoff.BackOff {
@@ -204,22 +217,20 @@ func runInTransaction(ds appwrap.Datastore, f func(ds appwrap.Datastore) error)
 	}, mrBackOff())
 }
 
-func markJobFailed(c context.Context, ds appwrap.Datastore, jobKey *datastore.Key, log appwrap.Logging) (prev JobInfo, finalErr error) {
-	finalErr = runInTransaction(ds, func(ds appwrap.Datastore) error {
-		prev = JobInfo{}
-		if err := ds.Get(jobKey, &prev); err != nil {
-			return err
+func markJobFailed(c context.Context, store JobStore, jobId int64, log appwrap.Logging) (prev JobInfo, finalErr error) {
+	_, finalErr = store.UpdateJob(jobId, func(job *JobInfo) error {
+		prev = *job
+		if job.Stage == StageCancelled {
+			// a task which fails after the job was cancelled doesn't matter anymore
+			return nil
 		}
 
-		job := prev
 		job.Stage = StageFailed
-
-		_, err := ds.Put(jobKey, &job)
-		return err
+		return nil
 	})
 
 	if finalErr != nil {
-		log.Criticalf("marking job failed for key %s failed: %s", jobKey, finalErr)
+		log.Criticalf("marking job %d failed failed: %s", jobId, finalErr)
 	}
 
 	return
@@ -234,22 +245,20 @@ func (t taskError) Error() string { return "taskError " + t.err }
 //
 // caller needs to check the stage in the final job; if stageChanged is true it will be either nextStage or StageFailed.
 // If StageFailed then at least one of the underlying tasks failed and the reason will appear as a taskError{} in err
-func jobStageComplete(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*datastore.Key, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
-	last := len(taskKeys)
-	tasks := make([]JobTask, 100)
+func jobStageComplete(store JobStore, jobId int64, taskIds []int64, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
+	doneTasks := make([]JobTask, 0, len(taskIds))
+	last := len(taskIds)
 	for last > 0 {
 		first := last - 100
 		if first < 0 {
 			first = 0
 		}
 
-		taskCount := last - first
-
-		if err := ds.GetMulti(taskKeys[first:last], tasks[0:taskCount]); err != nil {
+		if tasks, err := store.GetTasks(taskIds[first:last]); err != nil {
 			finalErr = err
 			return
 		} else {
-			for i := 0; i < taskCount; i++ {
+			for i := range tasks {
 				if tasks[i].Status == TaskStatusFailed {
 					log.Infof("failed tasks found")
 					nextStage = StageFailed
@@ -261,6 +270,8 @@ func jobStageComplete(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*d
 				}
 			}
 
+			doneTasks = append(doneTasks, tasks...)
+
 			if last >= 0 {
 				last = first
 			}
@@ -268,26 +279,36 @@ func jobStageComplete(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*d
 	}
 
 	// running this in a transaction ensures only one process advances the stage
-	if transErr := runInTransaction(ds, func(ds appwrap.Datastore) error {
-		job = JobInfo{}
-		if err := ds.Get(jobKey, &job); err != nil {
-			return err
-		}
-
+	if updatedJob, transErr := store.UpdateJob(jobId, func(job *JobInfo) error {
 		if job.Stage != expectedStage {
 			// we're not where we expected, so advancing this isn't our responsibility
-			stageChanged = false
 			return errMonitorJobConflict
 		}
 
+		if nextStage != StageFailed {
+			// the stage's counters are added to the job's exactly once, as it advances
+			if counters, err := addTaskCounters(job.Counters, doneTasks); err != nil {
+				log.Errorf("failed to add task counters: %s", err)
+			} else {
+				job.Counters = counters
+			}
+
+			// the next stage's progress starts when its tasks are created
+			job.StageProgress = 0
+			if nextStage == StageDone {
+				job.StageProgress = 1
+			}
+			job.StageEta = time.Time{}
+		}
+
 		job.Stage = nextStage
 		job.UpdatedAt = time.Now()
-
-		_, err := ds.Put(jobKey, &job)
-		stageChanged = (err == nil)
-		return err
+		return nil
 	}); transErr != nil {
 		finalErr = transErr
+	} else {
+		job = updatedJob
+		stageChanged = true
 	}
 
 	if finalErr != nil {
@@ -299,85 +320,54 @@ func jobStageComplete(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*d
 	return
 }
 
-func getTask(ds appwrap.Datastore, taskKey *datastore.Key) (JobTask, error) {
-	var task JobTask
-
-	err := backoff.Retry(func() error {
-		return ds.Get(taskKey, &task)
-	}, mrBackOff())
-
-	if err != nil {
-		return JobTask{}, err
+func updateTask(store JobStore, taskId int64, status TaskStatus, tryIncrement int, info string, result interface{}) (JobTask, error) {
+	var resultStr *string
+	if result != nil {
+		if resultBytes, err := json.Marshal(result); err != nil {
+			return JobTask{}, err
+		} else {
+			str := string(resultBytes)
+			resultStr = &str
+		}
 	}
 
-	return task, nil
-}
-
-func updateTask(ds appwrap.Datastore, taskKey *datastore.Key, status TaskStatus, tryIncrement int, info string, result interface{}) (JobTask, error) {
-	var task JobTask
-
 	newCount := -1
 
-	err := backoff.Retry(func() error {
-		if err := ds.Get(taskKey, &task); err != nil {
-			return err
-		}
-
+	return store.UpdateTask(taskId, func(task *JobTask) error {
 		task.UpdatedAt = time.Now()
 		task.Info = info
 
-		// this prevents double incrementing if the Put times out but has actually
+		// this prevents double incrementing if the save times out but has actually
 		// written the value
 		if newCount == -1 {
 			newCount = task.Retries + tryIncrement
 		}
 		task.Retries = newCount
 
-		if status != "" {
-			task.Status = status
-			if status == TaskStatusDone || task.Status == TaskStatusFailed {
-				task.Done = task.Job
-			}
+		if status == TaskStatusRunning && task.Status != TaskStatusRunning {
+			// speculative execution compares how long tasks have been running
+			task.StartTime = task.UpdatedAt
 		}
 
-		if result != nil {
-			resultBytes, err := json.Marshal(result)
-			if err != nil {
-				return err
-			}
-
-			task.Result = string(resultBytes)
+		if status != "" {
+			task.Status = status
+			task.Deferred = false
 		}
 
-		_, err := ds.Put(taskKey, &task)
-		return err
-	}, mrBackOff())
-
-	return task, err
-}
-
-func getJob(ds appwrap.Datastore, jobKey *datastore.Key) (JobInfo, error) {
-	var job JobInfo
-
-	err := backoff.Retry(func() error {
-		if err := ds.Get(jobKey, &job); err != nil {
-			return err
+		if resultStr != nil {
+			task.Result = *resultStr
 		}
 
 		return nil
-	}, mrBackOff())
-
-	job.Id = jobKey.IntID()
-
-	return job, err
+	})
 }
 
 func GetJob(ds appwrap.Datastore, jobId int64) (JobInfo, error) {
-	return getJob(ds, ds.NewKey(JobEntity, "", jobId, nil))
+	return datastoreJobStore{ds: ds}.GetJob(jobId)
 }
 
 func GetJobTasks(ds appwrap.Datastore, job JobInfo) ([]JobTask, error) {
-	if tasks, err := gatherTasks(ds, job); err != nil {
+	if tasks, err := gatherTasks(datastoreJobStore{ds: ds}, job); err != nil {
 		return nil, err
 	} else {
 		return tasks, nil
@@ -385,7 +375,11 @@ func GetJobTasks(ds appwrap.Datastore, job JobInfo) ([]JobTask, error) {
 }
 
 func GetJobTaskResults(ds appwrap.Datastore, job JobInfo) ([]interface{}, error) {
-	if tasks, err := gatherTasks(ds, job); err != nil {
+	return jobTaskResults(datastoreJobStore{ds: ds}, job)
+}
+
+func jobTaskResults(store JobStore, job JobInfo) ([]interface{}, error) {
+	if tasks, err := gatherTasks(store, job); err != nil {
 		return nil, err
 	} else {
 		result := make([]interface{}, len(tasks))
@@ -397,61 +391,23 @@ func GetJobTaskResults(ds appwrap.Datastore, job JobInfo) ([]interface{}, error)
 	}
 }
 
+// RemoveJob deletes a job and its tasks from the datastore; use RemoveJobWithStore to remove the
+// job's intermediate files as well
 func RemoveJob(ds appwrap.Datastore, jobId int64) error {
-	jobKey := ds.NewKey(JobEntity, "", jobId, nil)
-	q := ds.NewQuery(TaskEntity).Filter("Job =", jobKey).KeysOnly()
-	keys, err := q.GetAll(nil)
-	if err != nil {
-		return err
-	}
-
-	keys = append(keys, jobKey)
-
-	i := 0
-	for i < len(keys) {
-		last := i + 250
-		if last > len(keys) {
-			last = len(keys)
-		}
-
-		if err := ds.DeleteMulti(keys[i:last]); err != nil {
-			return err
-		}
-
-		i = last
-	}
-
-	return nil
+	return datastoreJobStore{ds: ds}.RemoveJob(jobId)
 }
 
-func makeTaskKeys(ds appwrap.Datastore, firstId int64, count int) []*datastore.Key {
-	taskKeys := make([]*datastore.Key, count)
+func makeTaskIds(firstId int64, count int) []int64 {
+	taskIds := make([]int64, count)
 	for i := 0; i < count; i++ {
-		taskKeys[i] = ds.NewKey(TaskEntity, "", firstId+int64(i), nil)
+		taskIds[i] = firstId + int64(i)
 	}
 
-	return taskKeys
+	return taskIds
 }
 
-func gatherTasks(ds appwrap.Datastore, job JobInfo) ([]JobTask, error) {
-	taskKeys := makeTaskKeys(ds, job.FirstTaskId, job.TaskCount)
-	tasks := make([]JobTask, len(taskKeys))
-
-	i := 0
-	for i < len(taskKeys) {
-		last := i + 100
-		if last > len(taskKeys) {
-			last = len(taskKeys)
-		}
-
-		if err := ds.GetMulti(taskKeys[i:last], tasks[i:last]); err != nil {
-			return nil, err
-		}
-
-		i = last
-	}
-
-	return tasks, nil
+func gatherTasks(store JobStore, job JobInfo) ([]JobTask, error) {
+	return store.GetTasks(makeTaskIds(job.FirstTaskId, job.TaskCount))
 }
 
 // AppengineTaskQueue implements TaskInterface via appengine task queues
@@ -462,22 +418,29 @@ type AppengineTaskQueue struct {
 	TaskQueueName string
 }
 
-func (q AppengineTaskQueue) PostTask(c context.Context, taskUrl string, jsonParameters string) error {
+func (q AppengineTaskQueue) PostTask(c context.Context, taskUrl string, jsonParameters string, log appwrap.Logging) error {
 	task := taskqueue.NewPOSTTask(taskUrl, url.Values{"json": []string{jsonParameters}})
 	_, err := taskqueue.Add(c, task, q.TaskQueueName)
 	return err
 }
 
-func (q AppengineTaskQueue) PostStatus(c context.Context, taskUrl string) error {
+func (q AppengineTaskQueue) PostTaskLater(c context.Context, taskUrl string, jsonParameters string, delay time.Duration, log appwrap.Logging) error {
+	task := taskqueue.NewPOSTTask(taskUrl, url.Values{"json": []string{jsonParameters}})
+	task.Delay = delay
+	_, err := taskqueue.Add(c, task, q.TaskQueueName)
+	return err
+}
+
+func (q AppengineTaskQueue) PostStatus(c context.Context, taskUrl string, log appwrap.Logging) error {
 	task := taskqueue.NewPOSTTask(taskUrl, url.Values{})
 	_, err := taskqueue.Add(c, task, q.StatusQueueName)
 	return err
 }
 
-func retryTask(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobKey *datastore.Key, taskKey *datastore.Key, log appwrap.Logging) error {
+func retryTask(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, taskId int64, log appwrap.Logging) error {
 	var job JobInfo
 
-	if j, err := getJob(ds, jobKey); err != nil {
+	if j, err := store.GetJob(jobId); err != nil {
 		return fmt.Errorf("getting job: %s", err)
 	} else {
 		job = j
@@ -486,19 +449,17 @@ func retryTask(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface,
 	time.Sleep(time.Duration(job.RetryCount) * 5 * time.Second)
 
 	if err := backoff.Retry(func() error {
-		var task JobTask
-		if err := ds.Get(taskKey, &task); err != nil {
-			return fmt.Errorf("getting task: %s", err)
-		}
-
-		task.Status = TaskStatusPending
-		if _, err := ds.Put(taskKey, &task); err != nil {
-			return fmt.Errorf("putting task: %s", err)
+		if task, err := store.UpdateTask(taskId, func(task *JobTask) error {
+			task.Status = TaskStatusPending
+			return nil
+		}); err != nil {
+			return fmt.Errorf("updating task: %s", err)
 		} else if err := taskIntf.PostTask(c, task.Url, job.JsonParameters, log); err != nil {
 			return fmt.Errorf("enqueuing task: %s", err)
+		} else {
+			log.Infof("retrying task %d/%d", task.Retries, job.RetryCount)
 		}
 
-		log.Infof("retrying task %d/%d", task.Retries, job.RetryCount)
 		return nil
 	}, mrBackOff()); err != nil {
 		log.Infof("retryTask() failed after backoff attempts")
@@ -508,53 +469,96 @@ func retryTask(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface,
 	}
 }
 
-func jobFailed(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobKey *datastore.Key, err error, log appwrap.Logging) {
+func jobFailed(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, err error, log appwrap.Logging) {
 	log.Errorf("jobFailed: %s", err)
-	prevJob, _ := markJobFailed(c, ds, jobKey, log) // this might mark it failed again. whatever.
+	prevJob, _ := markJobFailed(c, store, jobId, log) // this might mark it failed again. whatever.
 
-	if prevJob.OnCompleteUrl != "" {
-		taskIntf.PostStatus(c, fmt.Sprintf("%s?status=error;error=%s;id=%d", prevJob.OnCompleteUrl,
-			url.QueryEscape(err.Error()), jobKey.IntID()), log)
+	if prevJob.Stage == StageCancelled {
+		log.Infof("job was already cancelled")
+	} else if prevJob.OnCompleteUrl != "" {
+		taskIntf.PostStatus(c, fmt.Sprintf("%s?status=error&error=%s&id=%d", prevJob.OnCompleteUrl,
+			url.QueryEscape(err.Error()), jobId), log)
+	}
+
+	if intStorage, ok := taskIntf.(IntermediateStorage); ok {
+		prevJob.Id = jobId
+		removeTaskIntermediates(c, store, intStorage, prevJob, log)
 	}
 
 	return
 }
 
 // waitForStageCompletion() is split up like this for testability
-type jobStageCompletionFunc func(ds appwrap.Datastore, jobKey *datastore.Key, taskKeys []*datastore.Key, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error)
+type jobStageCompletionFunc func(store JobStore, jobId int64, taskIds []int64, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error)
+
+func waitForStageCompletion(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, currentStage, nextStage JobStage, timeout time.Duration, log appwrap.Logging) (JobInfo, error) {
+	return doWaitForStageCompletion(c, store, taskIntf, jobId, currentStage, nextStage, 5*time.Second, jobStageComplete, timeout, log)
+}
 
-func waitForStageCompletion(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobKey *datastore.Key, currentStage, nextStage JobStage, timeout time.Duration, log appwrap.Logging) (JobInfo, error) {
-	return doWaitForStageCompletion(c, ds, taskIntf, jobKey, currentStage, nextStage, 5*time.Second, jobStageComplete, timeout, log)
+// checkCancelled loads the job to see if it has been cancelled; the job is returned too (unless
+// it couldn't be loaded)
+func checkCancelled(store JobStore, jobId int64, log appwrap.Logging) (JobInfo, bool) {
+	if job, err := store.GetJob(jobId); err != nil {
+		log.Errorf("failed to check for job cancellation: %s", err)
+		return JobInfo{}, false
+	} else {
+		return job, job.Stage == StageCancelled
+	}
 }
 
-// if err != nil, this failed (which should never happen, and should be considered fatal)
-func doWaitForStageCompletion(c context.Context, ds appwrap.Datastore, taskIntf TaskInterface, jobKey *datastore.Key, currentStage, nextStage JobStage, delay time.Duration, checkCompletion jobStageCompletionFunc, timeout time.Duration, log appwrap.Logging) (JobInfo, error) {
+// if err != nil, this failed (which should never happen, and should be considered fatal). if
+// the job is cancelled while we're waiting the cancelled job is returned without an error.
+func doWaitForStageCompletion(c context.Context, store JobStore, taskIntf TaskInterface, jobId int64, currentStage, nextStage JobStage, delay time.Duration, checkCompletion jobStageCompletionFunc, timeout time.Duration, log appwrap.Logging) (JobInfo, error) {
 	var job JobInfo
-	var taskKeys []*datastore.Key
+	var taskIds []int64
 
-	if j, err := getJob(ds, jobKey); err != nil {
+	if j, err := store.GetJob(jobId); err != nil {
 		log.Criticalf("monitor failed to load job: %s", err)
 		//http.Error(w, "error loading job", 500)
 		return JobInfo{}, err
 	} else {
 		job = j
-		taskKeys = makeTaskKeys(ds, job.FirstTaskId, job.TaskCount)
+		taskIds = makeTaskIds(job.FirstTaskId, job.TaskCount)
 	}
 
 	start := time.Now()
+	lastSpeculation := start
+	lastProgress := start
 	backOffTimer := mrBackOff()
 
 	for time.Now().Sub(start) < timeout {
 
 		var newJob JobInfo
+		var failure error
 
 		backOffTimer.Reset()
 
 		for {
-			if stateChanged, nj, err := checkCompletion(ds, jobKey, taskKeys, currentStage, nextStage, log); err == errMonitorJobConflict {
+			if stateChanged, nj, err := checkCompletion(store, jobId, taskIds, currentStage, nextStage, log); err == errMonitorJobConflict {
+				if cancelledJob, cancelled := checkCancelled(store, jobId, log); cancelled {
+					return cancelledJob, nil
+				}
+
 				log.Errorf("monitor job conflict detected")
 				return JobInfo{}, err
 			} else if !stateChanged {
+				if currentJob, cancelled := checkCancelled(store, jobId, log); cancelled {
+					return currentJob, nil
+				} else if currentJob.Paused {
+					// paused jobs can take as long as they like
+					start = time.Now()
+				} else if time.Now().Sub(start) >= timeout {
+					log.Infof("timed out waiting for %s stage to complete", currentStage)
+					return job, nil
+				} else if currentStage == StageMapping && currentJob.SpeculativeExecution && !currentJob.MapOnly &&
+					time.Now().Sub(lastSpeculation) >= speculationCheckInterval {
+					speculate(c, store, taskIntf, currentJob, log)
+					lastSpeculation = time.Now()
+				} else if currentJob.Id != 0 && time.Now().Sub(lastProgress) >= progressInterval {
+					updateStageProgress(store, currentJob, log)
+					lastProgress = time.Now()
+				}
+
 				if err != nil {
 					log.Errorf("error getting map task complete status: %s", err.Error())
 
@@ -568,6 +572,11 @@ func doWaitForStageCompletion(c context.Context, ds appwrap.Datastore, taskIntf
 					backOffTimer.Reset()
 					time.Sleep(delay)
 				}
+			} else if _, isTaskErr := err.(taskError); isTaskErr && nj.Stage == StageFailed {
+				// a failed task moves the job to StageFailed, and that task's error comes back with it
+				newJob = nj
+				failure = err
+				break
 			} else if err != nil {
 				// this really shouldn't happen. errors are supposed to be reported as no state change
 				err := fmt.Errorf("error getting map task complete status even though stage was changed!!: %s", err.Error())
@@ -580,8 +589,12 @@ func doWaitForStageCompletion(c context.Context, ds appwrap.Datastore, taskIntf
 
 		if newJob.Stage == StageFailed {
 			// we found a failed task; the job has been marked as failed; notify the caller and exit
-			jobFailed(c, ds, taskIntf, jobKey, fmt.Errorf("failed task"), log)
-			return job, fmt.Errorf("failed task")
+			if failure == nil {
+				failure = fmt.Errorf("failed task")
+			}
+
+			jobFailed(c, store, taskIntf, jobId, failure, log)
+			return job, failure
 		} else {
 			job = newJob
 			break
@@ -603,14 +616,26 @@ func retryError(err error) bool {
 }
 
 // returns job if err is nil, err, and a boolean saying if the task should be restarted (true/false)
-func startTask(c context.Context, ds appwrap.Datastore, taskIntf startTopIntf, taskKey *datastore.Key, log appwrap.Logging) (JobTask, error, bool) {
-	if task, err := getTask(ds, taskKey); err != nil {
+func startTask(c context.Context, store JobStore, taskIntf startTopIntf, taskId int64, log appwrap.Logging) (JobTask, error, bool) {
+	if task, err := store.GetTask(taskId); err != nil {
 		return JobTask{}, fmt.Errorf("failed to get task status: %s", err), retryError(err)
-	} else if job, err := getJob(ds, task.Job); err != nil {
+	} else if job, err := store.GetJob(task.JobId); err != nil {
 		return JobTask{}, fmt.Errorf("failed to get job: %s", err), retryError(err)
+	} else if job.Stage == StageCancelled {
+		if _, err := updateTask(store, taskId, TaskStatusCancelled, 0, "job cancelled", nil); err != nil {
+			return JobTask{}, fmt.Errorf("Could not update task with cancellation: %s", err), true
+		}
+
+		return JobTask{}, errJobCancelled, false
+	} else if job.Paused {
+		if err := deferTask(c, store, taskIntf, job, task, log); err != errJobPaused {
+			return JobTask{}, err, true
+		}
+
+		return JobTask{}, errJobPaused, false
 	} else if task.Retries > job.RetryCount {
 		// we've failed
-		if _, err := updateTask(ds, taskKey, TaskStatusFailed, 0, "maxium retries exceeeded", nil); err != nil {
+		if _, err := updateTask(store, taskId, TaskStatusFailed, 0, "maxium retries exceeeded", nil); err != nil {
 			return JobTask{}, fmt.Errorf("Could not update task with failure: %s", err), true
 		}
 
@@ -623,26 +648,71 @@ func startTask(c context.Context, ds appwrap.Datastore, taskIntf startTopIntf, t
 		} else if task.Status == TaskStatusFailed {
 			log.Infof("started even though we've already failed. interesting")
 			return JobTask{}, fmt.Errorf("restarted failed task"), false
-		} else if _, err := updateTask(ds, taskKey, TaskStatusRunning, 1, "", nil); err != nil {
+		} else if task.Status == TaskStatusDone {
+			// another attempt at the task (probably a speculative one) got there first
+			return task, errTaskAlreadyDone, false
+		} else if _, err := updateTask(store, taskId, TaskStatusRunning, 1, "", nil); err != nil {
 			return JobTask{}, fmt.Errorf("failed to update map task to running: %s", err), true
 		}
 
-		taskIntf.Status(task.Job.IntID(), task)
+		taskIntf.Status(task.JobId, task)
 		return task, nil, false
 	}
 }
 
-func endTask(c context.Context, ds appwrap.Datastore, taskIntf startTopIntf, jobKey *datastore.Key, taskKey *datastore.Key, resultErr error, result interface{}, log appwrap.Logging) error {
+// errTaskAlreadyDone is returned by startTask and endTask when another attempt at the task has
+// already finished it
+var errTaskAlreadyDone = fmt.Errorf("task already done")
+
+// completeTask marks a task as done with result and the attempt's counters, unless another attempt
+// at the task finished it first (in which case won is false and the task is left alone)
+func completeTask(store JobStore, taskId int64, speculative bool, result interface{}, counters *Counters) (task JobTask, won bool, err error) {
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return JobTask{}, false, err
+	}
+
+	task, err = store.UpdateTask(taskId, func(task *JobTask) error {
+		if won = task.Status != TaskStatusDone; !won {
+			return nil
+		}
+
+		task.Status = TaskStatusDone
+		task.Deferred = false
+		task.Info = ""
+		task.Result = string(resultBytes)
+		task.Counters = counters.encode()
+		task.Progress = 1
+		task.SpeculativeWon = speculative
+		task.UpdatedAt = time.Now()
+		return nil
+	})
+
+	return task, won, err
+}
+
+func endTask(c context.Context, store JobStore, taskIntf startTopIntf, jobId int64, taskId int64, resultErr error, result interface{}, counters *Counters, log appwrap.Logging) error {
 	if resultErr == nil {
-		if task, err := updateTask(ds, taskKey, TaskStatusDone, 0, "", result); err != nil {
+		if task, won, err := completeTask(store, taskId, false, result, counters); err != nil {
 			return fmt.Errorf("Could not update task: %s", err)
+		} else if !won {
+			return errTaskAlreadyDone
 		} else {
-			taskIntf.Status(jobKey.IntID(), task)
+			taskIntf.Status(jobId, task)
+		}
+	} else if resultErr == errJobCancelled {
+		if _, err := updateTask(store, taskId, TaskStatusCancelled, 0, "job cancelled", nil); err != nil {
+			return fmt.Errorf("Could not update task with cancellation: %s", err)
 		}
 	} else {
+		if task, err := store.GetTask(taskId); err == nil && task.Status == TaskStatusDone {
+			// this attempt failed, but a speculative one already finished the task
+			return errTaskAlreadyDone
+		}
+
 		if _, ok := resultErr.(tryAgainError); ok {
 			// wasn't fatal, go for it
-			if retryErr := retryTask(c, ds, taskIntf, jobKey, taskKey, log); retryErr != nil {
+			if retryErr := retryTask(c, store, taskIntf, jobId, taskId, log); retryErr != nil {
 				return fmt.Errorf("error retrying: %s (task failed due to: %s)", retryErr, resultErr)
 			} else {
 				log.Infof("retrying task due to %s", resultErr)
@@ -651,7 +721,7 @@ func endTask(c context.Context, ds appwrap.Datastore, taskIntf startTopIntf, job
 		}
 
 		// fatal error
-		if _, err := updateTask(ds, taskKey, TaskStatusFailed, 0, resultErr.Error(), nil); err != nil {
+		if _, err := updateTask(store, taskId, TaskStatusFailed, 0, resultErr.Error(), nil); err != nil {
 			return fmt.Errorf("Could not update task with failure: %s", err)
 		}
 	}
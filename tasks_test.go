@@ -18,7 +18,6 @@ import (
 	"github.com/pendo-io/appwrap"
 	"github.com/stretchr/testify/mock"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 	ck "gopkg.in/check.v1"
 	"time"
 )
@@ -38,99 +37,95 @@ func (mock *taskInterfaceMock) PostStatus(c context.Context, fullUrl string, log
 }
 
 func (mrt *MapreduceTests) TestJobStageComplete(c *ck.C) {
-	c.Skip("YOU SHALL NOT PASS! (Because the dual monitor patch broke it)")
-	ds := appwrap.NewLocalDatastore()
-	ctx := appwrap.StubContext()
+	store := NewMemoryJobStore()
 
-	jobKey, err := createJob(ds, "prefix", []string{}, "complete", false, "", 5)
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}, OnCompleteUrl: "complete", RetryCount: 5})
 	c.Assert(err, ck.IsNil)
 
 	checkStage := func(expected JobStage) {
-		var job JobInfo
-		err := ds.Get(jobKey, &job)
+		job, err := store.GetJob(jobId)
 		c.Assert(err, ck.IsNil)
 		c.Assert(job.Stage, ck.Equals, expected)
 	}
 
 	checkStage(StageFormation)
 
-	taskKeys := make([]*datastore.Key, 2)
-	tasks := make([]JobTask, len(taskKeys))
-	for i := range taskKeys {
-		taskKeys[i] = ds.NewKey(TaskEntity, "", int64(i+1), jobKey)
+	firstId, err := store.AllocateTaskIds(2)
+	c.Assert(err, ck.IsNil)
+	taskIds := makeTaskIds(firstId, 2)
+	tasks := make([]JobTask, len(taskIds))
+	for i := range taskIds {
 		tasks[i].Status = TaskStatusRunning
 		tasks[i].Type = TaskTypeMap
 	}
 
-	err = createTasks(ds, jobKey, taskKeys, tasks, StageMapping, mrt.nullLog)
+	err = createTasks(store, jobId, taskIds, tasks, StageMapping, mrt.nullLog)
 	c.Assert(err, ck.IsNil)
 	checkStage(StageMapping)
 
-	advanced, _, err := jobStageComplete(ds, jobKey, taskKeys, StageMapping, StageReducing, mrt.nullLog)
+	advanced, _, err := jobStageComplete(store, jobId, taskIds, StageMapping, StageReducing, mrt.nullLog)
 	c.Assert(err, ck.IsNil)
 	c.Assert(advanced, ck.Equals, false)
 
-	tasks[0].Status = TaskStatusDone
-	tasks[0].Done = jobKey
-	_, err = ds.Put(taskKeys[0], &tasks[0])
+	_, err = updateTask(store, taskIds[0], TaskStatusDone, 0, "", nil)
 	c.Assert(err, ck.IsNil)
-	advanced, _, err = jobStageComplete(ds, jobKey, taskKeys, StageMapping, StageReducing, mrt.nullLog)
+	advanced, _, err = jobStageComplete(store, jobId, taskIds, StageMapping, StageReducing, mrt.nullLog)
 	c.Assert(err, ck.IsNil)
 	c.Assert(advanced, ck.Equals, false)
 
-	tasks[1].Status = TaskStatusDone
-	tasks[1].Done = jobKey
-	_, err = ds.Put(taskKeys[1], &tasks[1])
+	_, err = updateTask(store, taskIds[1], TaskStatusDone, 0, "", nil)
 	c.Assert(err, ck.IsNil)
 
-	// this uses an index query, which is eventually consistent
-	advanced, _, err = jobStageComplete(ds, jobKey, taskKeys, StageMapping, StageReducing, mrt.nullLog)
+	advanced, _, err = jobStageComplete(store, jobId, taskIds, StageMapping, StageReducing, mrt.nullLog)
 	c.Assert(err, ck.IsNil)
 	c.Assert(advanced, ck.Equals, true)
 	checkStage(StageReducing)
 
 	// we're already at StageReducing, so nothing should happen here
-	advanced, _, err = jobStageComplete(ds, jobKey, taskKeys, StageMapping, StageReducing, mrt.nullLog)
-	c.Assert(err, ck.IsNil)
+	advanced, _, err = jobStageComplete(store, jobId, taskIds, StageMapping, StageReducing, mrt.nullLog)
+	c.Assert(err, ck.Equals, errMonitorJobConflict)
 	c.Assert(advanced, ck.Equals, false)
 	checkStage(StageReducing)
 
 	// let's fail a reducer and see what happens
-	reduceKeys := make([]*datastore.Key, 2)
-	reduceTasks := make([]JobTask, len(reduceKeys))
-	reduceKeys[0] = datastore.NewKey(ctx, TaskEntity, "", int64(1001), jobKey)
-	reduceKeys[1] = datastore.NewKey(ctx, TaskEntity, "", int64(1002), jobKey)
-	reduceTasks[0] = JobTask{
-		Status: TaskStatusFailed,
-		Info:   "reason for failure",
-		Done:   jobKey,
-		Type:   TaskTypeReduce,
-	}
-	reduceTasks[1] = JobTask{
-		Status: TaskStatusDone,
-		Done:   jobKey,
-		Type:   TaskTypeReduce,
+	firstId, err = store.AllocateTaskIds(2)
+	c.Assert(err, ck.IsNil)
+	reduceIds := makeTaskIds(firstId, 2)
+	reduceTasks := []JobTask{
+		{
+			Status: TaskStatusFailed,
+			Info:   "reason for failure",
+			Type:   TaskTypeReduce,
+		},
+		{
+			Status: TaskStatusDone,
+			Type:   TaskTypeReduce,
+		},
 	}
-	err = createTasks(ds, jobKey, reduceKeys, reduceTasks, StageReducing, mrt.nullLog)
+	err = createTasks(store, jobId, reduceIds, reduceTasks, StageReducing, mrt.nullLog)
 	c.Assert(err, ck.IsNil)
 
-	// this uses an index query, which is eventually consistent
-	advanced, checkJob, err := jobStageComplete(ds, jobKey, reduceKeys, StageReducing, StageDone, mrt.nullLog)
+	advanced, checkJob, err := jobStageComplete(store, jobId, reduceIds, StageReducing, StageDone, mrt.nullLog)
+	c.Assert(err, ck.NotNil)
 	c.Assert(advanced, ck.Equals, true)
 	c.Assert(checkJob.Stage, ck.Equals, StageFailed)
 	checkStage(StageFailed)
+
+	jobTasks, err := store.JobTasks(jobId)
+	c.Assert(err, ck.IsNil)
+	c.Assert(jobTasks, ck.HasLen, 4)
 }
 
 func (mrt *MapreduceTests) TestWaitForStageCompletion(c *ck.C) {
-	ds := appwrap.NewLocalDatastore()
+	store := NewMemoryJobStore()
 	ctx := appwrap.StubContext()
-	jobKey, err := createJob(ds, "prefix", []string{}, "complete", false, "", 5)
+	jobId, err := createJob(store, JobInfo{UrlPrefix: "prefix", WriterNames: []string{}, OnCompleteUrl: "complete", RetryCount: 5})
 	c.Assert(err, ck.IsNil)
 
 	taskMock := &taskInterfaceMock{}
 	count := 0
-	job, err := doWaitForStageCompletion(ctx, ds, taskMock, jobKey, StageMapping, StageReducing, 1*time.Millisecond,
-		func(ds appwrap.Datastore, jobKey *datastore.Key, tasks []*datastore.Key, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
+	job, err := doWaitForStageCompletion(ctx, store, taskMock, jobId, StageMapping, StageReducing, 1*time.Millisecond,
+		func(store JobStore, jobId int64, taskIds []int64, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
 			if count == 5 {
 				return true, JobInfo{UrlPrefix: "foo"}, nil
 			}
@@ -142,10 +137,10 @@ func (mrt *MapreduceTests) TestWaitForStageCompletion(c *ck.C) {
 	c.Assert(err, ck.IsNil)
 	c.Assert(job.UrlPrefix, ck.Equals, "foo")
 
-	taskMock.On("PostStatus", ctx, mock.Anything, mrt.nullLog).Return(nil).Once()
+	taskMock.On("PostStatus", ctx, mock.Anything).Return(nil).Once()
 
-	job, err = doWaitForStageCompletion(ctx, ds, taskMock, jobKey, StageMapping, StageReducing, 1*time.Millisecond,
-		func(ds appwrap.Datastore, jobKey *datastore.Key, tasks []*datastore.Key, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
+	job, err = doWaitForStageCompletion(ctx, store, taskMock, jobId, StageMapping, StageReducing, 1*time.Millisecond,
+		func(store JobStore, jobId int64, taskIds []int64, expectedStage, nextStage JobStage, log appwrap.Logging) (stageChanged bool, job JobInfo, finalErr error) {
 			// this is what happens when a task fails
 			return true, JobInfo{Stage: StageFailed}, taskError{"some failure"}
 		},